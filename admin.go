@@ -0,0 +1,205 @@
+package rcache
+
+import (
+	"context"
+	dbsql "database/sql"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	redis "github.com/redis/go-redis/v9"
+)
+
+// key在redis和数据库中的状态
+const (
+	KeyNotCached  = "not_cached" //不在redis中
+	KeyInSync     = "in_sync"    //redis与数据库一致
+	KeyDirty      = "dirty"      //等待写回
+	KeyDeadLetter = "dead_letter"
+	KeyDiverged   = "diverged" //redis中是干净的数据，但与数据库不一致
+)
+
+type DBRow struct {
+	Version  int    `json:"version"`
+	Value    string `json:"value"`
+	ExpireAt int64  `json:"expire_at,omitempty"` //小于0为墓碑，-ExpireAt为删除时间
+}
+
+type KeyInfo struct {
+	Key          string            `json:"key"`
+	State        string            `json:"state"`
+	Redis        map[string]string `json:"redis,omitempty"` //redis中的hash，value为编码后的原始数据
+	TTL          int64             `json:"ttl"`             //秒，-1表示不过期，-2表示不在redis中
+	DirtyVersion int               `json:"dirty_version,omitempty"`
+	Group        string            `json:"group,omitempty"` //事务写入的组id
+	DB           *DBRow            `json:"db,omitempty"`
+	DeadLetter   *DeadLetter       `json:"dead_letter,omitempty"`
+}
+
+// 读取key在redis和数据库中的原始数据，不会触发加载
+func (p *DataProxy) Inspect(ctx context.Context, key string) (info KeyInfo, err error) {
+	info.Key = key
+	ks := keysOf(p.redisC, key)
+	cc, cancel := context.WithTimeout(ctx, time.Second*5)
+	pipe := p.redisC.Pipeline()
+	hash := pipe.HGetAll(cc, key)
+	ttl := pipe.TTL(cc, key)
+	dirty := pipe.HGet(cc, ks.dirty, key)
+	group := pipe.HGet(cc, ks.dirtyGroup, key)
+	dead := pipe.HGet(cc, ks.deadLetter, key)
+	_, err = pipe.Exec(cc)
+	if err = p.checkError(cc, cancel, err); err != nil && err != redis.Nil {
+		return info, err
+	}
+	if len(hash.Val()) > 0 {
+		info.Redis = hash.Val()
+	}
+	//不过期和不存在时go-redis返回的是-1和-2，不是秒数
+	if d := ttl.Val(); d < 0 {
+		info.TTL = int64(d)
+	} else {
+		info.TTL = int64(d / time.Second)
+	}
+	info.DirtyVersion, _ = strconv.Atoi(dirty.Val())
+	info.Group = group.Val()
+	if dead.Val() != "" {
+		info.DeadLetter = &DeadLetter{Key: key}
+		json.Unmarshal([]byte(dead.Val()), info.DeadLetter)
+	}
+
+	cc, cancel = context.WithTimeout(ctx, time.Second*5)
+	r, err := queryRawRow(cc, p.dbc, key)
+	if err = p.checkError(cc, cancel, err); err == nil {
+		info.DB = &DBRow{Version: r.version, Value: r.value, ExpireAt: r.expireAt}
+	} else if err != dbsql.ErrNoRows {
+		return info, err
+	}
+
+	info.State = keyState(info)
+	return info, nil
+}
+
+func keyState(info KeyInfo) string {
+	switch {
+	case info.DeadLetter != nil && info.DeadLetter.Version == info.DirtyVersion:
+		return KeyDeadLetter
+	case info.DirtyVersion > 0:
+		return KeyDirty
+	case info.Redis == nil || info.Redis["version"] == "":
+		return KeyNotCached
+	}
+
+	now := time.Now().Unix()
+	version, _ := strconv.Atoi(info.Redis["version"])
+	expireAt, _ := strconv.ParseInt(info.Redis["expire_at"], 10, 64)
+	cached := cachedRow{row: row{version: version, value: info.Redis["value"], expireAt: expireAt}}
+	_, cached.deleted = info.Redis["__deleted__"]
+	var db *row
+	if info.DB != nil {
+		db = &row{version: info.DB.Version, value: info.DB.Value, expireAt: info.DB.ExpireAt}
+	}
+	if consistent(cached, db, now) {
+		return KeyInSync
+	}
+	return KeyDiverged
+}
+
+// 干净的缓存与数据库中的记录是否一致，db为nil表示数据库中没有记录
+func consistent(cached cachedRow, db *row, now int64) bool {
+	dbAlive := db != nil && (db.expireAt == 0 || db.expireAt > now)
+	if !cached.alive(now) {
+		return !dbAlive
+	}
+	return dbAlive && db.version == cached.version && db.value == cached.value && db.expireAt == cached.expireAt
+}
+
+type DirtyKey struct {
+	Key     string `json:"key"`
+	Version int    `json:"version"`
+}
+
+// 集群模式下DirtyKeys的cursor高位为slot，低slotCursorBits位为该slot中HSCAN的cursor
+const slotCursorBits = 50
+
+// 分页列出dirty key，cursor为0时从头开始，返回的next为0表示结束
+func (p *DataProxy) DirtyKeys(ctx context.Context, cursor uint64, count int) (keys []DirtyKey, next uint64, err error) {
+	slots, err := p.slots(ctx, func(ks slotKeys) string { return ks.dirty })
+	if err != nil {
+		return nil, 0, err
+	}
+	slot, cursor := int(cursor>>slotCursorBits), cursor&(1<<slotCursorBits-1)
+	for i, s := range slots {
+		if s < slot {
+			continue
+		} else if s > slot {
+			cursor = 0
+		}
+		cc, cancel := context.WithTimeout(ctx, time.Second*5)
+		kvs, next, err := p.redisC.HScan(cc, p.slotKeys(s).dirty, cursor, "", int64(count)).Result()
+		if err = p.checkError(cc, cancel, err); err != nil {
+			return nil, 0, err
+		}
+		for j := 0; j+1 < len(kvs); j += 2 {
+			keys = append(keys, DirtyKey{Key: kvs[j], Version: parseVersion(kvs[j+1])})
+		}
+		if next != 0 {
+			return keys, uint64(s)<<slotCursorBits | next, nil
+		}
+		if len(keys) >= count && i+1 < len(slots) {
+			return keys, uint64(slots[i+1]) << slotCursorBits, nil
+		}
+	}
+	return keys, 0, nil
+}
+
+func (p *DataProxy) DirtyCount(ctx context.Context) (n int64, err error) {
+	cc, cancel := context.WithTimeout(ctx, time.Second*5)
+	pipe := p.redisC.Pipeline()
+	var cmds []*redis.IntCmd
+	for _, slot := range p.allSlots() {
+		cmds = append(cmds, pipe.HLen(cc, p.slotKeys(slot).dirty))
+	}
+	_, err = pipe.Exec(cc)
+	if err = p.checkError(cc, cancel, err); err != nil {
+		return 0, err
+	}
+	for _, cmd := range cmds {
+		n += cmd.Val()
+	}
+	return n, nil
+}
+
+// 立即写回一个dirty key，事务写入的key整组写回。key不是dirty时什么也不做
+func (p *DataProxy) Flush(ctx context.Context, key string) (err error) {
+	ks := keysOf(p.redisC, key)
+	cc, cancel := context.WithTimeout(ctx, time.Second)
+	pipe := p.redisC.Pipeline()
+	dirty := pipe.HExists(cc, ks.dirty, key)
+	group := pipe.HGet(cc, ks.dirtyGroup, key)
+	_, err = pipe.Exec(cc)
+	if err = p.checkError(cc, cancel, err); err != nil && err != redis.Nil {
+		return err
+	}
+	if !dirty.Val() {
+		return nil
+	}
+	if gid := group.Val(); gid != "" {
+		if done, err := p.syncGroup(ctx, ks, gid); err != nil || done {
+			return err
+		}
+	}
+	return p.syncKey(ctx, key)
+}
+
+// 删除redis中的缓存，下次读取时从数据库重新加载。未写回的key返回err_dirty
+func (p *DataProxy) Evict(ctx context.Context, key string) (evicted bool, err error) {
+	cc, cancel := context.WithTimeout(ctx, time.Second)
+	evicted, err = redisEvict(cc, p.redisC, key, 0)
+	if err = p.checkError(cc, cancel, err); err != nil {
+		return false, err
+	}
+	if p.hotkey != nil {
+		p.hotkey.invalidate(key)
+	}
+	return evicted, nil
+}
@@ -0,0 +1,126 @@
+package rcache
+
+import (
+	"context"
+	dbsql "database/sql"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+type BreakerOptions struct {
+	Failures    int           //连续失败Failures次后熔断，默认5
+	OpenTimeout time.Duration //熔断后经过OpenTimeout允许一次探测，默认10s
+}
+
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+type breaker struct {
+	opt      BreakerOptions
+	mu       sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+	//设置后由probe代替请求探测，半开期间不放行请求，probe成功后才恢复，返回错误则继续熔断
+	probe func() error
+}
+
+func newBreaker(opt BreakerOptions) *breaker {
+	if opt.Failures <= 0 {
+		opt.Failures = 5
+	}
+	if opt.OpenTimeout <= 0 {
+		opt.OpenTimeout = 10 * time.Second
+	}
+	return &breaker{opt: opt}
+}
+
+// 是否允许访问后端，熔断状态下超时后放行一次探测
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.opt.OpenTimeout {
+			return false
+		}
+		b.state = breakerHalfOpen
+		if b.probe != nil {
+			go b.runProbe()
+			return false
+		}
+		return true
+	case breakerHalfOpen:
+		//探测尚未返回
+		return false
+	default:
+		return true
+	}
+}
+
+func (b *breaker) done(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if errors.Is(err, context.Canceled) {
+		//探测被取消，不能据此判断后端已恢复
+		if b.state == breakerHalfOpen {
+			b.state = breakerOpen
+		}
+		return
+	}
+
+	if !backendFailure(err) {
+		if b.probe != nil && b.state != breakerClosed {
+			//熔断前发出的请求，只有probe能恢复
+			return
+		}
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.opt.Failures {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+func (b *breaker) runProbe() {
+	err := b.probe()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err != nil {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+		return
+	}
+	b.state = breakerClosed
+	b.failures = 0
+}
+
+// 熔断且未开始探测，isOpen在半开时也返回true
+func (b *breaker) rejecting() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state == breakerOpen
+}
+
+func (b *breaker) isOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state != breakerClosed
+}
+
+// 只有后端本身的错误才计入熔断，业务错误(err_xxx)、数据不存在和调用方取消不计入
+func backendFailure(err error) bool {
+	if err == nil || err == dbsql.ErrNoRows || errors.Is(err, context.Canceled) {
+		return false
+	}
+	return !strings.HasPrefix(err.Error(), "err_")
+}
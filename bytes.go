@@ -0,0 +1,23 @@
+package rcache
+
+import (
+	"context"
+)
+
+// 二进制value的读写，value在redis、lua脚本和同步过程中按原始字节保存。
+// 包含NUL字节或非法UTF-8的value需要kv表的value列为bytea(见sql.go)
+func (p *DataProxy) GetBytes(ctx context.Context, key string, cacheTimeout ...int) (value []byte, ver int, err error) {
+	var v string
+	if v, ver, err = p.Get(ctx, key, cacheTimeout...); err == nil || err.Error() == "err_stale" {
+		value = []byte(v)
+	}
+	return value, ver, err
+}
+
+func (p *DataProxy) SetBytes(ctx context.Context, key string, value []byte, cacheTimeout ...int) (ver int, err error) {
+	return p.Set(ctx, key, string(value), cacheTimeout...)
+}
+
+func (p *DataProxy) SetBytesWithVersion(ctx context.Context, key string, value []byte, version int, cacheTimeout ...int) (ver int, err error) {
+	return p.SetWithVersion(ctx, key, string(value), version, cacheTimeout...)
+}
@@ -0,0 +1,281 @@
+package rcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	redis "github.com/redis/go-redis/v9"
+)
+
+type CDCOptions struct {
+	Stream string //变更流的key，默认__cdc__
+	MaxLen int64  //保留的条数上限(近似)，默认100000，超出后裁剪最早的变更
+}
+
+// 每次写入在同一个脚本中追加{key,version,op}到变更流，op为set、del或expire。
+// 变更流的顺序即redis中写入的顺序。变更流是单个key，不能与所有数据在同一个slot，
+// redis cluster下不记录变更，Consume返回err_cdc_cluster
+func WithCDC(opt CDCOptions) Option {
+	return func(p *DataProxy) {
+		if opt.Stream == "" {
+			opt.Stream = "__cdc__"
+		}
+		if opt.MaxLen <= 0 {
+			opt.MaxLen = 100000
+		}
+		p.cdc = &opt
+	}
+}
+
+func (o *CDCOptions) xadd(key string, version int, op string) *redis.XAddArgs {
+	return &redis.XAddArgs{
+		Stream: o.Stream,
+		MaxLen: o.MaxLen,
+		Approx: true,
+		Values: []any{"key", key, "version", version, "op", op},
+	}
+}
+
+// 是否记录变更流
+func (p *DataProxy) capturing() bool {
+	return p.cdc != nil && !p.cluster
+}
+
+func (p *DataProxy) recorder() recorder {
+	r := recorder{history: p.history != nil}
+	if p.capturing() {
+		r.stream, r.maxLen = p.cdc.Stream, p.cdc.MaxLen
+	}
+	return r
+}
+
+type Change struct {
+	ID      string //变更流中的id
+	Key     string
+	Version int    //写入的版本号
+	Op      string //set、del或expire
+	//处理时读取的当前数据，可能比Version更新，之后还会收到更新的变更。key不存在时Exists为false
+	Value          string
+	CurrentVersion int
+	Exists         bool
+}
+
+// 变更流被裁剪时消费组还没有读取的变更，(LastDelivered,MaxDeleted]之间的变更已经丢失
+type Gap struct {
+	LastDelivered string
+	MaxDeleted    string
+}
+
+type ConsumeOptions struct {
+	Group    string        //消费组，必须设置
+	Consumer string        //组内的消费者，默认为hostname-pid。需要严格按顺序处理时每个组只使用一个消费者
+	StartID  string        //创建消费组时开始的位置，默认"0"从头开始，"$"只处理之后的变更
+	Batch    int64         //每次读取的条数，默认100
+	Block    time.Duration //没有新的变更时等待的时间，默认5s
+	//发现丢失的变更时调用，通常需要全量核对下游的数据，返回错误时Consume退出。
+	//未设置时Consume返回err_cdc_gap
+	OnGap func(ctx context.Context, gap Gap) error
+}
+
+// 以消费组的方式按顺序处理变更流，直到ctx结束或handle返回错误。
+// handle成功后确认(XACK)，失败的变更保留在消费组的pending列表中，下次Consume时首先重新处理
+func (p *DataProxy) Consume(ctx context.Context, opt ConsumeOptions, handle func(ctx context.Context, c Change) error) error {
+	if p.cdc == nil {
+		return errors.New("err_cdc_disabled")
+	} else if p.cluster {
+		return errors.New("err_cdc_cluster")
+	}
+	if opt.Group == "" {
+		return errors.New("rcache: ConsumeOptions.Group is required")
+	}
+	if opt.Consumer == "" {
+		host, _ := os.Hostname()
+		opt.Consumer = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+	if opt.StartID == "" {
+		opt.StartID = "0"
+	}
+	if opt.Batch <= 0 {
+		opt.Batch = 100
+	}
+	if opt.Block <= 0 {
+		opt.Block = time.Second * 5
+	}
+
+	c := &consumer{p: p, opt: opt, handle: handle}
+	err := p.redisC.XGroupCreateMkStream(ctx, p.cdc.Stream, opt.Group, opt.StartID).Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+
+	//先处理已经读取但没有确认的变更
+	for {
+		msgs, err := c.read(ctx, "0", 0)
+		if err == nil && len(msgs) > 0 {
+			err = c.deliver(ctx, msgs)
+		}
+		if err != nil {
+			return err
+		} else if len(msgs) == 0 {
+			break
+		}
+	}
+
+	if c.delivered, err = c.lastDelivered(ctx); err != nil {
+		return err
+	}
+	for {
+		//读取时会越过已经裁剪的位置，需要与读取前的位置比较
+		prev := c.delivered
+		var msgs []redis.XMessage
+		if msgs, err = c.read(ctx, ">", opt.Block); err == nil {
+			if len(msgs) > 0 {
+				c.delivered = msgs[len(msgs)-1].ID
+			}
+			if err = c.checkGap(ctx, prev); err == nil {
+				err = c.deliver(ctx, msgs)
+			}
+		}
+		if ctx.Err() != nil {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+type consumer struct {
+	p         *DataProxy
+	opt       ConsumeOptions
+	handle    func(ctx context.Context, c Change) error
+	reported  string //已经报告过的裁剪位置
+	delivered string //消费组最后读取的id
+}
+
+// 读取一批变更
+func (c *consumer) read(ctx context.Context, id string, block time.Duration) (msgs []redis.XMessage, err error) {
+	args := &redis.XReadGroupArgs{
+		Group:    c.opt.Group,
+		Consumer: c.opt.Consumer,
+		Streams:  []string{c.p.cdc.Stream, id},
+		Count:    c.opt.Batch,
+		Block:    block,
+	}
+	if block == 0 {
+		//0表示一直阻塞，读取pending时不阻塞
+		args.Block = -1
+	}
+	streams, err := c.p.redisC.XReadGroup(ctx, args).Result()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, s := range streams {
+		msgs = append(msgs, s.Messages...)
+	}
+	return msgs, nil
+}
+
+// 按顺序处理并确认
+func (c *consumer) deliver(ctx context.Context, msgs []redis.XMessage) (err error) {
+	for _, msg := range msgs {
+		if len(msg.Values) == 0 {
+			//pending中的变更已经被裁剪
+			if err = c.gap(ctx, Gap{LastDelivered: msg.ID, MaxDeleted: msg.ID}); err != nil {
+				return err
+			}
+		} else if err = c.process(ctx, msg); err != nil {
+			return err
+		}
+		if err = c.p.redisC.XAck(ctx, c.p.cdc.Stream, c.opt.Group, msg.ID).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *consumer) process(ctx context.Context, msg redis.XMessage) error {
+	change := Change{ID: msg.ID}
+	change.Key, _ = msg.Values["key"].(string)
+	change.Op, _ = msg.Values["op"].(string)
+	if v, ok := msg.Values["version"].(string); ok {
+		change.Version, _ = strconv.Atoi(v)
+	}
+
+	value, ver, err := c.p.Get(ctx, change.Key)
+	switch {
+	case err == nil || err.Error() == "err_stale":
+		//冷存储不可用时的陈旧数据同样存在，之后的变更会带来更新的数据
+		change.Value, change.CurrentVersion, change.Exists = value, ver, true
+	case err.Error() != "err_not_exist":
+		return err
+	}
+	return c.handle(ctx, change)
+}
+
+func (c *consumer) lastDelivered(ctx context.Context) (string, error) {
+	groups, err := c.p.redisC.XInfoGroups(ctx, c.p.cdc.Stream).Result()
+	if err != nil {
+		return "", err
+	}
+	for _, g := range groups {
+		if g.Name == c.opt.Group {
+			return g.LastDeliveredID, nil
+		}
+	}
+	return "", fmt.Errorf("rcache: consumer group %s not found", c.opt.Group)
+}
+
+// 裁剪掉的最大id比读取前消费组最后读取的id(prev)大，说明有变更没有被读取
+func (c *consumer) checkGap(ctx context.Context, prev string) error {
+	info, err := c.p.redisC.XInfoStream(ctx, c.p.cdc.Stream).Result()
+	if err != nil {
+		return err
+	}
+	if info.MaxDeletedEntryID == "" || info.MaxDeletedEntryID == c.reported {
+		return nil
+	}
+	if compareStreamID(info.MaxDeletedEntryID, prev) > 0 {
+		c.reported = info.MaxDeletedEntryID
+		return c.gap(ctx, Gap{LastDelivered: prev, MaxDeleted: info.MaxDeletedEntryID})
+	}
+	return nil
+}
+
+func (c *consumer) gap(ctx context.Context, gap Gap) error {
+	if c.opt.OnGap == nil {
+		return errors.New("err_cdc_gap")
+	}
+	return c.opt.OnGap(ctx, gap)
+}
+
+// 比较两个stream id(毫秒-序号)
+func compareStreamID(a, b string) int {
+	parse := func(id string) (ms, seq uint64) {
+		m, s, _ := strings.Cut(id, "-")
+		ms, _ = strconv.ParseUint(m, 10, 64)
+		seq, _ = strconv.ParseUint(s, 10, 64)
+		return ms, seq
+	}
+	ams, aseq := parse(a)
+	bms, bseq := parse(b)
+	switch {
+	case ams != bms:
+		if ams < bms {
+			return -1
+		}
+		return 1
+	case aseq != bseq:
+		if aseq < bseq {
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,264 @@
+// client通过rcached(cmd/rcached)访问rcache，实现了rcache.Store，
+// 与嵌入的rcache.DataProxy只需更换构造函数即可切换。
+package client
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	redis "github.com/redis/go-redis/v9"
+	"github.com/sniperHW/rcache"
+)
+
+type Options struct {
+	Addr     string
+	Password string
+
+	PoolSize     int           //连接池大小，默认10*GOMAXPROCS
+	MinIdleConns int           //最少保持的空闲连接数
+	DialTimeout  time.Duration //默认5秒
+	ReadTimeout  time.Duration //默认3秒
+	WriteTimeout time.Duration //默认与ReadTimeout一致
+
+	ReadRetries  int           //读取遇到网络错误时的重试次数，写入不会重试，默认2
+	RetryBackoff time.Duration //重试前的等待时间，默认10ms
+	Retry        rcache.RetryPolicy
+	//Retry为Update版本号冲突时的重试策略，默认rcache.DefaultRetryPolicy
+}
+
+// 服务端返回的rcache错误，Error()返回错误码，与DataProxy返回的错误一致
+type Error struct {
+	Code    string
+	Message string //服务端返回的完整错误信息
+}
+
+func (e *Error) Error() string {
+	return e.Code
+}
+
+type Client struct {
+	rc  *redis.Client
+	opt Options
+}
+
+var _ rcache.Store = (*Client)(nil)
+
+func New(opt Options) *Client {
+	if opt.ReadRetries == 0 {
+		opt.ReadRetries = 2
+	} else if opt.ReadRetries < 0 {
+		opt.ReadRetries = 0
+	}
+	if opt.RetryBackoff <= 0 {
+		opt.RetryBackoff = time.Millisecond * 10
+	}
+	if opt.Retry.MaxAttempts == 0 {
+		opt.Retry = rcache.DefaultRetryPolicy
+	}
+	return &Client{
+		opt: opt,
+		rc: redis.NewClient(&redis.Options{
+			Addr:         opt.Addr,
+			Password:     opt.Password,
+			PoolSize:     opt.PoolSize,
+			MinIdleConns: opt.MinIdleConns,
+			DialTimeout:  opt.DialTimeout,
+			ReadTimeout:  opt.ReadTimeout,
+			WriteTimeout: opt.WriteTimeout,
+			//写入不是幂等的，重试由Client控制
+			MaxRetries:      -1,
+			DisableIdentity: true,
+		}),
+	}
+}
+
+func (c *Client) Close() error {
+	return c.rc.Close()
+}
+
+// 将服务端的错误回复转换为*Error，格式为"TYPE err_xxx"
+func mapError(err error) error {
+	if err == nil || err == redis.Nil {
+		return err
+	}
+	var re redis.Error
+	if errors.As(err, &re) {
+		msg := re.Error()
+		fields := strings.Fields(msg)
+		if len(fields) > 0 {
+			if code := fields[len(fields)-1]; strings.HasPrefix(code, "err_") {
+				return &Error{Code: code, Message: msg}
+			}
+		}
+	}
+	return err
+}
+
+// 网络错误可以重试，服务端返回的错误和ctx的错误不重试
+func retryable(err error) bool {
+	if err == nil || err == redis.Nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var re redis.Error
+	if errors.As(err, &re) {
+		return false
+	}
+	var ne net.Error
+	return errors.As(err, &ne) || errors.Is(err, net.ErrClosed) || strings.Contains(err.Error(), "EOF")
+}
+
+// 幂等的读取，网络错误时重试
+func (c *Client) read(ctx context.Context, args ...any) (result any, err error) {
+	for i := 0; ; i++ {
+		if result, err = c.rc.Do(ctx, args...).Result(); !retryable(err) || i >= c.opt.ReadRetries {
+			return result, mapError(err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(c.opt.RetryBackoff):
+		}
+	}
+}
+
+func (c *Client) write(ctx context.Context, args ...any) (result any, err error) {
+	result, err = c.rc.Do(ctx, args...).Result()
+	return result, mapError(err)
+}
+
+func toInt(v any) (int64, error) {
+	switch n := v.(type) {
+	case int64:
+		return n, nil
+	case string:
+		return strconv.ParseInt(n, 10, 64)
+	default:
+		return 0, errors.New("err_unexpected_reply")
+	}
+}
+
+func (c *Client) writeVersion(ctx context.Context, args ...any) (ver int, err error) {
+	var r any
+	if r, err = c.write(ctx, args...); err != nil {
+		return 0, err
+	}
+	n, err := toInt(r)
+	return int(n), err
+}
+
+func (c *Client) Get(ctx context.Context, key string, cacheTimeout ...int) (value string, ver int, err error) {
+	r, err := c.read(ctx, "VGET", key)
+	if err == redis.Nil {
+		return "", 0, &Error{Code: "err_not_exist"}
+	} else if err != nil {
+		return "", 0, err
+	}
+
+	items, ok := r.([]any)
+	if !ok || len(items) < 2 {
+		return "", 0, errors.New("err_unexpected_reply")
+	}
+	value, _ = items[0].(string)
+	n, err := toInt(items[1])
+	if err != nil {
+		return "", 0, err
+	}
+	if len(items) > 2 {
+		//服务端的冷存储不可用，返回的是陈旧数据
+		err = &Error{Code: "err_stale"}
+	}
+	return value, int(n), err
+}
+
+// RESP的字符串是二进制安全的，value按原始字节传输
+func (c *Client) GetBytes(ctx context.Context, key string, cacheTimeout ...int) (value []byte, ver int, err error) {
+	var v string
+	if v, ver, err = c.Get(ctx, key); err == nil || err.Error() == "err_stale" {
+		value = []byte(v)
+	}
+	return value, ver, err
+}
+
+func (c *Client) Set(ctx context.Context, key string, value string, cacheTimeout ...int) (ver int, err error) {
+	return c.writeVersion(ctx, "VSET", key, value, 0)
+}
+
+func (c *Client) SetWithVersion(ctx context.Context, key string, value string, version int, cacheTimeout ...int) (ver int, err error) {
+	return c.writeVersion(ctx, "VSET", key, value, version)
+}
+
+func (c *Client) SetBytes(ctx context.Context, key string, value []byte, cacheTimeout ...int) (ver int, err error) {
+	return c.writeVersion(ctx, "VSET", key, value, 0)
+}
+
+func (c *Client) SetBytesWithVersion(ctx context.Context, key string, value []byte, version int, cacheTimeout ...int) (ver int, err error) {
+	return c.writeVersion(ctx, "VSET", key, value, version)
+}
+
+func (c *Client) SetNX(ctx context.Context, key string, value string, cacheTimeout ...int) (ver int, err error) {
+	return c.writeVersion(ctx, "VSETNX", key, value)
+}
+
+func (c *Client) SetIfExists(ctx context.Context, key string, value string, cacheTimeout ...int) (ver int, err error) {
+	return c.writeVersion(ctx, "VSETXX", key, value)
+}
+
+// expireAt为零值时与DataProxy一致，不设置过期时间
+func (c *Client) SetWithExpiry(ctx context.Context, key string, value string, expireAt time.Time, cacheTimeout ...int) (ver int, err error) {
+	if expireAt.IsZero() {
+		return c.writeVersion(ctx, "VSET", key, value, 0)
+	}
+	return c.writeVersion(ctx, "VSETEXAT", key, value, expireAt.Unix())
+}
+
+func (c *Client) ExpireAt(ctx context.Context, key string, expireAt time.Time, cacheTimeout ...int) (ver int, err error) {
+	var at int64
+	if !expireAt.IsZero() {
+		at = expireAt.Unix()
+	}
+	return c.writeVersion(ctx, "VEXPIREAT", key, at)
+}
+
+func (c *Client) Delete(ctx context.Context, key string, cacheTimeout ...int) (err error) {
+	return c.CompareAndDelete(ctx, key, 0)
+}
+
+func (c *Client) CompareAndDelete(ctx context.Context, key string, version int, cacheTimeout ...int) (err error) {
+	n, err := c.writeVersion(ctx, "VDEL", key, version)
+	if err == nil && n == 0 {
+		err = &Error{Code: "err_not_exist"}
+	}
+	return err
+}
+
+func (c *Client) IncrBy(ctx context.Context, key string, delta int64, cacheTimeout ...int) (value int64, ver int, err error) {
+	r, err := c.write(ctx, "VINCRBY", key, delta)
+	if err != nil {
+		return 0, 0, err
+	}
+	items, ok := r.([]any)
+	if !ok || len(items) != 2 {
+		return 0, 0, errors.New("err_unexpected_reply")
+	}
+	if value, err = toInt(items[0]); err != nil {
+		return 0, 0, err
+	}
+	n, err := toInt(items[1])
+	return value, int(n), err
+}
+
+func (c *Client) DecrBy(ctx context.Context, key string, delta int64, cacheTimeout ...int) (value int64, ver int, err error) {
+	if delta == math.MinInt64 {
+		return 0, 0, &Error{Code: "err_out_of_range"}
+	}
+	return c.IncrBy(ctx, key, -delta)
+}
+
+func (c *Client) Update(ctx context.Context, key string, fn func(old string, exists bool) (string, error), cacheTimeout ...int) (ver int, err error) {
+	return rcache.UpdateStore(ctx, c, key, c.opt.Retry, fn)
+}
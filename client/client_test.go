@@ -0,0 +1,33 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	redis "github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+type replyError string
+
+func (e replyError) Error() string { return string(e) }
+func (replyError) RedisError()     {}
+
+var _ redis.Error = replyError("")
+
+func TestMapError(t *testing.T) {
+	err := mapError(replyError("VERSION_NOT_MATCH err_version_not_match"))
+	var e *Error
+	assert.True(t, errors.As(err, &e))
+	assert.Equal(t, "err_version_not_match", err.Error())
+
+	//不是rcache错误码的错误原样返回
+	err = mapError(replyError("ERR unknown command 'FOO'"))
+	assert.Equal(t, "ERR unknown command 'FOO'", err.Error())
+
+	assert.True(t, retryable(io.EOF))
+	assert.False(t, retryable(replyError("NOT_EXIST err_not_exist")))
+	assert.False(t, retryable(context.DeadlineExceeded))
+}
@@ -0,0 +1,175 @@
+package rcache
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	redis "github.com/redis/go-redis/v9"
+)
+
+// redis cluster中脚本访问的key必须在同一个hash slot。集群模式下dirty标记、事务组、历史记录和
+// dead letter按数据key所在的slot分开保存，名字后面加上映射到该slot的hash tag，如__dirty__{3ck}。
+// 单节点和sentinel仍然只有一份
+const slotCount = 16384
+
+// 未开启的功能(历史记录、变更流)在KEYS中的占位，集群模式下空字符串也会被当作其它slot的key
+const noneKey = "__none__"
+
+// 与数据key在同一个slot的内部key
+type slotKeys struct {
+	dirty      string
+	dirtyGroup string
+	groups     string
+	groupSeq   string
+	history    string
+	deadLetter string
+	none       string
+}
+
+var globalKeys = slotKeys{dirtyKey, dirtyGroupKey, groupsKey, groupSeqKey, historyKey, deadLetterKey, ""}
+
+// 是否为rcache内部使用的key，集群模式下带有slot的hash tag
+func isInternalKey(key string) bool {
+	if i := strings.IndexByte(key, '{'); i > 0 && strings.HasSuffix(key, "}") {
+		key = key[:i]
+	}
+	switch key {
+	case dirtyKey, dirtyGroupKey, groupsKey, groupSeqKey, historyKey, deadLetterKey, noneKey:
+		return true
+	}
+	return false
+}
+
+func isCluster(c redis.UniversalClient) bool {
+	_, ok := c.(*redis.ClusterClient)
+	return ok
+}
+
+func keysOf(c redis.UniversalClient, key string) slotKeys {
+	if !isCluster(c) {
+		return globalKeys
+	}
+	return keysOfSlot(keySlot(key))
+}
+
+func keysOfSlot(slot int) slotKeys {
+	tag := "{" + slotTag(slot) + "}"
+	return slotKeys{
+		dirty:      dirtyKey + tag,
+		dirtyGroup: dirtyGroupKey + tag,
+		groups:     groupsKey + tag,
+		groupSeq:   groupSeqKey + tag,
+		history:    historyKey + tag,
+		deadLetter: deadLetterKey + tag,
+		none:       noneKey + tag,
+	}
+}
+
+// 与redis cluster的算法一致：key中有非空的{...}时只计算第一个{}中的部分
+func keySlot(key string) int {
+	if s := strings.IndexByte(key, '{'); s >= 0 {
+		if e := strings.IndexByte(key[s+1:], '}'); e > 0 {
+			key = key[s+1 : s+1+e]
+		}
+	}
+	return int(crc16(key) % slotCount)
+}
+
+// CRC16-CCITT(XMODEM)
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+var (
+	slotTagsOnce sync.Once
+	slotTags     []string
+)
+
+// 每个slot的hash tag，按36进制从小到大枚举，取第一个映射到该slot的字符串
+func slotTag(slot int) string {
+	slotTagsOnce.Do(func() {
+		slotTags = make([]string, slotCount)
+		for i, n := int64(0), 0; n < slotCount; i++ {
+			s := strconv.FormatInt(i, 36)
+			if t := &slotTags[crc16(s)%slotCount]; *t == "" {
+				*t = s
+				n++
+			}
+		}
+	})
+	return slotTags[slot]
+}
+
+func (p *DataProxy) slotKeys(slot int) slotKeys {
+	if !p.cluster {
+		return globalKeys
+	}
+	return keysOfSlot(slot)
+}
+
+// 所有slot，单节点时只有0
+func (p *DataProxy) allSlots() []int {
+	n := 1
+	if p.cluster {
+		n = slotCount
+	}
+	slots := make([]int, n)
+	for i := range slots {
+		slots[i] = i
+	}
+	return slots
+}
+
+// name对应的内部key存在的slot，按slot升序。单节点时总是返回0，
+// 集群模式下用pipeline检查所有slot
+func (p *DataProxy) slots(ctx context.Context, name func(ks slotKeys) string) (slots []int, err error) {
+	if !p.cluster {
+		return []int{0}, nil
+	}
+	cc, cancel := context.WithTimeout(ctx, time.Second*5)
+	pipe := p.redisC.Pipeline()
+	cmds := make([]*redis.IntCmd, slotCount)
+	for i := range cmds {
+		cmds[i] = pipe.Exists(cc, name(keysOfSlot(i)))
+	}
+	_, err = pipe.Exec(cc)
+	if err = p.checkError(cc, cancel, err); err != nil {
+		return nil, err
+	}
+	for i, cmd := range cmds {
+		if cmd.Val() > 0 {
+			slots = append(slots, i)
+		}
+	}
+	return slots, nil
+}
+
+// 所有的master节点，用于SCAN等只在一个节点上执行的命令。单节点时为redisC本身
+func (p *DataProxy) nodes(ctx context.Context) (nodes []redis.UniversalClient, err error) {
+	c, ok := p.redisC.(*redis.ClusterClient)
+	if !ok {
+		return []redis.UniversalClient{p.redisC}, nil
+	}
+	var mu sync.Mutex
+	err = c.ForEachMaster(ctx, func(ctx context.Context, c *redis.Client) error {
+		mu.Lock()
+		nodes = append(nodes, c)
+		mu.Unlock()
+		return nil
+	})
+	return nodes, err
+}
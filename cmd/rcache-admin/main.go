@@ -0,0 +1,481 @@
+// rcache-admin用于排查和处理rcache中的key：
+//
+//	inspect <key>             redis中的hash、ttl、dirty版本、数据库记录以及两者是否一致
+//	dirty ls [limit]          列出等待写回的key，默认最多100个
+//	dirty count               等待写回的key的数量
+//	flush <key>               立即写回一个dirty key
+//	evict <key>               删除redis中的缓存，dirty的key拒绝删除
+//	resync                    执行一次完整的写回
+//	deadletter ls             列出数据库拒绝写入的key
+//	deadletter retry <key>    重新写回
+//	deadletter discard <key>  丢弃redis中未写回的修改，以数据库为准
+//	verify [-prefix p] [-sample rate] [-repair [-writeback-missing]]
+//	                          比较redis和数据库，存在未修复的不一致时退出码为3
+//	export [-format jsonl|copy] [file]
+//	                          导出所有key，默认输出到标准输出
+//	import [-format jsonl|copy] [-mode overwrite|skip|newer] [file]
+//	                          导入export导出的数据，默认从标准输入读取
+//
+// 使用-o json输出json，默认输出表格
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	redis "github.com/redis/go-redis/v9"
+	"github.com/sniperHW/rcache"
+)
+
+type admin struct {
+	proxy *rcache.DataProxy
+	out   io.Writer
+	json  bool
+}
+
+func main() {
+	redisAddr := flag.String("redis", "localhost:6379", "redis address")
+	redisPassword := flag.String("redis-password", "", "redis password")
+	dsn := flag.String("pg", "host=localhost port=5432 dbname=test user=postgres sslmode=disable", "pgsql dsn")
+	configPath := flag.String("config", "", "yaml config file, overrides -redis, -redis-password and -pg")
+	output := flag.String("o", "table", "output format: table or json")
+	timeout := flag.Duration("timeout", time.Minute, "timeout of the command")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: rcache-admin [flags] inspect|dirty|flush|evict|resync|deadletter|verify|export|import ...\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *output != "table" && *output != "json" {
+		fatal(fmt.Errorf("unknown output format %q", *output))
+	}
+
+	var proxy *rcache.DataProxy
+	if *configPath != "" {
+		cfg, err := rcache.LoadConfig(*configPath)
+		if err != nil {
+			fatal(err)
+		}
+		if proxy, err = rcache.NewFromConfig(cfg); err != nil {
+			fatal(err)
+		}
+	} else {
+		redisC := redis.NewClient(&redis.Options{
+			Addr:     *redisAddr,
+			Password: *redisPassword,
+		})
+		dbc, err := sqlx.Open("postgres", *dsn)
+		if err != nil {
+			fatal(err)
+		}
+		defer redisC.Close()
+		defer dbc.Close()
+		rcache.InitScript()
+		proxy = rcache.NewDataProxy(redisC, dbc)
+	}
+	defer proxy.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	a := &admin{proxy: proxy, out: os.Stdout, json: *output == "json"}
+	if err := a.run(ctx, flag.Args()); err == errDiverged {
+		fmt.Fprintln(os.Stderr, "rcache-admin:", err)
+		os.Exit(3)
+	} else if err != nil {
+		fatal(err)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "rcache-admin:", err)
+	os.Exit(1)
+}
+
+var errUsage = errors.New("invalid arguments, see rcache-admin -h")
+
+func (a *admin) run(ctx context.Context, args []string) error {
+	switch args[0] {
+	case "inspect":
+		if len(args) != 2 {
+			return errUsage
+		}
+		info, err := a.proxy.Inspect(ctx, args[1])
+		if err != nil {
+			return err
+		}
+		return a.inspect(info)
+	case "dirty":
+		if len(args) < 2 {
+			return errUsage
+		}
+		switch args[1] {
+		case "ls":
+			limit := 100
+			if len(args) > 2 {
+				var err error
+				if limit, err = strconv.Atoi(args[2]); err != nil || limit <= 0 {
+					return errUsage
+				}
+			}
+			return a.dirtyList(ctx, limit)
+		case "count":
+			n, err := a.proxy.DirtyCount(ctx)
+			if err != nil {
+				return err
+			}
+			return a.print(map[string]int64{"dirty": n}, [][]string{{"DIRTY"}, {strconv.FormatInt(n, 10)}})
+		}
+		return errUsage
+	case "flush":
+		if len(args) != 2 {
+			return errUsage
+		}
+		if err := a.proxy.Flush(ctx, args[1]); err != nil {
+			return err
+		}
+		return a.afterWrite(ctx, args[1])
+	case "evict":
+		if len(args) != 2 {
+			return errUsage
+		}
+		evicted, err := a.proxy.Evict(ctx, args[1])
+		if err != nil && err.Error() == "err_dirty" {
+			return fmt.Errorf("%s has not been written back, flush it before evicting", args[1])
+		} else if err != nil {
+			return err
+		}
+		return a.print(map[string]any{"key": args[1], "evicted": evicted}, [][]string{{"KEY", "EVICTED"}, {args[1], strconv.FormatBool(evicted)}})
+	case "resync":
+		if len(args) != 1 {
+			return errUsage
+		}
+		if err := a.proxy.SyncDirtyToDB(ctx); err != nil {
+			return err
+		}
+		n, err := a.proxy.DirtyCount(ctx)
+		if err != nil {
+			return err
+		}
+		letters, err := a.proxy.DeadLetters(ctx)
+		if err != nil {
+			return err
+		}
+		return a.print(map[string]any{"dirty": n, "dead_letters": len(letters)},
+			[][]string{{"DIRTY", "DEAD LETTERS"}, {strconv.FormatInt(n, 10), strconv.Itoa(len(letters))}})
+	case "deadletter":
+		if len(args) < 2 {
+			return errUsage
+		}
+		switch {
+		case args[1] == "ls" && len(args) == 2:
+			return a.deadLetters(ctx)
+		case args[1] == "retry" && len(args) == 3:
+			if err := a.proxy.RetryDeadLetter(ctx, args[2]); err != nil {
+				return err
+			}
+			return a.afterWrite(ctx, args[2])
+		case args[1] == "discard" && len(args) == 3:
+			if err := a.proxy.DiscardDeadLetter(ctx, args[2]); err != nil {
+				return err
+			}
+			return a.afterWrite(ctx, args[2])
+		}
+		return errUsage
+	case "verify":
+		return a.verify(ctx, args[1:])
+	case "export":
+		return a.export(ctx, args[1:])
+	case "import":
+		return a.importFile(ctx, args[1:])
+	}
+	return errUsage
+}
+
+// 存在未修复的不一致时退出码为3
+var errDiverged = errors.New("found divergences that were not repaired")
+
+func (a *admin) verify(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	prefix := fs.String("prefix", "", "only verify keys with this prefix")
+	sample := fs.Float64("sample", 0, "verify a random sample of keys at this rate (0,1), default all keys")
+	repair := fs.Bool("repair", false, "repair divergences by evicting the cache or writing back lost versions")
+	missing := fs.Bool("writeback-missing", false, "with -repair, also write back cached keys that have no row in the database")
+	if err := fs.Parse(args); err != nil || fs.NArg() > 0 {
+		return errUsage
+	}
+
+	report, err := a.proxy.Verify(ctx, rcache.VerifyOptions{Prefix: *prefix, SampleRate: *sample, Repair: *repair, WritebackMissing: *missing})
+	if err != nil {
+		return err
+	}
+	diverged := -report.Counts[rcache.DivergeRepairFailed]
+	for _, n := range report.Counts {
+		diverged += n
+	}
+
+	if a.json {
+		if err = a.print(report, nil); err != nil {
+			return err
+		}
+	} else {
+		rows := [][]string{
+			{"DB ROWS", "CACHE ONLY", "DIRTY", "DIVERGED", "REPAIRED", "SECONDS"},
+			{strconv.Itoa(report.DBRows), strconv.Itoa(report.CachedKeys), strconv.Itoa(report.Dirty),
+				strconv.Itoa(diverged), strconv.Itoa(report.Repaired),
+				fmt.Sprintf("%.1f", report.Finished.Sub(report.Started).Seconds())},
+		}
+		if len(report.Divergences) > 0 {
+			rows = append(rows, []string{}, []string{"KEY", "KIND", "CACHE VERSION", "DB VERSION", "REPAIR", "RESULT"})
+			for _, d := range report.Divergences {
+				result, repair := "-", d.Repair
+				if repair == "" {
+					repair = "-"
+				}
+				if d.Repaired {
+					result = "repaired"
+				} else if d.Error != "" {
+					result = d.Error
+				}
+				rows = append(rows, []string{d.Key, d.Kind, strconv.Itoa(d.CacheVersion), strconv.Itoa(d.DBVersion), repair, result})
+			}
+		}
+		if report.Truncated {
+			rows = append(rows, []string{"(more divergences omitted)"})
+		}
+		if err = a.table(rows); err != nil {
+			return err
+		}
+	}
+
+	if diverged > report.Repaired {
+		return errDiverged
+	}
+	return nil
+}
+
+func parseFormat(s string) (rcache.Format, error) {
+	switch s {
+	case "jsonl":
+		return rcache.FormatJSONL, nil
+	case "copy":
+		return rcache.FormatCopy, nil
+	}
+	return 0, fmt.Errorf("unknown format %q", s)
+}
+
+func (a *admin) export(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := fs.String("format", "jsonl", "jsonl or copy")
+	if err := fs.Parse(args); err != nil || fs.NArg() > 1 {
+		return errUsage
+	}
+	f, err := parseFormat(*format)
+	if err != nil {
+		return err
+	}
+
+	w := os.Stdout
+	if fs.NArg() == 1 {
+		if w, err = os.Create(fs.Arg(0)); err != nil {
+			return err
+		}
+	}
+	n, err := a.proxy.Export(ctx, w, f)
+	if w != os.Stdout {
+		if e := w.Close(); err == nil {
+			err = e
+		}
+	}
+	if err != nil {
+		return err
+	}
+	//数据可能输出到标准输出，统计信息输出到标准错误
+	fmt.Fprintf(os.Stderr, "exported %d keys\n", n)
+	return nil
+}
+
+func (a *admin) importFile(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := fs.String("format", "jsonl", "jsonl or copy")
+	mode := fs.String("mode", "newer", "overwrite, skip (existing keys) or newer (version wins)")
+	if err := fs.Parse(args); err != nil || fs.NArg() > 1 {
+		return errUsage
+	}
+	f, err := parseFormat(*format)
+	if err != nil {
+		return err
+	}
+	var m rcache.ImportMode
+	switch *mode {
+	case "overwrite":
+		m = rcache.ImportOverwrite
+	case "skip":
+		m = rcache.ImportSkipExisting
+	case "newer":
+		m = rcache.ImportNewerWins
+	default:
+		return fmt.Errorf("unknown import mode %q", *mode)
+	}
+
+	var r io.Reader = os.Stdin
+	if fs.NArg() == 1 {
+		file, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+	res, err := a.proxy.Import(ctx, r, f, m)
+	if err != nil {
+		return err
+	}
+	rows := [][]string{{"ROWS", "WRITTEN", "CONFLICTS"}, {strconv.Itoa(res.Rows), strconv.Itoa(res.Written), strconv.Itoa(len(res.Conflicts))}}
+	for _, key := range res.Conflicts {
+		rows = append(rows, []string{"conflict: " + key})
+	}
+	if res.Conflicts == nil {
+		res.Conflicts = []string{}
+	}
+	return a.print(map[string]any{"rows": res.Rows, "written": res.Written, "conflicts": res.Conflicts}, rows)
+}
+
+// 输出操作后key的状态
+func (a *admin) afterWrite(ctx context.Context, key string) error {
+	info, err := a.proxy.Inspect(ctx, key)
+	if err != nil {
+		return err
+	}
+	return a.print(info, [][]string{{"KEY", "STATE"}, {key, info.State}})
+}
+
+func (a *admin) inspect(info rcache.KeyInfo) error {
+	if a.json {
+		return a.print(info, nil)
+	}
+	rows := [][]string{
+		{"KEY", info.Key},
+		{"STATE", info.State},
+		{"TTL", ttlString(info.TTL)},
+	}
+	if info.DirtyVersion > 0 {
+		rows = append(rows, []string{"DIRTY VERSION", strconv.Itoa(info.DirtyVersion)})
+	}
+	if info.Group != "" {
+		rows = append(rows, []string{"TXN GROUP", info.Group})
+	}
+	fields := make([]string, 0, len(info.Redis))
+	for f := range info.Redis {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	for _, f := range fields {
+		rows = append(rows, []string{"REDIS " + f, strconv.Quote(info.Redis[f])})
+	}
+	if info.DB != nil {
+		rows = append(rows, []string{"DB version", strconv.Itoa(info.DB.Version)}, []string{"DB value", strconv.Quote(info.DB.Value)})
+		if info.DB.ExpireAt > 0 {
+			rows = append(rows, []string{"DB expire_at", time.Unix(info.DB.ExpireAt, 0).Format(time.RFC3339)})
+		} else if info.DB.ExpireAt < 0 {
+			rows = append(rows, []string{"DB deleted_at", time.Unix(-info.DB.ExpireAt, 0).Format(time.RFC3339)})
+		}
+	} else {
+		rows = append(rows, []string{"DB", "(no row)"})
+	}
+	if d := info.DeadLetter; d != nil {
+		rows = append(rows, []string{"DEAD LETTER", fmt.Sprintf("version %d at %s: %s", d.Version, d.At.Format(time.RFC3339), d.Error)})
+	}
+	return a.table(rows)
+}
+
+func ttlString(ttl int64) string {
+	switch {
+	case ttl == -2:
+		return "(not in redis)"
+	case ttl < 0:
+		return "(no expire)"
+	}
+	return (time.Duration(ttl) * time.Second).String()
+}
+
+func (a *admin) dirtyList(ctx context.Context, limit int) error {
+	var all []rcache.DirtyKey
+	cursor := uint64(0)
+	for {
+		keys, next, err := a.proxy.DirtyKeys(ctx, cursor, limit)
+		if err != nil {
+			return err
+		}
+		all = append(all, keys...)
+		if next == 0 || len(all) >= limit {
+			break
+		}
+		cursor = next
+	}
+	if len(all) > limit {
+		all = all[:limit]
+	}
+	rows := [][]string{{"KEY", "VERSION"}}
+	for _, k := range all {
+		rows = append(rows, []string{k.Key, strconv.Itoa(k.Version)})
+	}
+	if all == nil {
+		all = []rcache.DirtyKey{}
+	}
+	return a.print(all, rows)
+}
+
+func (a *admin) deadLetters(ctx context.Context) error {
+	letters, err := a.proxy.DeadLetters(ctx)
+	if err != nil {
+		return err
+	}
+	sort.Slice(letters, func(i, j int) bool { return letters[i].Key < letters[j].Key })
+	rows := [][]string{{"KEY", "VERSION", "AT", "ERROR"}}
+	for _, d := range letters {
+		rows = append(rows, []string{d.Key, strconv.Itoa(d.Version), d.At.Format(time.RFC3339), d.Error})
+	}
+	if letters == nil {
+		letters = []rcache.DeadLetter{}
+	}
+	return a.print(letters, rows)
+}
+
+// json格式输出v，否则以表格输出rows
+func (a *admin) print(v any, rows [][]string) error {
+	if a.json {
+		enc := json.NewEncoder(a.out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	return a.table(rows)
+}
+
+func (a *admin) table(rows [][]string) error {
+	w := tabwriter.NewWriter(a.out, 0, 4, 2, ' ', 0)
+	for _, r := range rows {
+		for i, c := range r {
+			if i > 0 {
+				fmt.Fprint(w, "\t")
+			}
+			fmt.Fprint(w, c)
+		}
+		fmt.Fprintln(w)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sniperHW/rcache"
+	"github.com/stretchr/testify/assert"
+)
+
+func testInfo() rcache.KeyInfo {
+	return rcache.KeyInfo{
+		Key:          "user:1",
+		State:        rcache.KeyDirty,
+		Redis:        map[string]string{"version": "3", "value": "hello"},
+		TTL:          -1,
+		DirtyVersion: 3,
+		DB:           &rcache.DBRow{Version: 2, Value: "hi"},
+		DeadLetter:   &rcache.DeadLetter{Key: "user:1", Version: 3, Error: "value too long", At: time.Unix(0, 0).UTC()},
+	}
+}
+
+func TestInspectTable(t *testing.T) {
+	var out bytes.Buffer
+	a := &admin{out: &out}
+	assert.Nil(t, a.inspect(testInfo()))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Equal(t, []string{
+		"KEY            user:1",
+		"STATE          " + rcache.KeyDirty,
+		"TTL            (no expire)",
+		"DIRTY VERSION  3",
+		`REDIS value    "hello"`,
+		`REDIS version  "3"`,
+		"DB version     2",
+		`DB value       "hi"`,
+		"DEAD LETTER    version 3 at 1970-01-01T00:00:00Z: value too long",
+	}, lines)
+}
+
+func TestInspectJSON(t *testing.T) {
+	var out bytes.Buffer
+	a := &admin{out: &out, json: true}
+	info := testInfo()
+	info.TTL = 90
+	info.DeadLetter = nil
+	assert.Nil(t, a.inspect(info))
+
+	var v map[string]any
+	assert.Nil(t, json.Unmarshal(out.Bytes(), &v))
+	assert.Equal(t, "user:1", v["key"])
+	//ttl以秒输出
+	assert.Equal(t, float64(90), v["ttl"])
+	assert.Equal(t, float64(3), v["dirty_version"])
+	assert.Equal(t, map[string]any{"version": float64(2), "value": "hi"}, v["db"])
+	assert.NotContains(t, v, "dead_letter")
+}
+
+func TestTTLString(t *testing.T) {
+	assert.Equal(t, "(not in redis)", ttlString(-2))
+	assert.Equal(t, "(no expire)", ttlString(-1))
+	assert.Equal(t, "1m30s", ttlString(90))
+}
+
+func TestPrint(t *testing.T) {
+	var out bytes.Buffer
+	a := &admin{out: &out}
+	assert.Nil(t, a.print(map[string]int64{"dirty": 12}, [][]string{{"DIRTY"}, {"12"}}))
+	assert.Equal(t, "DIRTY\n12\n", out.String())
+
+	out.Reset()
+	a.json = true
+	assert.Nil(t, a.print(map[string]int64{"dirty": 12}, [][]string{{"DIRTY"}, {"12"}}))
+	assert.JSONEq(t, `{"dirty":12}`, out.String())
+}
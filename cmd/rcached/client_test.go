@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/sniperHW/rcache/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientRoundTrip(t *testing.T) {
+	store := newMemStore()
+	_, addr := startServer(t, store)
+	c := client.New(client.Options{Addr: addr})
+	defer c.Close()
+	ctx := context.TODO()
+
+	_, _, err := c.Get(ctx, "k")
+	assert.Equal(t, "err_not_exist", err.Error())
+	var e *client.Error
+	assert.True(t, errors.As(err, &e))
+
+	ver, err := c.Set(ctx, "k", "a")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, ver)
+
+	value, ver, err := c.Get(ctx, "k")
+	assert.Nil(t, err)
+	assert.Equal(t, "a", value)
+	assert.Equal(t, 1, ver)
+
+	_, err = c.SetWithVersion(ctx, "k", "b", 5)
+	assert.Equal(t, "err_version_not_match", err.Error())
+	assert.True(t, errors.As(err, &e))
+	assert.Equal(t, "VERSION_NOT_MATCH err_version_not_match", e.Message)
+
+	ver, err = c.SetWithVersion(ctx, "k", "b", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, ver)
+
+	//二进制value
+	ver, err = c.SetBytes(ctx, "bin", []byte{0, 0xff, '\r', '\n'})
+	assert.Nil(t, err)
+	b, _, err := c.GetBytes(ctx, "bin")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0, 0xff, '\r', '\n'}, b)
+
+	//陈旧数据同时返回value和err_stale
+	store.stale["k"] = true
+	value, ver, err = c.Get(ctx, "k")
+	assert.Equal(t, "err_stale", err.Error())
+	assert.Equal(t, "b", value)
+	assert.Equal(t, 2, ver)
+	delete(store.stale, "k")
+
+	_, err = c.SetNX(ctx, "k", "c")
+	assert.Equal(t, "err_exist", err.Error())
+	_, err = c.SetIfExists(ctx, "none", "c")
+	assert.Equal(t, "err_not_exist", err.Error())
+
+	//零值的过期时间表示不过期
+	ver, err = c.SetWithExpiry(ctx, "k", "c", time.Time{})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, ver)
+	assert.True(t, store.data["k"].expireAt.IsZero())
+	_, err = c.SetWithExpiry(ctx, "k", "d", time.Now().Add(time.Hour))
+	assert.Nil(t, err)
+	assert.False(t, store.data["k"].expireAt.IsZero())
+
+	value2, _, err := c.IncrBy(ctx, "n", 5)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), value2)
+	value2, _, err = c.DecrBy(ctx, "n", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), value2)
+	_, _, err = c.DecrBy(ctx, "n", math.MinInt64)
+	assert.Equal(t, "err_out_of_range", err.Error())
+
+	assert.Equal(t, "err_version_not_match", c.CompareAndDelete(ctx, "k", 1).Error())
+	assert.Nil(t, c.Delete(ctx, "k"))
+	assert.Equal(t, "err_not_exist", c.Delete(ctx, "k").Error())
+
+	//Update与DataProxy共用重试逻辑
+	ver, err = c.Update(ctx, "u", func(old string, exists bool) (string, error) {
+		assert.False(t, exists)
+		return "x", nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, ver)
+}
+
+func TestClientRetry(t *testing.T) {
+	store := newMemStore()
+	s, addr := startServer(t, store)
+	c := client.New(client.Options{Addr: addr, ReadRetries: 2})
+	defer c.Close()
+	ctx := context.TODO()
+
+	_, err := c.Set(ctx, "k", "a")
+	assert.Nil(t, err)
+
+	//每次操作前断开连接
+	store.before = func(op string) { s.dropConns() }
+
+	//读取在网络错误时重试
+	_, _, err = c.Get(ctx, "k")
+	assert.NotNil(t, err)
+	assert.Equal(t, 3, store.count("get"))
+
+	//写入不重试，服务端只执行一次
+	_, err = c.Set(ctx, "k", "b")
+	assert.NotNil(t, err)
+	assert.Equal(t, 2, store.count("set"))
+	_, _, err = c.IncrBy(ctx, "n", 1)
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, store.count("incr"))
+
+	//服务端返回的错误不重试
+	store.before = nil
+	store.fail = errors.New("err_cold_unavailable")
+	_, _, err = c.Get(ctx, "k")
+	assert.Equal(t, "err_cold_unavailable", err.Error())
+	assert.Equal(t, 4, store.count("get"))
+}
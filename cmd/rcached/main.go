@@ -0,0 +1,142 @@
+// rcached以redis协议提供DataProxy服务，非Go的服务可以直接使用redis客户端访问。
+//
+// 除GET/SET/MGET/DEL/EXISTS/INCR等常用命令外，支持带版本号的命令。SET的EX/PX/EXAT/PXAT
+// 保存为逻辑过期时间，不能与NX/XX同时使用：
+//
+//	VGET key                  返回[value,version]，陈旧数据返回[value,version,"stale"]，不存在返回nil
+//	VSET key value version    版本号一致才写入(version为0时不校验)，返回新的版本号
+//	VSETNX key value          只在key不存在时写入，返回新的版本号
+//	VSETXX key value          只在key已存在时写入，返回新的版本号
+//	VSETEXAT key value ts     写入并设置逻辑过期时间(unix秒)，返回新的版本号
+//	VEXPIREAT key ts          修改逻辑过期时间，0表示取消过期，返回新的版本号
+//	VINCRBY key delta         返回[value,version]
+//	VDEL key version          版本号一致才删除(version为0时不校验)，返回删除的个数
+//
+// rcache的错误以错误码返回，如 "-VERSION_NOT_MATCH err_version_not_match"
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	redis "github.com/redis/go-redis/v9"
+	"github.com/sniperHW/rcache"
+)
+
+func main() {
+	addr := flag.String("listen", ":6380", "listen address")
+	redisAddr := flag.String("redis", "localhost:6379", "redis address")
+	redisPassword := flag.String("redis-password", "", "redis password")
+	dsn := flag.String("pg", "host=localhost port=5432 dbname=test user=postgres sslmode=disable", "pgsql dsn")
+	cacheTimeout := flag.Int("cache-timeout", 0, "cache timeout in seconds, 0 uses the default")
+	syncInterval := flag.Duration("sync-interval", time.Second, "interval of writing dirty data back to pgsql")
+	shutdownTimeout := flag.Duration("shutdown-timeout", time.Second*10, "time to wait for connections to finish on shutdown")
+	configPath := flag.String("config", "", "yaml config file, overrides -redis, -redis-password, -pg and -sync-interval")
+	maxBulk := flag.Int("max-bulk", defaultMaxBulk, "max length in bytes of a single command argument")
+	maxCommand := flag.Int("max-command", defaultMaxCommand, "max total length in bytes of the arguments of a single command")
+	metricsAddr := flag.String("metrics", "", "serve prometheus metrics on this address at /metrics, empty disables")
+	invalidate := flag.Bool("invalidate", false, "evict cache entries changed outside rcache, requires the kv_notify trigger")
+	flag.Parse()
+
+	logSyncError := func(err error) { log.Printf("sync dirty: %v", err) }
+	metrics := rcache.NewPrometheusMetrics()
+	var proxy *rcache.DataProxy
+	if *configPath != "" {
+		cfg, err := rcache.LoadConfig(*configPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if cfg.Sync.Interval <= 0 {
+			cfg.Sync.Interval = *syncInterval
+		}
+		*dsn = cfg.DB.DSN
+		if proxy, err = rcache.NewFromConfig(cfg, rcache.WithSync(rcache.SyncOptions{Interval: cfg.Sync.Interval, OnError: logSyncError}), rcache.WithMetrics(metrics)); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		redisC := redis.NewClient(&redis.Options{
+			Addr:     *redisAddr,
+			Password: *redisPassword,
+		})
+		dbc, err := sqlx.Open("postgres", *dsn)
+		if err != nil {
+			log.Fatalf("open pgsql: %v", err)
+		}
+		defer redisC.Close()
+		defer dbc.Close()
+		rcache.InitScript()
+		proxy = rcache.NewDataProxy(redisC, dbc, rcache.WithSync(rcache.SyncOptions{Interval: *syncInterval, OnError: logSyncError}), rcache.WithMetrics(metrics))
+	}
+	defer proxy.Close()
+
+	l, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatalf("listen %s: %v", *addr, err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	srv := newServer(proxy, *cacheTimeout)
+	if *maxBulk > 0 {
+		srv.maxBulk = *maxBulk
+	}
+	if *maxCommand > 0 {
+		srv.maxCommand = *maxCommand
+	}
+	syncDone := make(chan struct{})
+	go func() {
+		defer close(syncDone)
+		proxy.RunSync(ctx)
+	}()
+	if *metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics)
+		go func() {
+			if err := http.ListenAndServe(*metricsAddr, mux); err != nil {
+				log.Printf("metrics: %v", err)
+			}
+		}()
+	}
+	if *invalidate {
+		go proxy.ListenInvalidations(ctx, rcache.InvalidationOptions{
+			DSN:         *dsn,
+			OnConflict:  func(c rcache.Conflict) { log.Printf("external %s of dirty key %s, moved to dead letter", c.Op, c.Key) },
+			OnReconnect: func() { log.Printf("invalidation listener reconnected, notifications may be lost") },
+			OnError:     func(err error) { log.Printf("invalidation: %v", err) },
+		})
+	}
+
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		sctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := srv.shutdown(sctx); err != nil {
+			log.Printf("shutdown: %v", err)
+		}
+	}()
+
+	log.Printf("rcached listening on %s", l.Addr())
+	if err = srv.serve(l); err != nil {
+		log.Fatalf("serve: %v", err)
+	}
+	<-shutdownDone
+	<-syncDone
+
+	//退出前写回所有dirty数据
+	sctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err = proxy.SyncDirtyToDB(sctx); err != nil {
+		log.Printf("final sync: %v", err)
+	}
+}
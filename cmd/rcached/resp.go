@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultMaxBulk    = 16 * 1024 * 1024 //参数长度上限的默认值，可以用-max-bulk修改
+	defaultMaxCommand = 64 * 1024 * 1024 //一条命令所有参数的总长度上限的默认值，可以用-max-command修改
+	maxArgs           = 1024 * 1024
+	//长度和参数个数由客户端声明，不能据此一次分配，超过bulkChunk的参数随读取增长
+	bulkChunk = 64 * 1024
+	argsChunk = 16
+)
+
+var errProtocol = errors.New("ERR Protocol error")
+
+// 读取一条命令，支持multibulk和inline两种格式，maxBulk为单个参数的长度上限，maxCommand为所有参数的总长度上限
+func readCommand(r *bufio.Reader, maxBulk int, maxCommand int) (args [][]byte, err error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, nil
+	}
+
+	if line[0] != '*' {
+		//inline命令
+		for _, f := range strings.Fields(string(line)) {
+			args = append(args, []byte(f))
+		}
+		return args, nil
+	}
+
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n > maxArgs {
+		return nil, errProtocol
+	}
+	args = make([][]byte, 0, min(n, argsChunk))
+	total := 0
+	for i := 0; i < n; i++ {
+		if line, err = readLine(r); err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errProtocol
+		}
+		l, err := strconv.Atoi(string(line[1:]))
+		if err != nil || l < 0 || l > maxBulk || total+l > maxCommand {
+			return nil, errProtocol
+		}
+		total += l
+		arg, err := readBulk(r, l)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+// 读取长度为l的参数和结尾的\r\n
+func readBulk(r *bufio.Reader, l int) ([]byte, error) {
+	var arg []byte
+	if l <= bulkChunk {
+		arg = make([]byte, l+2)
+		if _, err := io.ReadFull(r, arg); err != nil {
+			return nil, err
+		}
+	} else {
+		var b bytes.Buffer
+		b.Grow(bulkChunk)
+		if _, err := io.CopyN(&b, r, int64(l+2)); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		arg = b.Bytes()
+	}
+	if arg[l] != '\r' || arg[l+1] != '\n' {
+		return nil, errProtocol
+	}
+	return arg[:l], nil
+}
+
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, errProtocol
+	} else if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, errProtocol
+	}
+	return line[:len(line)-2], nil
+}
+
+// 按连接协商的协议版本(2或3)写入回复
+type respWriter struct {
+	w     *bufio.Writer
+	proto int
+}
+
+func (w *respWriter) writeLine(prefix byte, s string) {
+	w.w.WriteByte(prefix)
+	w.w.WriteString(s)
+	w.w.WriteString("\r\n")
+}
+
+func (w *respWriter) simple(s string) {
+	w.writeLine('+', s)
+}
+
+func (w *respWriter) error(s string) {
+	w.writeLine('-', s)
+}
+
+func (w *respWriter) integer(n int64) {
+	w.writeLine(':', strconv.FormatInt(n, 10))
+}
+
+func (w *respWriter) bulk(b string) {
+	w.writeLine('$', strconv.Itoa(len(b)))
+	w.w.WriteString(b)
+	w.w.WriteString("\r\n")
+}
+
+func (w *respWriter) null() {
+	if w.proto == 3 {
+		w.w.WriteString("_\r\n")
+	} else {
+		w.w.WriteString("$-1\r\n")
+	}
+}
+
+func (w *respWriter) array(n int) {
+	w.writeLine('*', strconv.Itoa(n))
+}
+
+// RESP2中map以键值交替的数组表示
+func (w *respWriter) mapHeader(n int) {
+	if w.proto == 3 {
+		w.writeLine('%', strconv.Itoa(n))
+	} else {
+		w.array(n * 2)
+	}
+}
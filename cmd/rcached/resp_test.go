@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadCommand(t *testing.T) {
+	//pipeline中的多条命令，包括二进制参数和inline命令
+	input := "*3\r\n$4\r\nVSET\r\n$3\r\na\x00b\r\n$1\r\n0\r\nPING\r\n*2\r\n$3\r\nGET\r\n$0\r\n\r\n"
+	r := bufio.NewReader(strings.NewReader(input))
+
+	args, err := readCommand(r, defaultMaxBulk, defaultMaxCommand)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("VSET"), []byte("a\x00b"), []byte("0")}, args)
+
+	args, err = readCommand(r, defaultMaxBulk, defaultMaxCommand)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("PING")}, args)
+
+	args, err = readCommand(r, defaultMaxBulk, defaultMaxCommand)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("GET"), {}}, args)
+
+	_, err = readCommand(bufio.NewReader(strings.NewReader("*1\r\n$5\r\nGET\r\n")), defaultMaxBulk, defaultMaxCommand)
+	assert.NotNil(t, err)
+
+	//超过上限的参数
+	_, err = readCommand(bufio.NewReader(strings.NewReader("*1\r\n$11\r\nhello world\r\n")), 10, defaultMaxCommand)
+	assert.Equal(t, errProtocol, err)
+
+	//参数的总长度超过上限
+	_, err = readCommand(bufio.NewReader(strings.NewReader("*3\r\n$3\r\nSET\r\n$5\r\nhello\r\n$5\r\nworld\r\n")), 10, 12)
+	assert.Equal(t, errProtocol, err)
+	args, err = readCommand(bufio.NewReader(strings.NewReader("*3\r\n$3\r\nSET\r\n$5\r\nhello\r\n$5\r\nworld\r\n")), 10, 13)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(args))
+
+	//大参数分块读取，声明的长度和参数个数不会预先分配
+	big := strings.Repeat("x", bulkChunk*3)
+	args, err = readCommand(bufio.NewReader(strings.NewReader("*1000000\r\n$"+strconv.Itoa(len(big))+"\r\n"+big+"\r\n")), defaultMaxBulk, defaultMaxCommand)
+	assert.Equal(t, io.EOF, err)
+	args, err = readCommand(bufio.NewReader(strings.NewReader("*1\r\n$"+strconv.Itoa(len(big))+"\r\n"+big+"\r\n")), defaultMaxBulk, defaultMaxCommand)
+	assert.Nil(t, err)
+	assert.Equal(t, big, string(args[0]))
+	_, err = readCommand(bufio.NewReader(strings.NewReader("*1\r\n$16000000\r\n"+big)), defaultMaxBulk, defaultMaxCommand)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestRespWriter(t *testing.T) {
+	var b bytes.Buffer
+	w := &respWriter{w: bufio.NewWriter(&b), proto: 2}
+	w.null()
+	w.proto = 3
+	w.null()
+	w.mapHeader(1)
+	w.w.Flush()
+	assert.Equal(t, "$-1\r\n_\r\n%1\r\n", b.String())
+}
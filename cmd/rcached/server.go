@@ -0,0 +1,545 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sniperHW/rcache"
+)
+
+type server struct {
+	proxy        rcache.Store //*rcache.DataProxy，测试中使用内存实现
+	cacheTimeout []int
+	maxBulk      int
+	maxCommand   int
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closing  atomic.Bool
+	wg       sync.WaitGroup
+	nextID   atomic.Int64
+}
+
+func newServer(proxy rcache.Store, cacheTimeout int) *server {
+	s := &server{
+		proxy:      proxy,
+		maxBulk:    defaultMaxBulk,
+		maxCommand: defaultMaxCommand,
+		conns:      map[net.Conn]struct{}{},
+	}
+	if cacheTimeout > 0 {
+		s.cacheTimeout = []int{cacheTimeout}
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	return s
+}
+
+func (s *server) serve(l net.Listener) error {
+	s.mu.Lock()
+	s.listener = l
+	s.mu.Unlock()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if s.closing.Load() {
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(time.Millisecond * 10)
+				continue
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		if s.closing.Load() {
+			s.mu.Unlock()
+			c.Close()
+			continue
+		}
+		s.conns[c] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go s.handle(c)
+	}
+}
+
+// 停止接受新连接，正在执行的命令完成后关闭连接。ctx超时后取消还未完成的命令
+func (s *server) shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing.Store(true)
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	for c := range s.conns {
+		//唤醒阻塞在读取上的连接
+		c.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.cancel()
+		s.mu.Lock()
+		for c := range s.conns {
+			c.Close()
+		}
+		s.mu.Unlock()
+		<-done
+		return ctx.Err()
+	}
+}
+
+func (s *server) handle(c net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		c.Close()
+		s.wg.Done()
+	}()
+
+	id := s.nextID.Add(1)
+	r := bufio.NewReader(c)
+	w := &respWriter{w: bufio.NewWriter(c), proto: 2}
+	for {
+		//pipeline中已经读到的命令处理完才退出
+		if r.Buffered() == 0 && s.closing.Load() {
+			return
+		}
+
+		args, err := readCommand(r, s.maxBulk, s.maxCommand)
+		if err != nil {
+			if err == errProtocol {
+				w.error(err.Error())
+				w.w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		quit := s.exec(w, id, args)
+
+		//pipeline中的回复合并写出
+		if r.Buffered() == 0 || quit {
+			if err = w.w.Flush(); err != nil {
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// rcache的错误码转换为redis风格的错误：首个单词为错误类型，之后为原始错误码
+func errorReply(err error) string {
+	code := err.Error()
+	if strings.HasPrefix(code, "err_") {
+		return strings.ToUpper(code[4:]) + " " + code
+	}
+	return "ERR " + code
+}
+
+func (s *server) replyError(w *respWriter, err error) {
+	w.error(errorReply(err))
+}
+
+func isStale(err error) bool {
+	return err != nil && err.Error() == "err_stale"
+}
+
+func isNotExist(err error) bool {
+	return err != nil && err.Error() == "err_not_exist"
+}
+
+func wrongArgs(w *respWriter, cmd string) {
+	w.error("ERR wrong number of arguments for '" + strings.ToLower(cmd) + "' command")
+}
+
+func (s *server) exec(w *respWriter, id int64, args [][]byte) (quit bool) {
+	cmd := strings.ToUpper(string(args[0]))
+	argc := len(args)
+	ctx := s.ctx
+
+	switch cmd {
+	case "PING":
+		if argc > 1 {
+			w.bulk(string(args[1]))
+		} else {
+			w.simple("PONG")
+		}
+	case "ECHO":
+		if argc != 2 {
+			wrongArgs(w, cmd)
+		} else {
+			w.bulk(string(args[1]))
+		}
+	case "QUIT":
+		w.simple("OK")
+		return true
+	case "HELLO":
+		s.hello(w, id, args)
+	case "CLIENT", "SELECT":
+		w.simple("OK")
+	case "COMMAND":
+		w.array(0)
+	case "GET":
+		if argc != 2 {
+			wrongArgs(w, cmd)
+			break
+		}
+		value, _, err := s.proxy.Get(ctx, string(args[1]), s.cacheTimeout...)
+		switch {
+		case err == nil || isStale(err):
+			w.bulk(value)
+		case isNotExist(err):
+			w.null()
+		default:
+			s.replyError(w, err)
+		}
+	case "MGET":
+		if argc < 2 {
+			wrongArgs(w, cmd)
+			break
+		}
+		w.array(argc - 1)
+		for _, key := range args[1:] {
+			value, _, err := s.proxy.Get(ctx, string(key), s.cacheTimeout...)
+			switch {
+			case err == nil || isStale(err):
+				w.bulk(value)
+			case isNotExist(err):
+				w.null()
+			default:
+				//与GET一致返回错误，不能当作不存在
+				w.error(errorReply(err))
+			}
+		}
+	case "EXISTS":
+		if argc < 2 {
+			wrongArgs(w, cmd)
+			break
+		}
+		var n int64
+		for _, key := range args[1:] {
+			_, _, err := s.proxy.Get(ctx, string(key), s.cacheTimeout...)
+			if err == nil || isStale(err) {
+				n++
+			} else if !isNotExist(err) {
+				s.replyError(w, err)
+				return false
+			}
+		}
+		w.integer(n)
+	case "SET":
+		s.set(w, args)
+	case "DEL":
+		if argc < 2 {
+			wrongArgs(w, cmd)
+			break
+		}
+		var n int64
+		for _, key := range args[1:] {
+			if err := s.proxy.Delete(ctx, string(key), s.cacheTimeout...); err == nil {
+				n++
+			} else if !isNotExist(err) {
+				s.replyError(w, err)
+				return false
+			}
+		}
+		w.integer(n)
+	case "VGET":
+		//返回[value,version]，不存在返回nil
+		if argc != 2 {
+			wrongArgs(w, cmd)
+			break
+		}
+		value, ver, err := s.proxy.Get(ctx, string(args[1]), s.cacheTimeout...)
+		switch {
+		case err == nil:
+			w.array(2)
+			w.bulk(value)
+			w.integer(int64(ver))
+		case isStale(err):
+			//冷存储不可用时返回的陈旧数据
+			w.array(3)
+			w.bulk(value)
+			w.integer(int64(ver))
+			w.bulk("stale")
+		case isNotExist(err):
+			w.null()
+		default:
+			s.replyError(w, err)
+		}
+	case "VSET":
+		//VSET key value version，version为0时不校验版本号，返回新的版本号
+		if argc != 4 {
+			wrongArgs(w, cmd)
+			break
+		}
+		version, err := strconv.Atoi(string(args[3]))
+		if err != nil || version < 0 {
+			w.error("ERR version is not an integer or out of range")
+			break
+		}
+		ver, err := s.proxy.SetWithVersion(ctx, string(args[1]), string(args[2]), version, s.cacheTimeout...)
+		if err != nil {
+			s.replyError(w, err)
+		} else {
+			w.integer(int64(ver))
+		}
+	case "VSETNX", "VSETXX":
+		//只在key不存在/已存在时写入，返回新的版本号
+		if argc != 3 {
+			wrongArgs(w, cmd)
+			break
+		}
+		var ver int
+		var err error
+		if cmd == "VSETNX" {
+			ver, err = s.proxy.SetNX(ctx, string(args[1]), string(args[2]), s.cacheTimeout...)
+		} else {
+			ver, err = s.proxy.SetIfExists(ctx, string(args[1]), string(args[2]), s.cacheTimeout...)
+		}
+		if err != nil {
+			s.replyError(w, err)
+		} else {
+			w.integer(int64(ver))
+		}
+	case "VSETEXAT":
+		//VSETEXAT key value unix-seconds，写入并设置逻辑过期时间，返回新的版本号
+		if argc != 4 {
+			wrongArgs(w, cmd)
+			break
+		}
+		at, err := strconv.ParseInt(string(args[3]), 10, 64)
+		if err != nil || at <= 0 {
+			w.error("ERR invalid expire time in 'vsetexat' command")
+			break
+		}
+		ver, err := s.proxy.SetWithExpiry(ctx, string(args[1]), string(args[2]), time.Unix(at, 0), s.cacheTimeout...)
+		if err != nil {
+			s.replyError(w, err)
+		} else {
+			w.integer(int64(ver))
+		}
+	case "VEXPIREAT":
+		//VEXPIREAT key unix-seconds，0表示取消过期，返回新的版本号
+		if argc != 3 {
+			wrongArgs(w, cmd)
+			break
+		}
+		at, err := strconv.ParseInt(string(args[2]), 10, 64)
+		if err != nil || at < 0 {
+			w.error("ERR invalid expire time in 'vexpireat' command")
+			break
+		}
+		var expireAt time.Time
+		if at > 0 {
+			expireAt = time.Unix(at, 0)
+		}
+		ver, err := s.proxy.ExpireAt(ctx, string(args[1]), expireAt, s.cacheTimeout...)
+		if err != nil {
+			s.replyError(w, err)
+		} else {
+			w.integer(int64(ver))
+		}
+	case "VINCRBY":
+		//VINCRBY key delta，返回[value,version]
+		if argc != 3 {
+			wrongArgs(w, cmd)
+			break
+		}
+		delta, err := strconv.ParseInt(string(args[2]), 10, 64)
+		if err != nil {
+			w.error("ERR value is not an integer or out of range")
+			break
+		}
+		value, ver, err := s.proxy.IncrBy(ctx, string(args[1]), delta, s.cacheTimeout...)
+		if err != nil {
+			s.replyError(w, err)
+		} else {
+			w.array(2)
+			w.integer(value)
+			w.integer(int64(ver))
+		}
+	case "VDEL":
+		//VDEL key version，删除成功返回1，不存在返回0
+		if argc != 3 {
+			wrongArgs(w, cmd)
+			break
+		}
+		version, err := strconv.Atoi(string(args[2]))
+		if err != nil || version < 0 {
+			w.error("ERR version is not an integer or out of range")
+			break
+		}
+		err = s.proxy.CompareAndDelete(ctx, string(args[1]), version, s.cacheTimeout...)
+		switch {
+		case err == nil:
+			w.integer(1)
+		case isNotExist(err):
+			w.integer(0)
+		default:
+			s.replyError(w, err)
+		}
+	case "INCR", "DECR", "INCRBY", "DECRBY":
+		var delta int64 = 1
+		if cmd == "INCRBY" || cmd == "DECRBY" {
+			if argc != 3 {
+				wrongArgs(w, cmd)
+				break
+			}
+			var err error
+			if delta, err = strconv.ParseInt(string(args[2]), 10, 64); err != nil {
+				w.error("ERR value is not an integer or out of range")
+				break
+			}
+		} else if argc != 2 {
+			wrongArgs(w, cmd)
+			break
+		}
+		if strings.HasPrefix(cmd, "DECR") {
+			delta = -delta
+		}
+		value, _, err := s.proxy.IncrBy(ctx, string(args[1]), delta, s.cacheTimeout...)
+		if err != nil {
+			s.replyError(w, err)
+		} else {
+			w.integer(value)
+		}
+	default:
+		w.error("ERR unknown command '" + string(args[0]) + "'")
+	}
+	return false
+}
+
+// HELLO [protover [AUTH username password] [SETNAME clientname]]
+func (s *server) hello(w *respWriter, id int64, args [][]byte) {
+	if len(args) > 1 {
+		proto, err := strconv.Atoi(string(args[1]))
+		if err != nil || proto < 2 || proto > 3 {
+			w.error("NOPROTO unsupported protocol version")
+			return
+		}
+		w.proto = proto
+	}
+
+	w.mapHeader(7)
+	w.bulk("server")
+	w.bulk("rcached")
+	w.bulk("version")
+	w.bulk("1.0.0")
+	w.bulk("proto")
+	w.integer(int64(w.proto))
+	w.bulk("id")
+	w.integer(id)
+	w.bulk("mode")
+	w.bulk("standalone")
+	w.bulk("role")
+	w.bulk("master")
+	w.bulk("modules")
+	w.array(0)
+}
+
+// SET key value [NX|XX] [EX seconds|PX milliseconds|EXAT timestamp|PXAT timestamp]
+// 过期时间作为逻辑过期保存(SetWithExpiry)，不能与NX/XX同时使用(不能原子的写入和设置过期时间)
+func (s *server) set(w *respWriter, args [][]byte) {
+	if len(args) < 3 {
+		wrongArgs(w, "SET")
+		return
+	}
+	key, value := string(args[1]), string(args[2])
+
+	var nx, xx bool
+	var expireAt time.Time
+	for i := 3; i < len(args); i++ {
+		opt := strings.ToUpper(string(args[i]))
+		switch opt {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if i+1 >= len(args) || !expireAt.IsZero() {
+				w.error("ERR syntax error")
+				return
+			}
+			i++
+			n, err := strconv.ParseInt(string(args[i]), 10, 64)
+			if err != nil || n <= 0 {
+				w.error("ERR invalid expire time in 'set' command")
+				return
+			}
+			switch opt {
+			case "EX":
+				expireAt = time.Now().Add(time.Duration(n) * time.Second)
+			case "PX":
+				expireAt = time.Now().Add(time.Duration(n) * time.Millisecond)
+			case "EXAT":
+				expireAt = time.Unix(n, 0)
+			default:
+				expireAt = time.UnixMilli(n)
+			}
+		default:
+			w.error("ERR syntax error")
+			return
+		}
+	}
+	if nx && xx {
+		w.error("ERR syntax error")
+		return
+	} else if (nx || xx) && !expireAt.IsZero() {
+		w.error("ERR NX and XX options are not supported with an expire time")
+		return
+	}
+
+	var err error
+	switch {
+	case nx:
+		if _, err = s.proxy.SetNX(s.ctx, key, value, s.cacheTimeout...); err != nil && err.Error() == "err_exist" {
+			w.null()
+			return
+		}
+	case xx:
+		if _, err = s.proxy.SetIfExists(s.ctx, key, value, s.cacheTimeout...); isNotExist(err) {
+			w.null()
+			return
+		}
+	case !expireAt.IsZero():
+		_, err = s.proxy.SetWithExpiry(s.ctx, key, value, expireAt, s.cacheTimeout...)
+	default:
+		_, err = s.proxy.Set(s.ctx, key, value, s.cacheTimeout...)
+	}
+
+	if err != nil {
+		s.replyError(w, err)
+	} else {
+		w.simple("OK")
+	}
+}
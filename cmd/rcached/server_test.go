@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 执行一条inline命令，返回写出的回复
+func execLine(s *server, line string) string {
+	var b bytes.Buffer
+	w := &respWriter{w: bufio.NewWriter(&b), proto: 2}
+	var args [][]byte
+	for _, f := range strings.Fields(line) {
+		args = append(args, []byte(f))
+	}
+	s.exec(w, 1, args)
+	w.w.Flush()
+	return b.String()
+}
+
+func TestExec(t *testing.T) {
+	store := newMemStore()
+	s := newServer(store, 0)
+
+	for _, c := range []struct {
+		cmd   string
+		reply string
+	}{
+		{"PING", "+PONG\r\n"},
+		{"GET k", "$-1\r\n"},
+		{"GET", "-ERR wrong number of arguments for 'get' command\r\n"},
+		{"SET k v", "+OK\r\n"},
+		{"GET k", "$1\r\nv\r\n"},
+		{"VGET k", "*2\r\n$1\r\nv\r\n:1\r\n"},
+		{"SET k v2 NX", "$-1\r\n"},
+		{"SET k2 v XX", "$-1\r\n"},
+		{"SET k v2 xx", "+OK\r\n"},
+		{"SET k v NX XX", "-ERR syntax error\r\n"},
+		{"SET k v NX EX 10", "-ERR NX and XX options are not supported with an expire time\r\n"},
+		{"SET k v EX 0", "-ERR invalid expire time in 'set' command\r\n"},
+		{"SET k v EX 10 PX 100", "-ERR syntax error\r\n"},
+		{"SET k v EX", "-ERR syntax error\r\n"},
+		{"SET k v KEEPTTL", "-ERR syntax error\r\n"},
+		{"SET e v EX 100", "+OK\r\n"},
+		{"VSET k v3 9", "-VERSION_NOT_MATCH err_version_not_match\r\n"},
+		{"VSET k v3 x", "-ERR version is not an integer or out of range\r\n"},
+		{"VSET k v3 2", ":3\r\n"},
+		{"VSETNX k v", "-EXIST err_exist\r\n"},
+		{"VSETXX none v", "-NOT_EXIST err_not_exist\r\n"},
+		{"VSETEXAT k v 0", "-ERR invalid expire time in 'vsetexat' command\r\n"},
+		{"VEXPIREAT k -1", "-ERR invalid expire time in 'vexpireat' command\r\n"},
+		{"VEXPIREAT k 0", ":4\r\n"},
+		{"INCR n", ":1\r\n"},
+		{"DECRBY n 3", ":-2\r\n"},
+		{"INCRBY n x", "-ERR value is not an integer or out of range\r\n"},
+		{"VINCRBY n 2", "*2\r\n:0\r\n:3\r\n"},
+		{"INCR k", "-NOT_INTEGER err_not_integer\r\n"},
+		{"EXISTS k none e", ":2\r\n"},
+		{"MGET k none", "*2\r\n$2\r\nv3\r\n$-1\r\n"},
+		{"VDEL k 1", "-VERSION_NOT_MATCH err_version_not_match\r\n"},
+		{"VDEL k 0", ":1\r\n"},
+		{"VDEL k 0", ":0\r\n"},
+		{"DEL e none", ":1\r\n"},
+		{"FOO", "-ERR unknown command 'FOO'\r\n"},
+	} {
+		assert.Equal(t, c.reply, execLine(s, c.cmd), c.cmd)
+	}
+	assert.False(t, store.data["k"].alive())
+
+	//陈旧数据按存在返回，VGET附加stale标记
+	execLine(s, "SET k v")
+	store.stale["k"] = true
+	assert.Equal(t, "$1\r\nv\r\n", execLine(s, "GET k"))
+	assert.Equal(t, "*3\r\n$1\r\nv\r\n:6\r\n$5\r\nstale\r\n", execLine(s, "VGET k"))
+
+	//后端的错误不能当作不存在
+	store.fail = errors.New("err_cold_unavailable")
+	assert.Equal(t, "-COLD_UNAVAILABLE err_cold_unavailable\r\n", execLine(s, "GET k"))
+	assert.Equal(t, "*2\r\n-COLD_UNAVAILABLE err_cold_unavailable\r\n-COLD_UNAVAILABLE err_cold_unavailable\r\n", execLine(s, "MGET k none"))
+	assert.Equal(t, "-COLD_UNAVAILABLE err_cold_unavailable\r\n", execLine(s, "EXISTS k"))
+}
+
+func TestPipeline(t *testing.T) {
+	store := newMemStore()
+	_, addr := startServer(t, store)
+	c, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	//一次写入多条命令，回复按顺序返回
+	_, err = io.WriteString(c, "SET a 1\r\n*2\r\n$3\r\nGET\r\n$1\r\na\r\nGET b\r\nINCR a\r\nQUIT\r\n")
+	assert.Nil(t, err)
+	b, err := io.ReadAll(c)
+	assert.Nil(t, err)
+	assert.Equal(t, "+OK\r\n$1\r\n1\r\n$-1\r\n:2\r\n+OK\r\n", string(b))
+
+	//协议错误时返回错误并关闭连接
+	c2, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c2.Close()
+	io.WriteString(c2, "*1\r\n+GET\r\n")
+	b, _ = io.ReadAll(c2)
+	assert.Equal(t, "-ERR Protocol error\r\n", string(b))
+}
+
+func TestShutdown(t *testing.T) {
+	store := newMemStore()
+	s, addr := startServer(t, store)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	store.before = func(op string) {
+		if op == "set" {
+			close(started)
+			<-release
+		}
+	}
+
+	idle, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer idle.Close()
+	busy, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer busy.Close()
+	//SET执行期间已经读到的GET同样会处理
+	io.WriteString(busy, "SET a 1\r\nGET a\r\n")
+	<-started
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.shutdown(context.Background())
+	}()
+
+	//空闲的连接立即关闭，不再接受新连接
+	b, _ := io.ReadAll(idle)
+	assert.Equal(t, 0, len(b))
+	assert.Eventually(t, func() bool {
+		c, err := net.DialTimeout("tcp", addr, time.Second)
+		if err == nil {
+			c.Close()
+		}
+		return err != nil
+	}, time.Second, time.Millisecond*10)
+
+	//正在执行的命令完成后关闭
+	select {
+	case <-done:
+		t.Fatal("shutdown returned before the command finished")
+	default:
+	}
+	close(release)
+	b, _ = io.ReadAll(busy)
+	assert.Equal(t, "+OK\r\n$1\r\n1\r\n", string(b))
+	assert.Nil(t, <-done)
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	store := newMemStore()
+	s, addr := startServer(t, store)
+
+	started := make(chan struct{})
+	store.before = func(op string) {
+		close(started)
+		<-s.ctx.Done()
+	}
+	c, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+	io.WriteString(c, "SET a 1\r\n")
+	<-started
+
+	//超时后取消还未完成的命令
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, s.shutdown(ctx))
+}
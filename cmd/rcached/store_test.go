@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sniperHW/rcache"
+	"github.com/stretchr/testify/assert"
+)
+
+type memEntry struct {
+	value    string
+	version  int
+	deleted  bool
+	expireAt time.Time
+}
+
+func (e *memEntry) alive() bool {
+	return e != nil && !e.deleted && (e.expireAt.IsZero() || e.expireAt.After(time.Now()))
+}
+
+// 内存中的rcache.Store，错误码与DataProxy一致。删除后保留版本号
+type memStore struct {
+	mu    sync.Mutex
+	data  map[string]*memEntry
+	stale map[string]bool //Get返回err_stale的key
+	fail  error           //不为nil时所有操作返回该错误
+	calls map[string]int
+	//执行操作前调用，用于模拟连接断开等
+	before func(op string)
+}
+
+var _ rcache.Store = (*memStore)(nil)
+
+func newMemStore() *memStore {
+	return &memStore{data: map[string]*memEntry{}, stale: map[string]bool{}, calls: map[string]int{}}
+}
+
+// 记录调用次数并执行before，返回后持有锁
+func (m *memStore) enter(op string) error {
+	m.mu.Lock()
+	m.calls[op]++
+	before := m.before
+	m.mu.Unlock()
+	if before != nil {
+		before(op)
+	}
+	m.mu.Lock()
+	return m.fail
+}
+
+func (m *memStore) count(op string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.calls[op]
+}
+
+func (m *memStore) write(key string, value string, version int, expireAt time.Time) (int, error) {
+	e := m.data[key]
+	if version > 0 && (!e.alive() || e.version != version) {
+		return 0, errors.New("err_version_not_match")
+	}
+	if e == nil {
+		e = &memEntry{}
+		m.data[key] = e
+	}
+	e.version++
+	e.value, e.deleted, e.expireAt = value, false, expireAt
+	return e.version, nil
+}
+
+func (m *memStore) Get(ctx context.Context, key string, cacheTimeout ...int) (string, int, error) {
+	err := m.enter("get")
+	defer m.mu.Unlock()
+	if err != nil {
+		return "", 0, err
+	}
+	e := m.data[key]
+	if !e.alive() {
+		return "", 0, errors.New("err_not_exist")
+	}
+	if m.stale[key] {
+		return e.value, e.version, errors.New("err_stale")
+	}
+	return e.value, e.version, nil
+}
+
+func (m *memStore) GetBytes(ctx context.Context, key string, cacheTimeout ...int) ([]byte, int, error) {
+	v, ver, err := m.Get(ctx, key)
+	return []byte(v), ver, err
+}
+
+func (m *memStore) Set(ctx context.Context, key string, value string, cacheTimeout ...int) (int, error) {
+	return m.SetWithVersion(ctx, key, value, 0)
+}
+
+func (m *memStore) SetWithVersion(ctx context.Context, key string, value string, version int, cacheTimeout ...int) (int, error) {
+	err := m.enter("set")
+	defer m.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return m.write(key, value, version, time.Time{})
+}
+
+func (m *memStore) SetBytes(ctx context.Context, key string, value []byte, cacheTimeout ...int) (int, error) {
+	return m.SetWithVersion(ctx, key, string(value), 0)
+}
+
+func (m *memStore) SetBytesWithVersion(ctx context.Context, key string, value []byte, version int, cacheTimeout ...int) (int, error) {
+	return m.SetWithVersion(ctx, key, string(value), version)
+}
+
+func (m *memStore) SetWithExpiry(ctx context.Context, key string, value string, expireAt time.Time, cacheTimeout ...int) (int, error) {
+	err := m.enter("set")
+	defer m.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return m.write(key, value, 0, expireAt)
+}
+
+func (m *memStore) SetNX(ctx context.Context, key string, value string, cacheTimeout ...int) (int, error) {
+	err := m.enter("setnx")
+	defer m.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	if m.data[key].alive() {
+		return 0, errors.New("err_exist")
+	}
+	return m.write(key, value, 0, time.Time{})
+}
+
+func (m *memStore) SetIfExists(ctx context.Context, key string, value string, cacheTimeout ...int) (int, error) {
+	err := m.enter("setxx")
+	defer m.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	if !m.data[key].alive() {
+		return 0, errors.New("err_not_exist")
+	}
+	return m.write(key, value, 0, time.Time{})
+}
+
+func (m *memStore) ExpireAt(ctx context.Context, key string, expireAt time.Time, cacheTimeout ...int) (int, error) {
+	err := m.enter("expire")
+	defer m.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	e := m.data[key]
+	if !e.alive() {
+		return 0, errors.New("err_not_exist")
+	}
+	e.version++
+	e.expireAt = expireAt
+	return e.version, nil
+}
+
+func (m *memStore) Delete(ctx context.Context, key string, cacheTimeout ...int) error {
+	return m.CompareAndDelete(ctx, key, 0)
+}
+
+func (m *memStore) CompareAndDelete(ctx context.Context, key string, version int, cacheTimeout ...int) error {
+	err := m.enter("del")
+	defer m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	e := m.data[key]
+	if !e.alive() {
+		return errors.New("err_not_exist")
+	}
+	if version > 0 && e.version != version {
+		return errors.New("err_version_not_match")
+	}
+	e.version++
+	e.value, e.deleted = "", true
+	return nil
+}
+
+func (m *memStore) IncrBy(ctx context.Context, key string, delta int64, cacheTimeout ...int) (int64, int, error) {
+	err := m.enter("incr")
+	defer m.mu.Unlock()
+	if err != nil {
+		return 0, 0, err
+	}
+	var n int64
+	if e := m.data[key]; e.alive() {
+		if n, err = strconv.ParseInt(e.value, 10, 64); err != nil {
+			return 0, 0, errors.New("err_not_integer")
+		}
+	}
+	n += delta
+	ver, err := m.write(key, strconv.FormatInt(n, 10), 0, time.Time{})
+	return n, ver, err
+}
+
+func (m *memStore) DecrBy(ctx context.Context, key string, delta int64, cacheTimeout ...int) (int64, int, error) {
+	if delta == math.MinInt64 {
+		return 0, 0, errors.New("err_out_of_range")
+	}
+	return m.IncrBy(ctx, key, -delta)
+}
+
+func (m *memStore) Update(ctx context.Context, key string, fn func(old string, exists bool) (string, error), cacheTimeout ...int) (int, error) {
+	return rcache.UpdateStore(ctx, m, key, rcache.DefaultRetryPolicy, fn)
+}
+
+// 在随机端口上启动rcached，测试结束时关闭
+func startServer(t *testing.T, store rcache.Store) (*server, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	s := newServer(store, 0)
+	done := make(chan error, 1)
+	go func() { done <- s.serve(l) }()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s.shutdown(ctx)
+		<-done
+	})
+	return s, l.Addr().String()
+}
+
+// 关闭服务端的所有连接
+func (s *server) dropConns() {
+	s.mu.Lock()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+}
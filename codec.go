@@ -0,0 +1,252 @@
+package rcache
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"sync/atomic"
+)
+
+// 压缩后的value以0x1b和codec的ID开头，之后为base64编码的数据(pgsql的varchar不能保存任意字节)。
+// 没有头部的value按原样读取，开启压缩前写入的数据不受影响
+const valueMagic = 0x1b
+
+// 开启压缩或加密后，本身以valueMagic开头的value写入时加上0x1b 0x00，读取时去掉，
+// 避免被当作压缩或加密的数据
+const escapedID = 0x00
+
+func escapeValue(value string) string {
+	if len(value) > 0 && value[0] == valueMagic {
+		return string([]byte{valueMagic, escapedID}) + value
+	}
+	return value
+}
+
+func unescapeValue(value string) (string, bool) {
+	if len(value) >= 2 && value[0] == valueMagic && value[1] == escapedID {
+		return value[2:], true
+	}
+	return value, false
+}
+
+type Codec interface {
+	ID() byte //写入value头部，不能与其它codec重复
+	Encode(src []byte) ([]byte, error)
+	Decode(src []byte) ([]byte, error)
+}
+
+type GzipCodec struct {
+	Level int //0使用gzip.DefaultCompression
+}
+
+func (GzipCodec) ID() byte {
+	return 'g'
+}
+
+func (c GzipCodec) Encode(src []byte) ([]byte, error) {
+	level := c.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	var b bytes.Buffer
+	w, err := gzip.NewWriterLevel(&b, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(src); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (GzipCodec) Decode(src []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+type FlateCodec struct {
+	Level int //0使用flate.DefaultCompression
+}
+
+func (FlateCodec) ID() byte {
+	return 'f'
+}
+
+func (c FlateCodec) Encode(src []byte) ([]byte, error) {
+	level := c.Level
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	var b bytes.Buffer
+	w, err := flate.NewWriter(&b, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(src); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (FlateCodec) Decode(src []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+type CompressOptions struct {
+	Threshold int   //超过该字节数的value才压缩，默认4096
+	Codec     Codec //写入使用的codec，默认GzipCodec
+	Codecs    []Codec
+	//Codecs为额外可以读取的codec，更换Codec后用于读取旧数据。GzipCodec和FlateCodec总是可以读取
+}
+
+type CompressStats struct {
+	Values      int64 //压缩写入的value数量
+	RawBytes    int64 //压缩前的字节数
+	StoredBytes int64 //压缩后(含头部)的字节数
+}
+
+// 压缩率(压缩前/压缩后)，没有压缩过的value时返回0
+func (s CompressStats) Ratio() float64 {
+	if s.StoredBytes == 0 {
+		return 0
+	}
+	return float64(s.RawBytes) / float64(s.StoredBytes)
+}
+
+type compressor struct {
+	threshold   int
+	codec       Codec
+	codecs      map[byte]Codec
+	values      atomic.Int64
+	rawBytes    atomic.Int64
+	storedBytes atomic.Int64
+}
+
+// 开启value压缩，超过阈值的value在写入redis和pgsql前压缩，读取时透明解压。
+// 计数器的value很短不会被压缩
+func WithCompression(opt CompressOptions) Option {
+	return func(p *DataProxy) {
+		c := &compressor{
+			threshold: opt.Threshold,
+			codec:     opt.Codec,
+			codecs:    map[byte]Codec{},
+		}
+		if c.threshold <= 0 {
+			c.threshold = 4096
+		}
+		if c.codec == nil {
+			c.codec = GzipCodec{}
+		}
+		for _, codec := range append([]Codec{GzipCodec{}, FlateCodec{}, c.codec}, opt.Codecs...) {
+			c.codecs[codec.ID()] = codec
+		}
+		p.compress = c
+	}
+}
+
+func (c *compressor) encode(value string) (string, error) {
+	if len(value) <= c.threshold {
+		return escapeValue(value), nil
+	}
+	b, err := c.codec.Encode([]byte(value))
+	if err != nil {
+		return "", err
+	}
+	encoded := string([]byte{valueMagic, c.codec.ID()}) + base64.StdEncoding.EncodeToString(b)
+	if len(encoded) >= len(value) {
+		//压缩后没有变小
+		return escapeValue(value), nil
+	}
+	c.values.Add(1)
+	c.rawBytes.Add(int64(len(value)))
+	c.storedBytes.Add(int64(len(encoded)))
+	return encoded, nil
+}
+
+func (c *compressor) decode(value string) (string, error) {
+	if v, ok := unescapeValue(value); ok {
+		return v, nil
+	}
+	if len(value) < 2 || value[0] != valueMagic {
+		return value, nil
+	}
+	codec, ok := c.codecs[value[1]]
+	if !ok {
+		//不是压缩的数据
+		return value, nil
+	}
+	b, err := base64.StdEncoding.DecodeString(value[2:])
+	if err != nil {
+		return "", errors.New("err_decode")
+	}
+	if b, err = codec.Decode(b); err != nil {
+		return "", errors.New("err_decode")
+	}
+	return string(b), nil
+}
+
+// 写入redis和pgsql前对value编码：先压缩再加密
+func (p *DataProxy) encodeValue(ctx context.Context, key string, value string) (v string, err error) {
+	v = value
+	if p.compress != nil {
+		if v, err = p.compress.encode(v); err != nil {
+			return "", err
+		}
+	}
+	if p.encrypt != nil {
+		if p.compress == nil {
+			v = escapeValue(v)
+		}
+		return p.encrypt.encrypt(ctx, key, v)
+	}
+	return v, nil
+}
+
+// 对读取到的value解码，读取失败时value为空不需要解码
+func (p *DataProxy) decodeValue(ctx context.Context, key string, value string, err error) (string, error) {
+	if err != nil && err.Error() != "err_stale" {
+		return value, err
+	}
+	var e error
+	if p.encrypt != nil {
+		if value, e = p.encrypt.decrypt(ctx, key, value); e != nil {
+			return "", e
+		}
+	}
+	if p.compress != nil {
+		if value, e = p.compress.decode(value); e != nil {
+			return "", e
+		}
+	} else if p.encrypt != nil {
+		value, _ = unescapeValue(value)
+	}
+	return value, err
+}
+
+// 返回压缩统计，未开启压缩时返回零值
+func (p *DataProxy) CompressStats() CompressStats {
+	if p.compress == nil {
+		return CompressStats{}
+	}
+	return CompressStats{
+		Values:      p.compress.values.Load(),
+		RawBytes:    p.compress.rawBytes.Load(),
+		StoredBytes: p.compress.storedBytes.Load(),
+	}
+}
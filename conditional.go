@@ -0,0 +1,119 @@
+package rcache
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// 只在key不存在时写入，已存在返回err_exist
+func (p *DataProxy) SetNX(ctx context.Context, key string, value string, cacheTimeout ...int) (ver int, err error) {
+	if p.hotkey != nil {
+		p.hotkey.invalidate(key)
+	}
+	if value, err = p.encodeValue(ctx, key, value); err != nil {
+		return ver, err
+	}
+
+	if !p.redisAllow() {
+		p.fallback.add(key)
+		start := time.Now()
+		ver, err = insertRowPgsql(ctx, p.dbc, key, value)
+		p.metrics.DBUpsert(key, time.Since(start), err)
+		p.fallbackWritten(ctx, key)
+		return ver, err
+	}
+
+	cacheTime := p.cacheTime(key, cacheTimeout)
+	ver, err = redisSetNX(ctx, p.redisC, key, value, cacheTime, p.recorder())
+	p.redisDone(err)
+	if err != nil && err.Error() == "err_not_in_redis" {
+		if !p.coldAllow() {
+			return ver, errors.New("err_cold_unavailable")
+		}
+		start := time.Now()
+		ver, err = insertRowPgsql(ctx, p.dbc, key, value)
+		p.metrics.DBUpsert(key, time.Since(start), err)
+		p.coldDone(err)
+		if err == nil {
+			redisLoadSet(ctx, p.redisC, key, ver, value, 0, cacheTime, p.staleGrace)
+			p.publish(ctx, key, ver, "set")
+		}
+	}
+	return ver, err
+}
+
+// 只在key已存在时写入，不存在返回err_not_exist
+func (p *DataProxy) SetIfExists(ctx context.Context, key string, value string, cacheTimeout ...int) (ver int, err error) {
+	if p.hotkey != nil {
+		p.hotkey.invalidate(key)
+	}
+	if value, err = p.encodeValue(ctx, key, value); err != nil {
+		return ver, err
+	}
+
+	if !p.redisAllow() {
+		p.fallback.add(key)
+		start := time.Now()
+		ver, err = updateExistRowPgsql(ctx, p.dbc, key, value)
+		p.metrics.DBUpsert(key, time.Since(start), err)
+		p.fallbackWritten(ctx, key)
+		return ver, err
+	}
+
+	cacheTime := p.cacheTime(key, cacheTimeout)
+	ver, err = redisSet(ctx, p.redisC, key, value, 0, cacheTime, p.staleGrace, true, 0, p.recorder())
+	p.redisDone(err)
+	if err != nil && err.Error() == "err_not_in_redis" {
+		if !p.coldAllow() {
+			return ver, errors.New("err_cold_unavailable")
+		}
+		start := time.Now()
+		ver, err = updateExistRowPgsql(ctx, p.dbc, key, value)
+		p.metrics.DBUpsert(key, time.Since(start), err)
+		p.coldDone(err)
+		if err == nil {
+			redisLoadSet(ctx, p.redisC, key, ver, value, 0, cacheTime, p.staleGrace)
+			p.publish(ctx, key, ver, "set")
+		}
+	}
+	return ver, err
+}
+
+// 删除key，不存在返回err_not_exist
+func (p *DataProxy) Delete(ctx context.Context, key string, cacheTimeout ...int) (err error) {
+	return p.CompareAndDelete(ctx, key, 0, cacheTimeout...)
+}
+
+// 只有版本号一致才删除，version为0时不校验版本号
+func (p *DataProxy) CompareAndDelete(ctx context.Context, key string, version int, cacheTimeout ...int) (err error) {
+	if p.hotkey != nil {
+		p.hotkey.invalidate(key)
+	}
+
+	if !p.redisAllow() {
+		p.fallback.add(key)
+		start := time.Now()
+		_, err = deleteRowPgsql(ctx, p.dbc, key, version)
+		p.metrics.DBUpsert(key, time.Since(start), err)
+		p.fallbackWritten(ctx, key)
+		return p.versionChecked(key, err)
+	}
+
+	err = redisDel(ctx, p.redisC, key, version, p.cacheTime(key, cacheTimeout), p.staleGrace, p.recorder())
+	p.redisDone(err)
+	if err != nil && err.Error() == "err_not_in_redis" {
+		if !p.coldAllow() {
+			return errors.New("err_cold_unavailable")
+		}
+		start := time.Now()
+		var ver int
+		ver, err = deleteRowPgsql(ctx, p.dbc, key, version)
+		p.metrics.DBUpsert(key, time.Since(start), err)
+		p.coldDone(err)
+		if err == nil {
+			p.publish(ctx, key, ver, "del")
+		}
+	}
+	return p.versionChecked(key, err)
+}
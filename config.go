@@ -0,0 +1,334 @@
+package rcache
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	redis "github.com/redis/go-redis/v9"
+	"gopkg.in/yaml.v3"
+)
+
+// 示例：
+//
+//	redis:
+//	  mode: sentinel
+//	  master_name: mymaster
+//	  sentinel_addrs: ["10.0.0.1:26379", "10.0.0.2:26379"]
+//	  pool_size: 50
+//	db:
+//	  dsn: host=localhost port=5432 dbname=test user=postgres sslmode=disable
+//	  max_open_conns: 20
+//	cache_timeout: 1800
+//	namespaces:
+//	  session:
+//	    cache_timeout: 300
+//	sync:
+//	  interval: 1s
+//
+// redis cluster使用mode: cluster和cluster_addrs，此时Txn的key需要在同一个hash slot，不支持cdc。
+// 密码和dsn可以由环境变量RCACHE_REDIS_PASSWORD、RCACHE_REDIS_SENTINEL_PASSWORD、RCACHE_DB_DSN覆盖
+type Config struct {
+	Redis         RedisConfig                `yaml:"redis"`
+	DB            DBConfig                   `yaml:"db"`
+	CacheTimeout  int                        `yaml:"cache_timeout"` //秒，0使用默认值
+	Namespaces    map[string]NamespaceConfig `yaml:"namespaces"`    //namespace为key中第一个':'之前的部分
+	Sync          SyncConfig                 `yaml:"sync"`
+	HotKey        *HotKeyConfig              `yaml:"hot_key"`
+	Degrade       *DegradeConfig             `yaml:"degrade"`
+	RedisFallback *BreakerConfig             `yaml:"redis_fallback"`
+	History       *HistoryConfig             `yaml:"history"`
+	Compression   *CompressionConfig         `yaml:"compression"`
+	CDC           *CDCConfig                 `yaml:"cdc"`
+}
+
+type RedisConfig struct {
+	Mode             string        `yaml:"mode"` //standalone(默认)、sentinel或cluster
+	Addr             string        `yaml:"addr"`
+	ClusterAddrs     []string      `yaml:"cluster_addrs"` //cluster模式的种子节点
+	SentinelAddrs    []string      `yaml:"sentinel_addrs"`
+	MasterName       string        `yaml:"master_name"`
+	Password         string        `yaml:"password"`
+	SentinelPassword string        `yaml:"sentinel_password"`
+	DB               int           `yaml:"db"`
+	PoolSize         int           `yaml:"pool_size"`
+	MinIdleConns     int           `yaml:"min_idle_conns"`
+	DialTimeout      time.Duration `yaml:"dial_timeout"`
+	ReadTimeout      time.Duration `yaml:"read_timeout"`
+	WriteTimeout     time.Duration `yaml:"write_timeout"`
+}
+
+type DBConfig struct {
+	DSN             string        `yaml:"dsn"`
+	MaxOpenConns    int           `yaml:"max_open_conns"`
+	MaxIdleConns    int           `yaml:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime"`
+}
+
+type NamespaceConfig struct {
+	CacheTimeout int `yaml:"cache_timeout"`
+}
+
+type SyncConfig struct {
+	Interval time.Duration `yaml:"interval"`
+}
+
+type HotKeyConfig struct {
+	SampleRate int           `yaml:"sample_rate"`
+	Window     time.Duration `yaml:"window"`
+	Threshold  int           `yaml:"threshold"`
+	TopN       int           `yaml:"top_n"`
+	LocalTTL   time.Duration `yaml:"local_ttl"`
+}
+
+type BreakerConfig struct {
+	Failures    int           `yaml:"failures"`
+	OpenTimeout time.Duration `yaml:"open_timeout"`
+}
+
+type DegradeConfig struct {
+	Breaker    BreakerConfig `yaml:"breaker"`
+	StaleGrace int           `yaml:"stale_grace"`
+}
+
+type HistoryConfig struct {
+	Keep int `yaml:"keep"`
+}
+
+type CompressionConfig struct {
+	Threshold int    `yaml:"threshold"`
+	Codec     string `yaml:"codec"` //gzip(默认)或flate
+}
+
+type CDCConfig struct {
+	Stream string `yaml:"stream"`
+	MaxLen int64  `yaml:"max_len"`
+}
+
+// 配置错误，Field为出错的字段，如redis.addr
+type ConfigError struct {
+	Field string
+	Msg   string
+}
+
+func (e *ConfigError) Error() string {
+	return "rcache config: " + e.Field + ": " + e.Msg
+}
+
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(data)
+}
+
+// 解析yaml配置，未知的字段按错误处理
+func ParseConfig(data []byte) (*Config, error) {
+	cfg := &Config{}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("rcache config: %w", err)
+	}
+	cfg.applyEnv()
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *Config) applyEnv() {
+	if v, ok := os.LookupEnv("RCACHE_REDIS_PASSWORD"); ok {
+		c.Redis.Password = v
+	}
+	if v, ok := os.LookupEnv("RCACHE_REDIS_SENTINEL_PASSWORD"); ok {
+		c.Redis.SentinelPassword = v
+	}
+	if v, ok := os.LookupEnv("RCACHE_DB_DSN"); ok {
+		c.DB.DSN = v
+	}
+}
+
+func (c *Config) Validate() error {
+	switch c.Redis.Mode {
+	case "", "standalone":
+		if c.Redis.Addr == "" {
+			return &ConfigError{"redis.addr", "required in standalone mode"}
+		}
+	case "sentinel":
+		if len(c.Redis.SentinelAddrs) == 0 {
+			return &ConfigError{"redis.sentinel_addrs", "required in sentinel mode"}
+		}
+		if c.Redis.MasterName == "" {
+			return &ConfigError{"redis.master_name", "required in sentinel mode"}
+		}
+	case "cluster":
+		if len(c.Redis.ClusterAddrs) == 0 {
+			return &ConfigError{"redis.cluster_addrs", "required in cluster mode"}
+		}
+		if c.Redis.DB != 0 {
+			return &ConfigError{"redis.db", "must be 0 in cluster mode"}
+		}
+		//变更流是单个key，无法与所有数据在同一个slot
+		if c.CDC != nil {
+			return &ConfigError{"cdc", "not supported in cluster mode"}
+		}
+	default:
+		return &ConfigError{"redis.mode", fmt.Sprintf("unknown mode %q, expected standalone, sentinel or cluster", c.Redis.Mode)}
+	}
+	if c.Redis.DB < 0 {
+		return &ConfigError{"redis.db", "must not be negative"}
+	}
+	if c.Redis.PoolSize < 0 {
+		return &ConfigError{"redis.pool_size", "must not be negative"}
+	}
+
+	if c.DB.DSN == "" {
+		return &ConfigError{"db.dsn", "required (or set RCACHE_DB_DSN)"}
+	}
+	if c.DB.MaxOpenConns < 0 {
+		return &ConfigError{"db.max_open_conns", "must not be negative"}
+	}
+
+	if c.CacheTimeout < 0 {
+		return &ConfigError{"cache_timeout", "must not be negative"}
+	}
+	for ns, n := range c.Namespaces {
+		if strings.Contains(ns, ":") {
+			return &ConfigError{"namespaces." + ns, "namespace must not contain ':'"}
+		}
+		if n.CacheTimeout < 0 {
+			return &ConfigError{"namespaces." + ns + ".cache_timeout", "must not be negative"}
+		}
+	}
+	if c.Sync.Interval < 0 {
+		return &ConfigError{"sync.interval", "must not be negative"}
+	}
+	if c.Degrade != nil && c.Degrade.StaleGrace < 0 {
+		return &ConfigError{"degrade.stale_grace", "must not be negative"}
+	}
+	if c.Compression != nil {
+		switch c.Compression.Codec {
+		case "", "gzip", "flate":
+		default:
+			return &ConfigError{"compression.codec", fmt.Sprintf("unknown codec %q, expected gzip or flate", c.Compression.Codec)}
+		}
+	}
+	if c.CDC != nil && c.CDC.MaxLen < 0 {
+		return &ConfigError{"cdc.max_len", "must not be negative"}
+	}
+	return nil
+}
+
+// 按配置创建redis和数据库连接以及DataProxy，连接由DataProxy.Close关闭。
+// 需要另外调用RunSync写回dirty数据
+func NewFromConfig(cfg *Config, opts ...Option) (*DataProxy, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	var redisC redis.UniversalClient
+	r := cfg.Redis
+	switch r.Mode {
+	case "cluster":
+		redisC = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        r.ClusterAddrs,
+			Password:     r.Password,
+			PoolSize:     r.PoolSize,
+			MinIdleConns: r.MinIdleConns,
+			DialTimeout:  r.DialTimeout,
+			ReadTimeout:  r.ReadTimeout,
+			WriteTimeout: r.WriteTimeout,
+		})
+	case "sentinel":
+		redisC = redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       r.MasterName,
+			SentinelAddrs:    r.SentinelAddrs,
+			SentinelPassword: r.SentinelPassword,
+			Password:         r.Password,
+			DB:               r.DB,
+			PoolSize:         r.PoolSize,
+			MinIdleConns:     r.MinIdleConns,
+			DialTimeout:      r.DialTimeout,
+			ReadTimeout:      r.ReadTimeout,
+			WriteTimeout:     r.WriteTimeout,
+		})
+	default:
+		redisC = redis.NewClient(&redis.Options{
+			Addr:         r.Addr,
+			Password:     r.Password,
+			DB:           r.DB,
+			PoolSize:     r.PoolSize,
+			MinIdleConns: r.MinIdleConns,
+			DialTimeout:  r.DialTimeout,
+			ReadTimeout:  r.ReadTimeout,
+			WriteTimeout: r.WriteTimeout,
+		})
+	}
+
+	dbc, err := sqlx.Open("postgres", cfg.DB.DSN)
+	if err != nil {
+		redisC.Close()
+		return nil, err
+	}
+	if cfg.DB.MaxOpenConns > 0 {
+		dbc.SetMaxOpenConns(cfg.DB.MaxOpenConns)
+	}
+	if cfg.DB.MaxIdleConns > 0 {
+		dbc.SetMaxIdleConns(cfg.DB.MaxIdleConns)
+	}
+	if cfg.DB.ConnMaxLifetime > 0 {
+		dbc.SetConnMaxLifetime(cfg.DB.ConnMaxLifetime)
+	}
+
+	InitScript()
+
+	namespaces := map[string]int{}
+	for ns, n := range cfg.Namespaces {
+		namespaces[ns] = n.CacheTimeout
+	}
+	options := []Option{
+		WithCacheTimeouts(cfg.CacheTimeout, namespaces),
+		WithSync(SyncOptions{Interval: cfg.Sync.Interval}),
+	}
+	if h := cfg.HotKey; h != nil {
+		options = append(options, WithHotKey(HotKeyOptions{
+			SampleRate: h.SampleRate,
+			Window:     h.Window,
+			Threshold:  h.Threshold,
+			TopN:       h.TopN,
+			LocalTTL:   h.LocalTTL,
+		}))
+	}
+	if d := cfg.Degrade; d != nil {
+		options = append(options, WithDegrade(DegradeOptions{
+			Breaker:    BreakerOptions{Failures: d.Breaker.Failures, OpenTimeout: d.Breaker.OpenTimeout},
+			StaleGrace: d.StaleGrace,
+		}))
+	}
+	if b := cfg.RedisFallback; b != nil {
+		options = append(options, WithRedisFallback(BreakerOptions{Failures: b.Failures, OpenTimeout: b.OpenTimeout}))
+	}
+	if h := cfg.History; h != nil {
+		options = append(options, WithHistory(HistoryOptions{Keep: h.Keep}))
+	}
+	if c := cfg.Compression; c != nil {
+		opt := CompressOptions{Threshold: c.Threshold}
+		if c.Codec == "flate" {
+			opt.Codec = FlateCodec{}
+		}
+		options = append(options, WithCompression(opt))
+	}
+
+	if c := cfg.CDC; c != nil {
+		options = append(options, WithCDC(CDCOptions{Stream: c.Stream, MaxLen: c.MaxLen}))
+	}
+
+	p := NewDataProxy(redisC, dbc, append(options, opts...)...)
+	p.closers = append(p.closers, redisC.Close, dbc.Close)
+	return p, nil
+}
@@ -0,0 +1,85 @@
+package rcache
+
+import (
+	"context"
+	dbsql "database/sql"
+	"errors"
+	"math"
+	"time"
+)
+
+// 计数器的取值范围
+type Bounds struct {
+	Min    int64
+	Max    int64
+	HasMin bool
+	HasMax bool
+}
+
+// 不允许小于0
+var NonNegative = Bounds{HasMin: true}
+
+func (p *DataProxy) Incr(ctx context.Context, key string, cacheTimeout ...int) (value int64, ver int, err error) {
+	return p.IncrByWithBounds(ctx, key, 1, Bounds{}, cacheTimeout...)
+}
+
+func (p *DataProxy) IncrBy(ctx context.Context, key string, delta int64, cacheTimeout ...int) (value int64, ver int, err error) {
+	return p.IncrByWithBounds(ctx, key, delta, Bounds{}, cacheTimeout...)
+}
+
+func (p *DataProxy) DecrBy(ctx context.Context, key string, delta int64, cacheTimeout ...int) (value int64, ver int, err error) {
+	if delta == math.MinInt64 {
+		return value, ver, errors.New("err_out_of_range")
+	}
+	return p.IncrByWithBounds(ctx, key, -delta, Bounds{}, cacheTimeout...)
+}
+
+// 计算在lua中进行(双精度浮点数)，计数器和delta的绝对值不能超过2^53-1
+const maxCounter = 1<<53 - 1
+
+// 原子的增加计数，不存在的key从0开始。结果超出bounds或绝对值超过maxCounter时返回err_out_of_range，
+// value不是整数时返回err_not_integer。
+func (p *DataProxy) IncrByWithBounds(ctx context.Context, key string, delta int64, bounds Bounds, cacheTimeout ...int) (value int64, ver int, err error) {
+	if delta > maxCounter || delta < -maxCounter {
+		return value, ver, errors.New("err_out_of_range")
+	}
+	if p.hotkey != nil {
+		p.hotkey.invalidate(key)
+	}
+
+	if !p.redisAllow() {
+		p.fallback.add(key)
+		start := time.Now()
+		value, ver, err = incrRowPgsql(ctx, p.dbc, key, delta, bounds)
+		p.metrics.DBUpsert(key, time.Since(start), err)
+		p.fallbackWritten(ctx, key)
+		return value, ver, err
+	}
+
+	cacheTime := p.cacheTime(key, cacheTimeout)
+	value, ver, err = redisIncrBy(ctx, p.redisC, key, delta, bounds, cacheTime, p.recorder())
+	p.redisDone(err)
+	//不在redis中，从数据库加载后重试，加载后可能又被淘汰，所以需要循环
+	for i := 0; i < 3 && err != nil && err.Error() == "err_not_in_redis"; i++ {
+		if !p.coldAllow() {
+			return value, ver, errors.New("err_cold_unavailable")
+		}
+
+		var version int
+		var v string
+		var expireAt int64
+		start := time.Now()
+		version, v, expireAt, err = queryRow(ctx, p.dbc, key)
+		p.metrics.DBLoad(key, time.Since(start), err)
+		p.coldDone(err)
+		if err != nil && err != dbsql.ErrNoRows {
+			return value, ver, err
+		}
+
+		if _, _, _, err = redisLoadGet(ctx, p.redisC, key, version, v, expireAt, cacheTime, p.staleGrace); err != nil && err.Error() != "err_not_exist" {
+			return value, ver, err
+		}
+		value, ver, err = redisIncrBy(ctx, p.redisC, key, delta, bounds, cacheTime, p.recorder())
+	}
+	return value, ver, err
+}
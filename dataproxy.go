@@ -3,7 +3,7 @@ package rcache
 import (
 	"context"
 	dbsql "database/sql"
-	"strconv"
+	"errors"
 	"time"
 
 	"github.com/jmoiron/sqlx"
@@ -11,67 +11,265 @@ import (
 )
 
 type DataProxy struct {
-	redisC *redis.Client
-	dbc    *sqlx.DB
+	redisC     redis.UniversalClient
+	cluster    bool //redis cluster，内部key按slot拆分，见slotKeys
+	dbc        *sqlx.DB
+	hotkey     *hotKeyDetector
+	cold       *breaker
+	staleGrace int
+	redisBrk   *breaker
+	fallback   *fallbackKeys
+	retry      RetryPolicy
+	history    *HistoryOptions
+	compress   *compressor
+	encrypt    *encryptor
+	ttl        *ttlPolicy
+	sync       SyncOptions
+	cdc        *CDCOptions
+	metrics    Metrics
+	closers    []func() error
 }
 
-func NewDataProxy(redisC *redis.Client, dbc *sqlx.DB) *DataProxy {
-	return &DataProxy{
-		redisC: redisC,
-		dbc:    dbc,
+type Option func(*DataProxy)
+
+// 开启热点key探测，热点key从本地副本读取
+func WithHotKey(opt HotKeyOptions) Option {
+	return func(p *DataProxy) {
+		p.hotkey = newHotKeyDetector(opt)
+	}
+}
+
+type DegradeOptions struct {
+	Breaker BreakerOptions
+	//干净数据逻辑过期后在redis中继续保留的秒数，冷存储不可用时这部分数据作为陈旧数据返回
+	StaleGrace int
+}
+
+// 开启降级模式：pgsql熔断后Get返回redis中的数据(逻辑过期的数据返回err_stale)，
+// 不在redis中的key直接写入redis，由同步时再写入pgsql
+func WithDegrade(opt DegradeOptions) Option {
+	return func(p *DataProxy) {
+		p.cold = newBreaker(opt.Breaker)
+		p.staleGrace = opt.StaleGrace
+	}
+}
+
+type ttlPolicy struct {
+	def        int
+	namespaces map[string]int
+}
+
+// 设置缓存时间，namespaces按key的namespace(第一个':'之前的部分)设置，调用时传入的cacheTimeout优先
+func WithCacheTimeouts(def int, namespaces map[string]int) Option {
+	return func(p *DataProxy) {
+		p.ttl = &ttlPolicy{def: def, namespaces: namespaces}
+	}
+}
+
+func (p *DataProxy) cacheTime(key string, cacheTimeout []int) int {
+	if len(cacheTimeout) > 0 || p.ttl == nil {
+		return getCacheTime(cacheTimeout)
+	}
+	if t, ok := p.ttl.namespaces[namespaceOf(key)]; ok && t > 0 {
+		return t
+	}
+	if p.ttl.def > 0 {
+		return p.ttl.def
 	}
+	return defaultCacheTimeout
+}
+
+// redisC可以是*redis.Client、sentinel的FailoverClient或*redis.ClusterClient
+func NewDataProxy(redisC redis.UniversalClient, dbc *sqlx.DB, opts ...Option) *DataProxy {
+	p := &DataProxy{
+		redisC:  redisC,
+		cluster: isCluster(redisC),
+		dbc:     dbc,
+		retry:   DefaultRetryPolicy,
+		metrics: nopMetrics{},
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
 }
 
 func (p *DataProxy) SetWithVersion(ctx context.Context, key string, value string, version int, cacheTimeout ...int) (ver int, err error) {
-	return p.setWithVersion(ctx, key, value, version, cacheTimeout...)
+	if p.hotkey != nil {
+		p.hotkey.invalidate(key)
+	}
+	if value, err = p.encodeValue(ctx, key, value); err != nil {
+		return ver, err
+	}
+	return p.setWithVersion(ctx, key, value, version, 0, cacheTimeout...)
 }
 
 func (p *DataProxy) Set(ctx context.Context, key string, value string, cacheTimeout ...int) (ver int, err error) {
-	return p.set(ctx, key, value, cacheTimeout...)
+	if p.hotkey != nil {
+		p.hotkey.invalidate(key)
+	}
+	if value, err = p.encodeValue(ctx, key, value); err != nil {
+		return ver, err
+	}
+	return p.set(ctx, key, value, 0, cacheTimeout...)
 }
 
-func (p *DataProxy) set(ctx context.Context, key string, value string, cacheTimeout ...int) (ver int, err error) {
+// 是否处于降级状态(pgsql熔断)
+func (p *DataProxy) Degraded() bool {
+	return p.cold != nil && p.cold.isOpen()
+}
+
+func (p *DataProxy) coldAllow() bool {
+	return p.cold == nil || p.cold.allow()
+}
+
+func (p *DataProxy) coldDone(err error) {
+	if p.cold != nil {
+		p.cold.done(err)
+	}
+}
+
+// expireAt为逻辑过期时间(unix秒)，0表示不过期
+func (p *DataProxy) set(ctx context.Context, key string, value string, expireAt int64, cacheTimeout ...int) (ver int, err error) {
+	if !p.redisAllow() {
+		return p.setToDB(ctx, key, value, 0, expireAt)
+	}
+
+	cacheTime := p.cacheTime(key, cacheTimeout)
 	//尝试直接更新redis
-	if ver, err = RedisSet(ctx, p.redisC, key, value, cacheTimeout...); err != nil {
-		if err.Error() == "err_not_in_redis" {
-			//写入数据库
-			var dbversion int
-			if dbversion, err = insertUpdateRowPgsql(ctx, p.dbc, key, value); err == nil {
-				ver = dbversion
-				RedisLoadSet(ctx, p.redisC, key, dbversion, value, cacheTimeout...)
-			}
-		}
+	ver, err = redisSet(ctx, p.redisC, key, value, 0, cacheTime, p.staleGrace, false, expireAt, p.recorder())
+	p.redisDone(err)
+	if err != nil && err.Error() == "err_not_in_redis" {
+		return p.setMiss(ctx, key, value, expireAt, cacheTime)
 	}
 	return ver, err
 }
 
-// 只有版本号一致才能更新
-func (p *DataProxy) setWithVersion(ctx context.Context, key string, value string, version int, cacheTimeout ...int) (ver int, err error) {
-	if ver, err = RedisSetWithVersion(ctx, p.redisC, key, value, version, cacheTimeout...); err != nil {
+// 不在redis中，不校验版本号写入
+func (p *DataProxy) setMiss(ctx context.Context, key string, value string, expireAt int64, cacheTime int) (ver int, err error) {
+	if p.coldAllow() {
+		//写入数据库
+		var dbversion int
+		start := time.Now()
+		dbversion, err = insertUpdateRowPgsql(ctx, p.dbc, key, value, expireAt)
+		p.metrics.DBUpsert(key, time.Since(start), err)
+		p.coldDone(err)
+		if err == nil {
+			ver = dbversion
+			redisLoadSet(ctx, p.redisC, key, dbversion, value, expireAt, cacheTime, p.staleGrace)
+			p.publish(ctx, key, ver, "set")
+			return ver, err
+		} else if p.cold == nil || !backendFailure(err) {
+			return ver, err
+		}
+	}
+	//降级，先写入redis
+	return redisSetBlind(ctx, p.redisC, key, value, cacheTime, expireAt, p.recorder())
+}
+
+// 只有版本号一致才能更新，expireAt为0时与Set一样会清除逻辑过期时间
+func (p *DataProxy) setWithVersion(ctx context.Context, key string, value string, version int, expireAt int64, cacheTimeout ...int) (ver int, err error) {
+	if !p.redisAllow() {
+		ver, err = p.setToDB(ctx, key, value, version, expireAt)
+		return ver, p.versionChecked(key, err)
+	}
+
+	cacheTime := p.cacheTime(key, cacheTimeout)
+	ver, err = redisSet(ctx, p.redisC, key, value, version, cacheTime, p.staleGrace, false, expireAt, p.recorder())
+	p.redisDone(err)
+	if err != nil {
 		if err.Error() == "err_not_in_redis" {
+			if version == 0 {
+				return p.setMiss(ctx, key, value, expireAt, cacheTime)
+			}
+
+			if !p.coldAllow() {
+				//无法校验版本号
+				return ver, errors.New("err_cold_unavailable")
+			}
 			//先尝试更新数据库
 			var dbversion int
-			if dbversion, err = updateRowPgsql(ctx, p.dbc, key, value, version); err == nil {
+			start := time.Now()
+			dbversion, err = updateRowPgsql(ctx, p.dbc, key, value, version, expireAt)
+			p.metrics.DBUpsert(key, time.Since(start), err)
+			p.coldDone(err)
+			if err == nil {
 				ver = dbversion
-				RedisLoadSet(ctx, p.redisC, key, dbversion, value, cacheTimeout...)
+				redisLoadSet(ctx, p.redisC, key, dbversion, value, expireAt, cacheTime, p.staleGrace)
+				p.publish(ctx, key, ver, "set")
 			}
 		}
+		p.versionChecked(key, err)
 	}
 	return ver, err
 }
 
 func (p *DataProxy) Get(ctx context.Context, key string, cacheTimeout ...int) (value string, ver int, err error) {
-	if value, ver, err = RedisGet(ctx, p.redisC, key, cacheTimeout...); err != nil {
+	if p.hotkey == nil {
+		value, ver, _, err = p.get(ctx, key, cacheTimeout...)
+		value, err = p.decodeValue(ctx, key, value, err)
+		return value, ver, err
+	}
+
+	var ok bool
+	if value, ver, ok = p.hotkey.get(ctx, p.redisC, key); ok {
+		p.metrics.Hit(key)
+		return value, ver, nil
+	}
+
+	var expireAt int64
+	value, ver, expireAt, err = p.get(ctx, key, cacheTimeout...)
+	//本地副本保存解码后的value
+	if value, err = p.decodeValue(ctx, key, value, err); err == nil && p.hotkey.sample(key) {
+		p.hotkey.store(key, value, ver, expireAt)
+	}
+	return value, ver, err
+}
+
+func (p *DataProxy) get(ctx context.Context, key string, cacheTimeout ...int) (value string, ver int, expireAt int64, err error) {
+	if !p.redisAllow() {
+		return p.getFromDB(ctx, key)
+	}
+
+	cacheTime := p.cacheTime(key, cacheTimeout)
+	value, ver, expireAt, err = redisGet(ctx, p.redisC, key, cacheTime, p.staleGrace, false)
+	p.redisDone(err)
+	if err == nil || err.Error() == "err_stale" {
+		p.metrics.Hit(key)
+	} else if err.Error() == "err_not_exist" {
+		p.metrics.NegativeHit(key)
+	} else {
+		if p.redisBrk != nil && backendFailure(err) {
+			return p.getFromDB(ctx, key)
+		}
+
 		if err.Error() == "err_not_in_redis" {
+			p.metrics.Miss(key)
+			if !p.coldAllow() {
+				return p.getStale(ctx, key, cacheTime, errors.New("err_cold_unavailable"))
+			}
 			//从数据库加载
 			var version int
-			version, value, err = queryRow(ctx, p.dbc, key)
+			start := time.Now()
+			version, value, expireAt, err = queryRow(ctx, p.dbc, key)
+			p.metrics.DBLoad(key, time.Since(start), err)
+			p.coldDone(err)
 			if err == nil || err == dbsql.ErrNoRows {
-				value, ver, err = RedisLoadGet(ctx, p.redisC, key, version, value, cacheTimeout...)
+				value, ver, expireAt, err = redisLoadGet(ctx, p.redisC, key, version, value, expireAt, cacheTime, p.staleGrace)
+			} else if p.cold != nil && backendFailure(err) {
+				return p.getStale(ctx, key, cacheTime, err)
 			}
 		}
 	}
-	return value, ver, err
+	return value, ver, expireAt, err
+}
+
+// 冷存储不可用时返回redis中缓存逻辑过期的数据(同时返回err_stale)，没有则返回cause
+func (p *DataProxy) getStale(ctx context.Context, key string, cacheTime int, cause error) (value string, ver int, expireAt int64, err error) {
+	if value, ver, expireAt, err = redisGet(ctx, p.redisC, key, cacheTime, p.staleGrace, true); err != nil && err.Error() == "err_not_in_redis" {
+		err = cause
+	}
+	return value, ver, expireAt, err
 }
 
 func (p *DataProxy) checkError(ctx context.Context, cancel context.CancelFunc, err error) error {
@@ -84,37 +282,132 @@ func (p *DataProxy) checkError(ctx context.Context, cancel context.CancelFunc, e
 	return err
 }
 
-func (p *DataProxy) SyncDirtyToDB(ctx context.Context) error {
+type SyncOptions struct {
+	Interval time.Duration //写回dirty数据的间隔，默认1秒
+	OnError  func(error)   //写回失败时调用，下一个周期会再次尝试
+}
+
+// 设置RunSync的参数
+func WithSync(opt SyncOptions) Option {
+	return func(p *DataProxy) {
+		p.sync = opt
+	}
+}
+
+// 周期性的执行SyncDirtyToDB，直到ctx结束
+func (p *DataProxy) RunSync(ctx context.Context) {
+	interval := p.sync.Interval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := p.SyncDirtyToDB(ctx); err != nil && ctx.Err() == nil && p.sync.OnError != nil {
+				p.sync.OnError(err)
+			}
+		}
+	}
+}
+
+// 关闭由NewFromConfig创建的redis和数据库连接，NewDataProxy传入的连接由调用方关闭
+func (p *DataProxy) Close() (err error) {
+	for _, c := range p.closers {
+		if e := c(); e != nil && err == nil {
+			err = e
+		}
+	}
+	p.closers = nil
+	return err
+}
+
+func (p *DataProxy) SyncDirtyToDB(ctx context.Context) (err error) {
+	if _, ok := p.metrics.(nopMetrics); !ok {
+		defer func(start time.Time) { p.syncDone(start, err) }(time.Now())
+	}
+
+	//先写入历史版本，保留redis中记录的写入时间
+	if p.history != nil {
+		if err = p.syncHistory(ctx); err != nil {
+			return err
+		}
+	}
+
+	slots, err := p.slots(ctx, func(ks slotKeys) string { return ks.dirty })
+	if err != nil {
+		return err
+	}
+	for _, slot := range slots {
+		if err = p.syncSlot(ctx, p.slotKeys(slot)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 写回一个slot中的dirty key，单节点时只有一个slot
+func (p *DataProxy) syncSlot(ctx context.Context, ks slotKeys) (err error) {
 	cursor := uint64(0)
 	var keys []string
-	var err error
+	synced := map[string]bool{}
 
 	for {
 		cc, cancel := context.WithTimeout(ctx, time.Second)
-		keys, cursor, err = p.redisC.HScan(cc, dirtyKey, cursor, "", 100).Result()
+		keys, cursor, err = p.redisC.HScan(cc, ks.dirty, cursor, "", 100).Result()
 		if err = p.checkError(cc, cancel, err); err != nil {
 			return err
 		}
 
+		//事务写入的key整组写回
+		var groups []any
+		fields := []string{}
 		for i := 0; i < len(keys); i = i + 2 {
-			key := keys[i]
+			fields = append(fields, keys[i])
+		}
+		if len(fields) > 0 {
 			cc, cancel = context.WithTimeout(ctx, time.Second)
-			r, err := p.redisC.HMGet(cc, key, "version", "value").Result()
+			groups, err = p.redisC.HMGet(cc, ks.dirtyGroup, fields...).Result()
 			if err = p.checkError(cc, cancel, err); err != nil {
 				return err
 			}
-			version, _ := strconv.Atoi(r[0].(string))
-			value := r[1].(string)
-			cc, cancel = context.WithTimeout(ctx, time.Second)
-			err = writebackPgsql(cc, p.dbc, key, value, version)
-			if err = p.checkError(cc, cancel, err); err != nil {
-				return err
+		}
+
+		dead, err := p.deadLetterVersions(ctx, fields)
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i < len(keys); i = i + 2 {
+			if version, ok := dead[keys[i]]; ok {
+				if version == parseVersion(keys[i+1]) {
+					//数据库拒绝的版本，等待写入新版本或人工处理
+					continue
+				}
+				cc, cancel = context.WithTimeout(ctx, time.Second)
+				err = p.redisC.HDel(cc, ks.deadLetter, keys[i]).Err()
+				if err = p.checkError(cc, cancel, err); err != nil {
+					return err
+				}
 			}
 
-			//清除dirty标记
-			cc, cancel = context.WithTimeout(ctx, time.Second)
-			err = RedisClearDirty(cc, p.redisC, key, version)
-			if err = p.checkError(cc, cancel, err); err != nil {
+			if gid, ok := groups[i/2].(string); ok {
+				done, seen := synced[gid]
+				if !seen {
+					if done, err = p.syncGroup(ctx, ks, gid); err != nil {
+						return err
+					}
+					synced[gid] = done
+				}
+				if done {
+					continue
+				}
+			}
+
+			if err = p.syncKey(ctx, keys[i]); err != nil {
 				return err
 			}
 		}
@@ -127,3 +420,69 @@ func (p *DataProxy) SyncDirtyToDB(ctx context.Context) error {
 	return nil
 
 }
+
+// 将一个dirty key写回数据库并清除dirty标记
+func (p *DataProxy) syncKey(ctx context.Context, key string) (err error) {
+	cc, cancel := context.WithTimeout(ctx, time.Second)
+	m, gid, ok, err := redisSyncSnapshot(cc, p.redisC, key)
+	if err = p.checkError(cc, cancel, err); err != nil || !ok {
+		return err
+	}
+	if gid != "" {
+		//HSCAN之后被事务写入，整组写回
+		_, err = p.syncGroup(ctx, keysOf(p.redisC, key), gid)
+		return err
+	}
+	if m.dead {
+		//HSCAN之后被记录为dead letter(如ListenInvalidations发现外部修改)，不能覆盖
+		return nil
+	}
+	version, value, deleted, expireAt := m.version, m.value, m.deleted, m.expireAt
+
+	if m.blind {
+		//降级期间写入的数据，以数据库中的版本号为基准重新调整
+		dbversion := version
+		cc, cancel = context.WithTimeout(ctx, time.Second)
+		start := time.Now()
+		if deleted {
+			dbversion, err = deleteBlindPgsql(cc, p.dbc, key, version)
+		} else {
+			dbversion, err = upsertBlindPgsql(cc, p.dbc, key, value, version, expireAt)
+		}
+		err = p.checkError(cc, cancel, err)
+		p.metrics.Writeback(key, time.Since(start), err)
+		if poisonError(err) {
+			return p.addDeadLetter(ctx, key, version, err)
+		} else if err != nil {
+			return err
+		}
+
+		cc, cancel = context.WithTimeout(ctx, time.Second)
+		err = redisRebase(cc, p.redisC, key, version, dbversion, p.staleGrace)
+		return p.checkError(cc, cancel, err)
+	}
+
+	cc, cancel = context.WithTimeout(ctx, time.Second)
+	start := time.Now()
+	if deleted {
+		err = writebackDeletePgsql(cc, p.dbc, key, version)
+	} else {
+		err = writebackPgsql(cc, p.dbc, key, value, version, expireAt)
+	}
+	err = p.checkError(cc, cancel, err)
+	p.metrics.Writeback(key, time.Since(start), err)
+	if poisonError(err) {
+		//不阻塞其它key的写回
+		return p.addDeadLetter(ctx, key, version, err)
+	} else if err != nil {
+		return err
+	}
+
+	//清除dirty标记
+	cc, cancel = context.WithTimeout(ctx, time.Second)
+	err = redisClearDirty(cc, p.redisC, key, version, p.staleGrace)
+	if err = p.checkError(cc, cancel, err); err != nil {
+		p.metrics.ClearDirtyFailed(key, err)
+	}
+	return err
+}
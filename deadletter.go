@@ -0,0 +1,149 @@
+package rcache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+	redis "github.com/redis/go-redis/v9"
+)
+
+// 写回时数据库拒绝的key：key -> json(DeadLetter)，集群模式下按slot拆分
+const deadLetterKey = "__deadletter__"
+
+// 数据库因数据本身拒绝写入的dirty key，同步时跳过直到写入了新的版本或被重试/丢弃。
+// key仍然保留dirty标记，不会因为过期而丢失数据
+type DeadLetter struct {
+	Key     string    `json:"key"`
+	Version int       `json:"version"`
+	Error   string    `json:"error"`
+	At      time.Time `json:"at"`
+}
+
+// 数据异常(22)和约束冲突(23)重试也不会成功，其它错误(连接、超时等)在下一个周期重试
+func poisonError(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code.Class() {
+		case "22", "23":
+			return true
+		}
+	}
+	return false
+}
+
+func (p *DataProxy) addDeadLetter(ctx context.Context, key string, version int, cause error) error {
+	b, _ := json.Marshal(DeadLetter{Key: key, Version: version, Error: cause.Error(), At: time.Now()})
+	cc, cancel := context.WithTimeout(ctx, time.Second)
+	err := p.redisC.HSet(cc, keysOf(p.redisC, key).deadLetter, key, b).Err()
+	return p.checkError(cc, cancel, err)
+}
+
+// 返回keys中仍处于dead letter状态的版本号
+func (p *DataProxy) deadLetterVersions(ctx context.Context, keys []string) (versions map[string]int, err error) {
+	versions = map[string]int{}
+	if len(keys) == 0 {
+		return versions, nil
+	}
+	//按所在的dead letter hash分组，单节点时只有一组
+	byHash := map[string][]string{}
+	for _, key := range keys {
+		h := keysOf(p.redisC, key).deadLetter
+		byHash[h] = append(byHash[h], key)
+	}
+	cc, cancel := context.WithTimeout(ctx, time.Second)
+	pipe := p.redisC.Pipeline()
+	cmds := map[string]*redis.SliceCmd{}
+	for h, ks := range byHash {
+		cmds[h] = pipe.HMGet(cc, h, ks...)
+	}
+	_, err = pipe.Exec(cc)
+	if err = p.checkError(cc, cancel, err); err != nil {
+		return nil, err
+	}
+	for h, cmd := range cmds {
+		for i, v := range cmd.Val() {
+			if s, ok := v.(string); ok {
+				var d DeadLetter
+				if json.Unmarshal([]byte(s), &d) == nil {
+					versions[byHash[h][i]] = d.Version
+				}
+			}
+		}
+	}
+	return versions, nil
+}
+
+func (p *DataProxy) DeadLetters(ctx context.Context) (letters []DeadLetter, err error) {
+	slots, err := p.slots(ctx, func(ks slotKeys) string { return ks.deadLetter })
+	if err != nil {
+		return nil, err
+	}
+	for _, slot := range slots {
+		cc, cancel := context.WithTimeout(ctx, time.Second*5)
+		r, err := p.redisC.HGetAll(cc, p.slotKeys(slot).deadLetter).Result()
+		if err = p.checkError(cc, cancel, err); err != nil {
+			return nil, err
+		}
+		for key, v := range r {
+			d := DeadLetter{Key: key}
+			if e := json.Unmarshal([]byte(v), &d); e != nil {
+				d.Error = "err_decode: " + e.Error()
+			}
+			letters = append(letters, d)
+		}
+	}
+	return letters, nil
+}
+
+// 立即重新写回key，仍然失败时重新记录为dead letter并返回错误
+func (p *DataProxy) RetryDeadLetter(ctx context.Context, key string) (err error) {
+	cc, cancel := context.WithTimeout(ctx, time.Second)
+	err = p.redisC.HDel(cc, keysOf(p.redisC, key).deadLetter, key).Err()
+	if err = p.checkError(cc, cancel, err); err != nil {
+		return err
+	}
+	if err = p.Flush(ctx, key); err != nil {
+		return err
+	}
+	//Flush中的写回失败只会重新记录dead letter
+	letters, err := p.deadLetterVersions(ctx, []string{key})
+	if err != nil {
+		return err
+	}
+	if _, ok := letters[key]; ok {
+		return errors.New("err_dead_letter")
+	}
+	return nil
+}
+
+// 放弃redis中未写回的修改：清除dirty标记并删除缓存，之后以数据库中的数据为准
+func (p *DataProxy) DiscardDeadLetter(ctx context.Context, key string) (err error) {
+	letters, err := p.deadLetterVersions(ctx, []string{key})
+	if err != nil {
+		return err
+	}
+	version, ok := letters[key]
+	if !ok {
+		return errors.New("err_not_exist")
+	}
+	cc, cancel := context.WithTimeout(ctx, time.Second)
+	err = redisDiscard(cc, p.redisC, key, version)
+	if err = p.checkError(cc, cancel, err); err != nil {
+		return err
+	}
+	if p.hotkey != nil {
+		p.hotkey.invalidate(key)
+	}
+	cc, cancel = context.WithTimeout(ctx, time.Second)
+	err = p.redisC.HDel(cc, keysOf(p.redisC, key).deadLetter, key).Err()
+	return p.checkError(cc, cancel, err)
+}
+
+func parseVersion(s string) int {
+	v, _ := strconv.Atoi(s)
+	return v
+}
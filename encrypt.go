@@ -0,0 +1,349 @@
+package rcache
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 加密后的value格式：0x1b 'e' keyID ':' base64(nonce+密文)，key作为附加数据，密文不能挪到其它key下使用
+const encryptedID = 'e'
+
+// 提供数据密钥(AES-128/192/256)，namespace为key中第一个':'之前的部分，没有':'时为空字符串
+type KeyProvider interface {
+	//namespace当前用于加密的密钥，keyID不能包含':'
+	CurrentKey(ctx context.Context, namespace string) (keyID string, key []byte, err error)
+	//按keyID返回密钥，用于解密旧数据
+	Key(ctx context.Context, namespace string, keyID string) (key []byte, err error)
+}
+
+// 固定的密钥表，用于测试或密钥由配置下发的场景
+type StaticKeyProvider struct {
+	Keys    map[string][]byte //keyID -> 密钥
+	Current map[string]string //namespace -> 当前keyID，没有配置的namespace使用Current[""]
+}
+
+func (s *StaticKeyProvider) CurrentKey(ctx context.Context, namespace string) (keyID string, key []byte, err error) {
+	keyID, ok := s.Current[namespace]
+	if !ok {
+		keyID = s.Current[""]
+	}
+	key, err = s.Key(ctx, namespace, keyID)
+	return keyID, key, err
+}
+
+func (s *StaticKeyProvider) Key(ctx context.Context, namespace string, keyID string) (key []byte, err error) {
+	if key = s.Keys[keyID]; key == nil {
+		return nil, errors.New("err_unknown_key")
+	}
+	return key, nil
+}
+
+type EncryptOptions struct {
+	Provider KeyProvider
+	CacheTTL time.Duration //当前密钥的缓存时间，轮换后最多经过CacheTTL开始使用新密钥，默认1分钟
+}
+
+type currentKey struct {
+	keyID     string
+	aead      cipher.AEAD
+	fetchedAt time.Time
+}
+
+type encryptor struct {
+	opt     EncryptOptions
+	mu      sync.Mutex
+	current map[string]*currentKey //namespace -> 当前密钥
+	aeads   map[string]cipher.AEAD //namespace+":"+keyID -> 密钥
+}
+
+// 开启value加密(AES-GCM)，value在写入redis和pgsql前加密，读取时解密。
+// 计数器(IncrBy)的value由redis直接运算，不会被加密
+func WithEncryption(opt EncryptOptions) Option {
+	return func(p *DataProxy) {
+		if opt.CacheTTL <= 0 {
+			opt.CacheTTL = time.Minute
+		}
+		p.encrypt = &encryptor{
+			opt:     opt,
+			current: map[string]*currentKey{},
+			aeads:   map[string]cipher.AEAD{},
+		}
+	}
+}
+
+// key中第一个':'之前的部分
+func namespaceOf(key string) string {
+	if i := strings.IndexByte(key, ':'); i >= 0 {
+		return key[:i]
+	}
+	return ""
+}
+
+func (e *encryptor) currentKey(ctx context.Context, namespace string) (*currentKey, error) {
+	e.mu.Lock()
+	c := e.current[namespace]
+	e.mu.Unlock()
+	if c != nil && time.Since(c.fetchedAt) < e.opt.CacheTTL {
+		return c, nil
+	}
+
+	keyID, key, err := e.opt.Provider.CurrentKey(ctx, namespace)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	c = &currentKey{keyID: keyID, aead: aead, fetchedAt: time.Now()}
+	e.mu.Lock()
+	e.current[namespace] = c
+	e.aeads[namespace+":"+keyID] = aead
+	e.mu.Unlock()
+	return c, nil
+}
+
+func (e *encryptor) aead(ctx context.Context, namespace string, keyID string) (cipher.AEAD, error) {
+	e.mu.Lock()
+	aead := e.aeads[namespace+":"+keyID]
+	e.mu.Unlock()
+	if aead != nil {
+		return aead, nil
+	}
+
+	key, err := e.opt.Provider.Key(ctx, namespace, keyID)
+	if err != nil {
+		return nil, err
+	}
+	if aead, err = newAEAD(key); err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	e.aeads[namespace+":"+keyID] = aead
+	e.mu.Unlock()
+	return aead, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (e *encryptor) encrypt(ctx context.Context, key string, value string) (string, error) {
+	c, err := e.currentKey(ctx, namespaceOf(key))
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(value)+c.aead.Overhead())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := c.aead.Seal(nonce, nonce, []byte(value), []byte(key))
+	return string([]byte{valueMagic, encryptedID}) + c.keyID + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// 返回value使用的keyID，没有加密时ok为false
+func encryptedKeyID(value string) (keyID string, ok bool) {
+	if len(value) < 2 || value[0] != valueMagic || value[1] != encryptedID {
+		return "", false
+	}
+	i := strings.IndexByte(value[2:], ':')
+	if i < 0 {
+		return "", false
+	}
+	return value[2 : 2+i], true
+}
+
+// 没有加密的value原样返回
+func (e *encryptor) decrypt(ctx context.Context, key string, value string) (string, error) {
+	keyID, ok := encryptedKeyID(value)
+	if !ok {
+		return value, nil
+	}
+	aead, err := e.aead(ctx, namespaceOf(key), keyID)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(value[3+len(keyID):])
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errors.New("err_decrypt")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(key))
+	if err != nil {
+		return "", errors.New("err_decrypt")
+	}
+	return string(plain), nil
+}
+
+type ReencryptOptions struct {
+	Prefix     string //只处理指定前缀的key
+	BatchSize  int    //每批读取的行数，默认500
+	StartAfter string
+	Progress   func(PreloadProgress)
+	//冷存储不可用而跳过的key在其它key处理完后重试，重试的间隔，默认5s
+	RetryInterval time.Duration
+}
+
+// 将用旧密钥加密的value用当前密钥重新加密，未加密的value(如计数器)不处理。
+// 通过版本号校验写回，期间被并发更新的key已经使用新密钥，直接跳过。
+// 先按数据库中的key处理，再处理只在redis中的dirty key(还未写回或dead letter)。
+// 冷存储不可用的key重试3次后仍然失败时返回err_cold_unavailable，可以稍后重新执行
+func (p *DataProxy) Reencrypt(ctx context.Context, opt ReencryptOptions) (n int, err error) {
+	if p.encrypt == nil {
+		return 0, errors.New("err_encryption_disabled")
+	}
+	batchSize := opt.BatchSize
+	if batchSize <= 0 {
+		batchSize = 500
+	}
+	if opt.RetryInterval <= 0 {
+		opt.RetryInterval = time.Second * 5
+	}
+
+	var skipped []string
+	process := func(key string) error {
+		reencrypted, err := p.reencryptKey(ctx, key)
+		if err != nil && coldUnavailable(err) {
+			skipped = append(skipped, key)
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if reencrypted {
+			n++
+		}
+		return nil
+	}
+
+	var cond string
+	var args []any
+	if opt.Prefix != "" {
+		cond = `key like $1`
+		args = []any{likePrefix(opt.Prefix)}
+	}
+
+	progress := PreloadProgress{LastKey: opt.StartAfter}
+	for {
+		var rows []row
+		if rows, err = queryRowsAfter(ctx, p.dbc, cond, args, progress.LastKey, batchSize); err != nil {
+			return n, err
+		}
+
+		for _, r := range rows {
+			var stale bool
+			if stale, err = p.encryptedWithOldKey(ctx, r.key, r.value); err != nil {
+				return n, err
+			}
+			//未加密或已经使用当前密钥的行不经过redis，避免把整个表加载到redis中。
+			//redis中还未写回的修改由之后的dirty key处理
+			if stale {
+				if err = process(r.key); err != nil {
+					return n, err
+				}
+			}
+			progress.Loaded++
+			progress.LastKey = r.key
+		}
+
+		if opt.Progress != nil && len(rows) > 0 {
+			opt.Progress(progress)
+		}
+
+		if len(rows) < batchSize {
+			break
+		}
+	}
+
+	dirty, err := p.dirtyKeysWithPrefix(ctx, opt.Prefix)
+	if err != nil {
+		return n, err
+	}
+	for _, key := range dirty {
+		if err = process(key); err != nil {
+			return n, err
+		}
+		progress.Loaded++
+	}
+	if opt.Progress != nil && len(dirty) > 0 {
+		opt.Progress(progress)
+	}
+
+	for i := 0; i < 3 && len(skipped) > 0; i++ {
+		select {
+		case <-ctx.Done():
+			return n, ctx.Err()
+		case <-time.After(opt.RetryInterval):
+		}
+		keys := skipped
+		skipped = nil
+		for _, key := range keys {
+			if err = process(key); err != nil {
+				return n, err
+			}
+		}
+	}
+	if len(skipped) > 0 {
+		return n, errors.New("err_cold_unavailable")
+	}
+	return n, nil
+}
+
+// value是否用当前密钥以外的密钥加密
+func (p *DataProxy) encryptedWithOldKey(ctx context.Context, key string, value string) (bool, error) {
+	keyID, ok := encryptedKeyID(value)
+	if !ok {
+		return false, nil
+	}
+	c, err := p.encrypt.currentKey(ctx, namespaceOf(key))
+	if err != nil {
+		return false, err
+	}
+	return keyID != c.keyID, nil
+}
+
+// 冷存储熔断时读到的是逻辑过期的陈旧数据或读不到，不能据此写回
+func coldUnavailable(err error) bool {
+	return err.Error() == "err_stale" || err.Error() == "err_cold_unavailable"
+}
+
+func (p *DataProxy) reencryptKey(ctx context.Context, key string) (bool, error) {
+	raw, ver, expireAt, err := p.get(ctx, key)
+	if err != nil {
+		if err.Error() == "err_not_exist" {
+			return false, nil
+		}
+		return false, err
+	}
+
+	if stale, err := p.encryptedWithOldKey(ctx, key, raw); err != nil || !stale {
+		return false, err
+	}
+
+	value, err := p.encrypt.decrypt(ctx, key, raw)
+	if err != nil {
+		return false, err
+	}
+	if value, err = p.encrypt.encrypt(ctx, key, value); err != nil {
+		return false, err
+	}
+	if p.hotkey != nil {
+		p.hotkey.invalidate(key)
+	}
+	if _, err = p.setWithVersion(ctx, key, value, ver, expireAt); err != nil {
+		if err.Error() == "err_version_not_match" {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,86 @@
+package rcache
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// 写入value并设置逻辑过期时间，到期后在redis和数据库中都按不存在处理。
+// 与缓存超时不同，过期时间随记录一起写回数据库，到期的记录由ReapExpired转为墓碑。
+func (p *DataProxy) SetWithExpiry(ctx context.Context, key string, value string, expireAt time.Time, cacheTimeout ...int) (ver int, err error) {
+	if p.hotkey != nil {
+		p.hotkey.invalidate(key)
+	}
+	if value, err = p.encodeValue(ctx, key, value); err != nil {
+		return ver, err
+	}
+	return p.set(ctx, key, value, unixExpire(expireAt), cacheTimeout...)
+}
+
+// 修改已存在key的逻辑过期时间，expireAt为零值时取消过期。key不存在返回err_not_exist
+func (p *DataProxy) ExpireAt(ctx context.Context, key string, expireAt time.Time, cacheTimeout ...int) (ver int, err error) {
+	if p.hotkey != nil {
+		p.hotkey.invalidate(key)
+	}
+
+	exp := unixExpire(expireAt)
+	if !p.redisAllow() {
+		p.fallback.add(key)
+		start := time.Now()
+		ver, err = expireRowPgsql(ctx, p.dbc, key, exp)
+		p.metrics.DBUpsert(key, time.Since(start), err)
+		p.fallbackWritten(ctx, key)
+		return ver, err
+	}
+
+	ver, err = redisExpireAt(ctx, p.redisC, key, exp, p.cacheTime(key, cacheTimeout), p.recorder())
+	p.redisDone(err)
+	if err != nil && err.Error() == "err_not_in_redis" {
+		if !p.coldAllow() {
+			return ver, errors.New("err_cold_unavailable")
+		}
+		start := time.Now()
+		ver, err = expireRowPgsql(ctx, p.dbc, key, exp)
+		p.metrics.DBUpsert(key, time.Since(start), err)
+		p.coldDone(err)
+		if err == nil {
+			p.publish(ctx, key, ver, "expire")
+		}
+	}
+	return ver, err
+}
+
+// 默认的墓碑保留时间
+const defaultTombstoneRetention = 7 * 24 * time.Hour
+
+// 把数据库中已过期的记录转为墓碑，并删除保留超过retention(<=0时为7天)的墓碑，每批最多batch条，返回处理的条数。
+// 墓碑保留版本号，删除后重新写入的key版本号继续递增；retention需要大于缓存超时和客户端持有旧版本号的时间。
+// redis中的过期数据读取时已按不存在处理，随缓存超时淘汰
+func (p *DataProxy) ReapExpired(ctx context.Context, batch int, retention time.Duration) (n int, err error) {
+	if batch <= 0 {
+		batch = 1000
+	}
+	if retention <= 0 {
+		retention = defaultTombstoneRetention
+	}
+	for {
+		before := time.Now().Add(-retention).Unix()
+		var expiredN, purged int
+		expiredN, purged, err = reapExpiredPgsql(ctx, p.dbc, batch, before)
+		n += expiredN + purged
+		if err != nil {
+			return n, err
+		}
+		if expiredN < batch && purged < batch {
+			return n, nil
+		}
+	}
+}
+
+func unixExpire(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
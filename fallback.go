@@ -0,0 +1,150 @@
+package rcache
+
+import (
+	"context"
+	dbsql "database/sql"
+	"errors"
+	"sync"
+	"time"
+)
+
+// 降级期间直接写入数据库的key，redis恢复后需要与redis中的数据核对
+type fallbackKeys struct {
+	mu   sync.Mutex
+	keys map[string]struct{}
+}
+
+func (f *fallbackKeys) add(key string) {
+	f.mu.Lock()
+	f.keys[key] = struct{}{}
+	f.mu.Unlock()
+}
+
+func (f *fallbackKeys) take() (keys []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for k := range f.keys {
+		keys = append(keys, k)
+	}
+	f.keys = map[string]struct{}{}
+	return keys
+}
+
+func (f *fallbackKeys) restore(keys []string) {
+	f.mu.Lock()
+	for _, k := range keys {
+		f.keys[k] = struct{}{}
+	}
+	f.mu.Unlock()
+}
+
+// 开启redis熔断：熔断期间Get直接读取pgsql，写入以版本号保护直接更新pgsql。
+// 熔断超时后用PING探测redis，恢复前先核对熔断期间写过的key，redis中不比数据库新的数据会被清除。
+func WithRedisFallback(opt BreakerOptions) Option {
+	return func(p *DataProxy) {
+		p.redisBrk = newBreaker(opt)
+		p.fallback = &fallbackKeys{keys: map[string]struct{}{}}
+		p.redisBrk.probe = func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+			defer cancel()
+			if err := p.redisC.Ping(ctx).Err(); err != nil {
+				return err
+			}
+			return p.reconcile(ctx)
+		}
+	}
+}
+
+func (p *DataProxy) redisAllow() bool {
+	return p.redisBrk == nil || p.redisBrk.allow()
+}
+
+func (p *DataProxy) redisDone(err error) {
+	if p.redisBrk != nil {
+		p.redisBrk.done(err)
+	}
+}
+
+// 是否处于redis熔断状态
+func (p *DataProxy) RedisUnavailable() bool {
+	return p.redisBrk != nil && p.redisBrk.isOpen()
+}
+
+func (p *DataProxy) getFromDB(ctx context.Context, key string) (value string, ver int, expireAt int64, err error) {
+	start := time.Now()
+	ver, value, expireAt, err = queryRow(ctx, p.dbc, key)
+	p.metrics.DBLoad(key, time.Since(start), err)
+	if err == dbsql.ErrNoRows || (err == nil && expired(expireAt)) {
+		err = errors.New("err_not_exist")
+	}
+	return value, ver, expireAt, err
+}
+
+func (p *DataProxy) setToDB(ctx context.Context, key string, value string, version int, expireAt int64) (ver int, err error) {
+	p.fallback.add(key)
+	start := time.Now()
+	if version > 0 {
+		ver, err = updateRowPgsql(ctx, p.dbc, key, value, version, expireAt)
+	} else {
+		ver, err = insertUpdateRowPgsql(ctx, p.dbc, key, value, expireAt)
+	}
+	p.metrics.DBUpsert(key, time.Since(start), err)
+	p.fallbackWritten(ctx, key)
+	return ver, err
+}
+
+// 熔断期间直接写入了数据库。写入前已经用fallback.add记录key，写入期间probe完成核对时不会遗漏；
+// 写入后再次记录并核对，写入失败(如超时)也可能已经提交，同样需要核对
+func (p *DataProxy) fallbackWritten(ctx context.Context, key string) {
+	p.fallback.add(key)
+	if !p.redisBrk.rejecting() {
+		//已经开始探测或已恢复，probe可能已经核对完，由自己核对
+		p.reconcile(ctx)
+	}
+}
+
+// 核对熔断期间直接写入数据库的key
+func (p *DataProxy) reconcile(ctx context.Context) error {
+	for {
+		keys := p.fallback.take()
+		if len(keys) == 0 {
+			return nil
+		}
+
+		rows, err := queryRawRows(ctx, p.dbc, keys)
+		if err != nil {
+			p.fallback.restore(keys)
+			return err
+		}
+
+		for i, key := range keys {
+			version := 0
+			if r := rows[key]; r != nil {
+				version = r.version
+			}
+			if err = redisReconcile(ctx, p.redisC, key, version); err != nil {
+				p.fallback.restore(keys[i:])
+				p.publishFallback(ctx, keys[:i], rows)
+				return err
+			}
+		}
+		p.publishFallback(ctx, keys, rows)
+	}
+}
+
+// 熔断期间直接写入数据库时redis不可用，没有发布变化，核对后按数据库中的当前版本补发到Watch和变更流。
+// 写入前后都会核对，同一个版本可能发布多次
+func (p *DataProxy) publishFallback(ctx context.Context, keys []string, rows map[string]*row) {
+	sets, dels := map[string]int{}, map[string]int{}
+	for _, key := range keys {
+		if r := rows[key]; r == nil {
+			continue
+		} else if expired(r.expireAt) {
+			dels[key] = r.version
+		} else {
+			sets[key] = r.version
+		}
+	}
+	p.publishVersions(ctx, sets, "set")
+	p.publishVersions(ctx, dels, "del")
+}
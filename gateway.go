@@ -0,0 +1,331 @@
+package rcache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// HTTP/JSON网关：
+//
+//	GET    /kv/{key}  返回{"key","value","version"}，ETag为版本号
+//	PUT    /kv/{key}  body为{"value"}，If-Match按版本号写入(*表示key必须存在)，If-None-Match: *只在不存在时创建
+//	DELETE /kv/{key}  If-Match按版本号删除
+//	POST   /batch     批量操作，atomic为true时作为一个事务(Txn)执行
+//
+// 错误统一返回{"error":{"code","message"}}，不存在返回404，版本号不一致返回412，后端不可用返回503，
+// 请求体超过maxHTTPBody返回413
+func NewHTTPHandler(p *DataProxy) http.Handler {
+	h := &httpHandler{proxy: p}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /kv/{key...}", h.get)
+	mux.HandleFunc("PUT /kv/{key...}", h.put)
+	mux.HandleFunc("DELETE /kv/{key...}", h.delete)
+	mux.HandleFunc("POST /batch", h.batch)
+	return mux
+}
+
+// 请求体的最大长度
+const maxHTTPBody = 16 << 20
+
+type httpHandler struct {
+	proxy *DataProxy
+}
+
+type httpError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type httpItem struct {
+	Key     string     `json:"key"`
+	Value   *string    `json:"value,omitempty"`
+	Version int        `json:"version,omitempty"`
+	Stale   bool       `json:"stale,omitempty"`
+	Error   *httpError `json:"error,omitempty"`
+}
+
+var httpMessages = map[string]string{
+	"err_not_exist":           "key does not exist",
+	"err_exist":               "key already exists",
+	"err_version_not_match":   "version does not match",
+	"err_cold_unavailable":    "cold store is unavailable",
+	"err_redis_unavailable":   "redis is unavailable",
+	"err_not_integer":         "value is not an integer",
+	"err_out_of_range":        "value is out of range",
+	"err_duplicate_key":       "duplicate key in transaction",
+	"err_cross_slot":          "keys of the transaction are in different slots",
+	"err_body_too_large":      "request body is too large",
+	"err_bad_request":         "bad request",
+	"err_backend_unavailable": "backend is unavailable",
+}
+
+// 错误码和对应的http状态码，不是rcache错误码的错误按后端故障处理
+func httpStatus(err error) (int, *httpError) {
+	code := err.Error()
+	var status int
+	switch {
+	case code == "err_not_exist":
+		status = http.StatusNotFound
+	case code == "err_version_not_match", code == "err_exist":
+		status = http.StatusPreconditionFailed
+	case code == "err_cold_unavailable", code == "err_redis_unavailable":
+		status = http.StatusServiceUnavailable
+	case code == "err_bad_request", code == "err_duplicate_key", code == "err_cross_slot", code == "err_not_integer", code == "err_out_of_range":
+		status = http.StatusBadRequest
+	case code == "err_body_too_large":
+		status = http.StatusRequestEntityTooLarge
+	case errors.Is(err, context.DeadlineExceeded):
+		status = http.StatusGatewayTimeout
+		code = "err_timeout"
+	case strings.HasPrefix(code, "err_"):
+		status = http.StatusInternalServerError
+	default:
+		status = http.StatusServiceUnavailable
+		code = "err_backend_unavailable"
+	}
+	msg, ok := httpMessages[code]
+	if !ok {
+		msg = err.Error()
+	}
+	return status, &httpError{Code: code, Message: msg}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status, e := httpStatus(err)
+	writeJSON(w, status, map[string]*httpError{"error": e})
+}
+
+func etag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// 解析If-Match/If-None-Match中的版本号，*返回-1
+func parseETag(s string) (version int, err error) {
+	s = strings.TrimSpace(s)
+	if s == "*" {
+		return -1, nil
+	}
+	s = strings.Trim(strings.TrimPrefix(s, "W/"), `"`)
+	if version, err = strconv.Atoi(s); err != nil || version <= 0 {
+		return 0, errors.New("err_bad_request")
+	}
+	return version, nil
+}
+
+// 解析json请求体，长度超过maxHTTPBody返回err_body_too_large，格式错误返回err_bad_request
+func decodeBody(w http.ResponseWriter, r *http.Request, v any) error {
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxHTTPBody)).Decode(v)
+	var mbe *http.MaxBytesError
+	switch {
+	case errors.As(err, &mbe):
+		return errors.New("err_body_too_large")
+	case err != nil:
+		return errors.New("err_bad_request")
+	}
+	return nil
+}
+
+func (h *httpHandler) get(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	value, ver, err := h.proxy.Get(r.Context(), key)
+	stale := err != nil && err.Error() == "err_stale"
+	if err != nil && !stale {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag(ver))
+	if stale {
+		w.Header().Set("Warning", `110 - "Response is Stale"`)
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if v, e := parseETag(inm); e == nil && (v == -1 || v == ver) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, httpItem{Key: key, Value: &value, Version: ver, Stale: stale})
+}
+
+func (h *httpHandler) put(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	var body struct {
+		Value *string `json:"value"`
+	}
+	if err := decodeBody(w, r, &body); err != nil {
+		writeError(w, err)
+		return
+	} else if body.Value == nil {
+		writeError(w, errors.New("err_bad_request"))
+		return
+	}
+
+	var ver int
+	var err error
+	status := http.StatusOK
+	im, inm := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+	switch {
+	case im != "" && inm != "":
+		err = errors.New("err_bad_request")
+	case im != "":
+		var version int
+		if version, err = parseETag(im); err == nil {
+			if version == -1 {
+				ver, err = h.proxy.SetIfExists(r.Context(), key, *body.Value)
+			} else {
+				ver, err = h.proxy.SetWithVersion(r.Context(), key, *body.Value, version)
+			}
+		}
+	case inm != "":
+		if strings.TrimSpace(inm) != "*" {
+			err = errors.New("err_bad_request")
+		} else if ver, err = h.proxy.SetNX(r.Context(), key, *body.Value); err == nil {
+			status = http.StatusCreated
+		}
+	default:
+		ver, err = h.proxy.Set(r.Context(), key, *body.Value)
+	}
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("ETag", etag(ver))
+	writeJSON(w, status, httpItem{Key: key, Version: ver})
+}
+
+func (h *httpHandler) delete(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	version := 0
+	if im := r.Header.Get("If-Match"); im != "" {
+		var err error
+		if version, err = parseETag(im); err != nil {
+			writeError(w, err)
+			return
+		} else if version == -1 {
+			version = 0
+		}
+	}
+	if err := h.proxy.CompareAndDelete(r.Context(), key, version); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type httpBatchOp struct {
+	Op      string  `json:"op"` //get,set,delete，atomic时还可以是check
+	Key     string  `json:"key"`
+	Value   *string `json:"value,omitempty"`
+	Version int     `json:"version,omitempty"` //大于0时需要版本号一致
+}
+
+type httpBatchRequest struct {
+	Atomic bool          `json:"atomic"`
+	Ops    []httpBatchOp `json:"ops"`
+}
+
+// 非atomic时每个操作独立执行，结果中带各自的错误；atomic时任一失败则都不执行，返回失败操作的序号
+func (h *httpHandler) batch(w http.ResponseWriter, r *http.Request) {
+	var req httpBatchRequest
+	if err := decodeBody(w, r, &req); err != nil {
+		writeError(w, err)
+		return
+	} else if len(req.Ops) == 0 {
+		writeError(w, errors.New("err_bad_request"))
+		return
+	}
+
+	if req.Atomic {
+		h.txn(w, r, req.Ops)
+		return
+	}
+
+	results := make([]httpItem, len(req.Ops))
+	for i, op := range req.Ops {
+		results[i] = h.batchOp(r.Context(), op)
+	}
+	writeJSON(w, http.StatusOK, map[string][]httpItem{"results": results})
+}
+
+func (h *httpHandler) batchOp(ctx context.Context, op httpBatchOp) (item httpItem) {
+	item.Key = op.Key
+	var err error
+	switch op.Op {
+	case "get":
+		var value string
+		value, item.Version, err = h.proxy.Get(ctx, op.Key)
+		if err == nil || err.Error() == "err_stale" {
+			item.Value = &value
+			item.Stale = err != nil
+			err = nil
+		}
+	case "set":
+		if op.Value == nil {
+			err = errors.New("err_bad_request")
+		} else if op.Version > 0 {
+			item.Version, err = h.proxy.SetWithVersion(ctx, op.Key, *op.Value, op.Version)
+		} else {
+			item.Version, err = h.proxy.Set(ctx, op.Key, *op.Value)
+		}
+	case "delete":
+		err = h.proxy.CompareAndDelete(ctx, op.Key, op.Version)
+	default:
+		err = errors.New("err_bad_request")
+	}
+	if err != nil {
+		item.Version = 0
+		_, item.Error = httpStatus(err)
+	}
+	return item
+}
+
+func (h *httpHandler) txn(w http.ResponseWriter, r *http.Request, ops []httpBatchOp) {
+	txnOps := make([]Op, len(ops))
+	for i, op := range ops {
+		txnOps[i] = Op{Key: op.Key, Version: op.Version}
+		switch op.Op {
+		case "set":
+			if op.Value == nil {
+				writeError(w, errors.New("err_bad_request"))
+				return
+			}
+			txnOps[i].Type, txnOps[i].Value = OpSet, *op.Value
+		case "delete":
+			txnOps[i].Type = OpDelete
+		case "check":
+			txnOps[i].Type = OpCheck
+		default:
+			writeError(w, errors.New("err_bad_request"))
+			return
+		}
+	}
+
+	versions, err := h.proxy.Txn(r.Context(), txnOps)
+	if err != nil {
+		status, e := httpStatus(err)
+		body := map[string]any{"error": e}
+		var te *TxnError
+		if errors.As(err, &te) {
+			body["index"] = te.Index
+		}
+		writeJSON(w, status, body)
+		return
+	}
+
+	results := make([]httpItem, len(ops))
+	for i, op := range ops {
+		results[i] = httpItem{Key: op.Key, Version: versions[i]}
+	}
+	writeJSON(w, http.StatusOK, map[string][]httpItem{"results": results})
+}
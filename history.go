@@ -0,0 +1,166 @@
+package rcache
+
+import (
+	"context"
+	dbsql "database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+type HistoryOptions struct {
+	Keep int //每个key保留的版本数，<=0保留全部
+}
+
+type HistoryEntry struct {
+	Version  int
+	Value    string
+	Deleted  bool
+	ExpireAt time.Time //零值表示不过期
+	At       time.Time //写入时间
+}
+
+// 开启历史记录：通过redis写入的每个版本(包括两次同步之间被覆盖的中间版本)在同步时写入kv_history。
+// 需要先创建kv_history表和触发器(见sql.go)，直接写入数据库的版本由触发器记录
+func WithHistory(opt HistoryOptions) Option {
+	return func(p *DataProxy) {
+		p.history = &opt
+	}
+}
+
+// 读取key的指定版本，版本不存在或该版本为删除时返回err_not_exist。
+// 中间版本在下一次SyncDirtyToDB之后才能读到
+func (p *DataProxy) GetVersion(ctx context.Context, key string, version int) (value string, err error) {
+	var ver int
+	value, ver, err = p.Get(ctx, key)
+	if ver == version && (err == nil || err.Error() == "err_stale") {
+		return value, err
+	} else if err != nil && err.Error() != "err_not_exist" && err.Error() != "err_stale" {
+		return "", err
+	}
+
+	rows, err := queryHistoryPgsql(ctx, p.dbc, key, version, 1)
+	if err != nil {
+		return "", err
+	}
+	if len(rows) == 0 || rows[0].deleted {
+		return "", errors.New("err_not_exist")
+	}
+	return p.decodeValue(ctx, key, rows[0].value.String, nil)
+}
+
+// 按版本号降序返回最近limit个历史版本
+func (p *DataProxy) History(ctx context.Context, key string, limit int) (entries []HistoryEntry, err error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	rows, err := queryHistoryPgsql(ctx, p.dbc, key, 0, limit)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range rows {
+		e := HistoryEntry{
+			Version: h.version,
+			Value:   h.value.String,
+			Deleted: h.deleted,
+			At:      time.Unix(h.createdAt, 0),
+		}
+		if h.expireAt > 0 {
+			e.ExpireAt = time.Unix(h.expireAt, 0)
+		}
+		if !h.deleted {
+			if e.Value, err = p.decodeValue(ctx, key, e.Value, nil); err != nil {
+				return nil, err
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// 将redis中记录的版本写入kv_history，集群模式下每个slot有一个list
+func (p *DataProxy) syncHistory(ctx context.Context) error {
+	slots, err := p.slots(ctx, func(ks slotKeys) string { return ks.history })
+	if err != nil {
+		return err
+	}
+	for _, slot := range slots {
+		if err = p.syncHistoryList(ctx, p.slotKeys(slot).history); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 记录写入数据库之后才从list中删除，写入失败或进程退出时留在list中等待下次同步
+func (p *DataProxy) syncHistoryList(ctx context.Context, list string) error {
+	//每个版本占两项，每次读取偶数项保证不会拆开
+	const batch = 200
+	for {
+		cc, cancel := context.WithTimeout(ctx, time.Second)
+		items, err := p.redisC.LRange(cc, list, 0, batch-1).Result()
+		if err = p.checkError(cc, cancel, err); err != nil {
+			return err
+		} else if len(items) == 0 {
+			return nil
+		}
+
+		touched := map[string]bool{}
+		cc, cancel = context.WithTimeout(ctx, time.Second*5)
+		for i := 0; i+1 < len(items); i = i + 2 {
+			h, e := decodeHistory(items[i], items[i+1])
+			if e != nil {
+				//格式错误的记录直接丢弃
+				continue
+			}
+			if err = insertHistoryPgsql(cc, p.dbc, h); err != nil {
+				break
+			}
+			touched[h.key] = true
+		}
+		if p.history.Keep > 0 && err == nil {
+			for key := range touched {
+				if err = pruneHistoryPgsql(cc, p.dbc, key, p.history.Keep); err != nil {
+					break
+				}
+			}
+		}
+		if err = p.checkError(cc, cancel, err); err != nil {
+			//重复写入的记录会被忽略，下次同步整批重新写入
+			return err
+		}
+
+		cc, cancel = context.WithTimeout(ctx, time.Second)
+		err = redisTrimHistory(cc, p.redisC, list, items)
+		if err = p.checkError(cc, cancel, err); err != nil {
+			return err
+		}
+
+		if len(items) < batch {
+			return nil
+		}
+	}
+}
+
+// 元数据格式见luaHistory：[key,version,hasValue,deleted,expireAt,time]
+func decodeHistory(meta string, value string) (h historyRow, err error) {
+	var v []any
+	if err = json.Unmarshal([]byte(meta), &v); err != nil {
+		return h, err
+	}
+	if len(v) < 6 {
+		return h, errors.New("err_invalid_history")
+	}
+	h.key, _ = v[0].(string)
+	version, _ := v[1].(float64)
+	h.version = int(version)
+	if hasValue, _ := v[2].(bool); hasValue {
+		h.value = dbsql.NullString{String: value, Valid: true}
+	}
+	h.deleted, _ = v[3].(bool)
+	expireAt, _ := v[4].(float64)
+	h.expireAt = int64(expireAt)
+	createdAt, _ := v[5].(float64)
+	h.createdAt = int64(createdAt)
+	return h, nil
+}
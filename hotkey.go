@@ -0,0 +1,210 @@
+package rcache
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	redis "github.com/redis/go-redis/v9"
+)
+
+type HotKeyOptions struct {
+	SampleRate int           //每SampleRate次读采样一次，默认10
+	Window     time.Duration //滑动窗口长度，默认10s
+	Buckets    int           //窗口划分的桶数，默认10
+	Threshold  int           //窗口内采样次数达到Threshold判定为热点，默认100
+	TopN       int           //最多保留的热点数，默认32
+	LocalTTL   time.Duration //本地副本免校验的时长，超过后需与redis中的版本号比对，默认500ms
+}
+
+type HotKey struct {
+	Key   string
+	Count int //窗口内的采样次数
+}
+
+type localEntry struct {
+	value     string
+	version   int
+	expireAt  int64 //数据的逻辑过期时间，0表示不过期
+	checkedAt time.Time
+}
+
+type hotKeyDetector struct {
+	opt HotKeyOptions
+
+	reads atomic.Int64
+
+	mu          sync.Mutex
+	buckets     []map[string]int
+	cur         int
+	bucketStart time.Time
+	hot         []HotKey
+
+	localMu sync.RWMutex
+	local   map[string]*localEntry
+}
+
+func newHotKeyDetector(opt HotKeyOptions) *hotKeyDetector {
+	if opt.SampleRate <= 0 {
+		opt.SampleRate = 10
+	}
+	if opt.Window <= 0 {
+		opt.Window = 10 * time.Second
+	}
+	if opt.Buckets <= 0 {
+		opt.Buckets = 10
+	}
+	if opt.Threshold <= 0 {
+		opt.Threshold = 100
+	}
+	if opt.TopN <= 0 {
+		opt.TopN = 32
+	}
+	if opt.LocalTTL <= 0 {
+		opt.LocalTTL = 500 * time.Millisecond
+	}
+
+	d := &hotKeyDetector{
+		opt:         opt,
+		buckets:     make([]map[string]int, opt.Buckets),
+		bucketStart: time.Now(),
+		local:       map[string]*localEntry{},
+	}
+	for i := range d.buckets {
+		d.buckets[i] = map[string]int{}
+	}
+	return d
+}
+
+// 滚动过期的桶，调用方需持有d.mu
+func (d *hotKeyDetector) rotate(now time.Time) {
+	bucketDur := d.opt.Window / time.Duration(d.opt.Buckets)
+	elapsed := now.Sub(d.bucketStart) / bucketDur
+	if elapsed <= 0 {
+		return
+	}
+
+	n := min(int(elapsed), d.opt.Buckets)
+	for i := 0; i < n; i++ {
+		d.cur = (d.cur + 1) % d.opt.Buckets
+		d.buckets[d.cur] = map[string]int{}
+	}
+	//按桶的长度前进，保持桶的边界不变
+	d.bucketStart = d.bucketStart.Add(elapsed * bucketDur)
+
+	//重新计算热点
+	counts := map[string]int{}
+	for _, b := range d.buckets {
+		for k, c := range b {
+			counts[k] += c
+		}
+	}
+
+	hot := []HotKey{}
+	for k, c := range counts {
+		if c >= d.opt.Threshold {
+			hot = append(hot, HotKey{Key: k, Count: c})
+		}
+	}
+	sort.Slice(hot, func(i, j int) bool {
+		return hot[i].Count > hot[j].Count
+	})
+	if len(hot) > d.opt.TopN {
+		hot = hot[:d.opt.TopN]
+	}
+	d.hot = hot
+
+	//不再是热点的key丢弃本地副本
+	d.localMu.Lock()
+	for k := range d.local {
+		if !d.isHotLocked(k) {
+			delete(d.local, k)
+		}
+	}
+	d.localMu.Unlock()
+}
+
+func (d *hotKeyDetector) isHotLocked(key string) bool {
+	for _, h := range d.hot {
+		if h.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// 采样一次读，返回key当前是否为热点
+func (d *hotKeyDetector) sample(key string) bool {
+	sampled := d.reads.Add(1)%int64(d.opt.SampleRate) == 0
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.rotate(time.Now())
+	if sampled {
+		d.buckets[d.cur][key]++
+	}
+	return d.isHotLocked(key)
+}
+
+func (d *hotKeyDetector) hotKeys() []HotKey {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.rotate(time.Now())
+	return append([]HotKey{}, d.hot...)
+}
+
+func (d *hotKeyDetector) store(key string, value string, version int, expireAt int64) {
+	d.localMu.Lock()
+	d.local[key] = &localEntry{value: value, version: version, expireAt: expireAt, checkedAt: time.Now()}
+	d.localMu.Unlock()
+}
+
+func (d *hotKeyDetector) invalidate(key string) {
+	d.localMu.Lock()
+	delete(d.local, key)
+	d.localMu.Unlock()
+}
+
+// 从本地副本读取，超过LocalTTL的副本需要与redis中的版本号一致才能继续使用
+func (d *hotKeyDetector) get(ctx context.Context, c redis.UniversalClient, key string) (value string, version int, ok bool) {
+	d.localMu.RLock()
+	e := d.local[key]
+	var checkedAt time.Time
+	var expireAt int64
+	if e != nil {
+		value, version, expireAt, checkedAt = e.value, e.version, e.expireAt, e.checkedAt
+	}
+	d.localMu.RUnlock()
+
+	if e == nil {
+		return value, version, false
+	}
+
+	if expireAt > 0 && expireAt <= time.Now().Unix() {
+		d.invalidate(key)
+		return value, version, false
+	}
+
+	if time.Since(checkedAt) > d.opt.LocalTTL {
+		if v, err := c.HGet(ctx, key, "version").Int(); err != nil || v != version {
+			d.invalidate(key)
+			return value, version, false
+		}
+		d.localMu.Lock()
+		e.checkedAt = time.Now()
+		d.localMu.Unlock()
+	}
+
+	d.sample(key)
+	return value, version, true
+}
+
+// 返回当前滑动窗口内的热点key，按采样次数降序排列，未开启热点探测时返回nil
+func (p *DataProxy) HotKeys() []HotKey {
+	if p.hotkey == nil {
+		return nil
+	}
+	return p.hotkey.hotKeys()
+}
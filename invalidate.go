@@ -0,0 +1,129 @@
+package rcache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// 数据库中被外部修改的key在redis中还有未写回的数据
+type Conflict struct {
+	Key          string
+	DBVersion    int    //外部修改后的版本号，删除时为删除前的版本号
+	CacheVersion int    //redis中未写回的版本号
+	Op           string //insert、update或delete
+}
+
+type InvalidationOptions struct {
+	DSN          string        //监听使用单独的连接，必须设置
+	Channel      string        //默认rcache_kv，与kv_notify触发器一致
+	MinReconnect time.Duration //默认1s
+	MaxReconnect time.Duration //默认1min
+	//发生冲突的key记录为dead letter，不再自动写回，避免覆盖外部的修改。
+	//由rcache-admin deadletter retry(保留redis中的数据)或discard(保留外部的修改)处理
+	OnConflict func(Conflict)
+	//断开后重新连接时调用，断开期间的修改没有收到通知，可以用Verify核对
+	OnReconnect func()
+	OnError     func(error)
+}
+
+type kvNotification struct {
+	Key     string `json:"key"`
+	Version int    `json:"version"`
+	Op      string `json:"op"`
+}
+
+// 监听kv_notify触发器发送的外部修改(见sql.go中的表定义)，直到ctx结束。
+// 外部修改后数据库中的数据是准确的，干净的缓存直接删除，下次读取时重新加载
+func (p *DataProxy) ListenInvalidations(ctx context.Context, opt InvalidationOptions) error {
+	if opt.DSN == "" {
+		return fmt.Errorf("rcache: InvalidationOptions.DSN is required")
+	}
+	if opt.Channel == "" {
+		opt.Channel = "rcache_kv"
+	}
+	if opt.MinReconnect <= 0 {
+		opt.MinReconnect = time.Second
+	}
+	if opt.MaxReconnect <= 0 {
+		opt.MaxReconnect = time.Minute
+	}
+
+	listener := pq.NewListener(opt.DSN, opt.MinReconnect, opt.MaxReconnect, func(ev pq.ListenerEventType, err error) {
+		if err != nil && opt.OnError != nil {
+			opt.OnError(err)
+		}
+	})
+	defer listener.Close()
+	if err := listener.Listen(opt.Channel); err != nil {
+		return err
+	}
+
+	//长时间没有通知时探测连接
+	ticker := time.NewTicker(time.Second * 90)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case n := <-listener.Notify:
+			if n == nil {
+				if opt.OnReconnect != nil {
+					opt.OnReconnect()
+				}
+				continue
+			}
+			var msg kvNotification
+			err := json.Unmarshal([]byte(n.Extra), &msg)
+			if err == nil {
+				err = p.invalidate(ctx, msg, opt)
+			}
+			if err != nil && opt.OnError != nil {
+				opt.OnError(err)
+			}
+		case <-ticker.C:
+			go listener.Ping()
+		}
+	}
+}
+
+func (p *DataProxy) invalidate(ctx context.Context, msg kvNotification, opt InvalidationOptions) error {
+	if p.hotkey != nil {
+		p.hotkey.invalidate(msg.Key)
+	}
+	//读取之后可能有新的写入，删除失败时重新读取
+	for i := 0; i < 3; i++ {
+		cc, cancel := context.WithTimeout(ctx, time.Second)
+		cached, err := redisPeekPipeline(cc, p.redisC, []string{msg.Key})
+		if err = p.checkError(cc, cancel, err); err != nil {
+			return err
+		}
+		c, ok := cached[msg.Key]
+		if !ok {
+			return nil
+		}
+
+		if c.dirty || c.blind {
+			cause := fmt.Errorf("err_external_edit: %s at db version %d", msg.Op, msg.Version)
+			if err = p.addDeadLetter(ctx, msg.Key, c.version, cause); err != nil {
+				return err
+			}
+			if opt.OnConflict != nil {
+				opt.OnConflict(Conflict{Key: msg.Key, DBVersion: msg.Version, CacheVersion: c.version, Op: msg.Op})
+			}
+			return nil
+		}
+
+		cc, cancel = context.WithTimeout(ctx, time.Second)
+		_, err = redisEvict(cc, p.redisC, msg.Key, c.version)
+		if err = p.checkError(cc, cancel, err); err == nil {
+			return nil
+		} else if e := err.Error(); e != "err_dirty" && e != "err_version_not_match" {
+			return err
+		}
+	}
+	return fmt.Errorf("rcache: %s changed repeatedly while invalidating", msg.Key)
+}
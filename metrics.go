@@ -0,0 +1,295 @@
+package rcache
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DataProxy在各个决策点调用Metrics，实现需要是并发安全的。
+// err为nil、数据不存在以及业务错误(err_xxx)时不是后端失败，参见backendFailure
+type Metrics interface {
+	Hit(key string)         //redis或本地副本命中
+	Miss(key string)        //不在redis中
+	NegativeHit(key string) //命中redis中缓存的不存在
+	DBLoad(key string, d time.Duration, err error)
+	DBUpsert(key string, d time.Duration, err error)
+	VersionMismatch(key string)
+	Writeback(key string, d time.Duration, err error)
+	ClearDirtyFailed(key string, err error)
+	//一次SyncDirtyToDB结束，backlog为结束时仍未写回的key数量，查询失败时为-1
+	Sync(d time.Duration, backlog int, err error)
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) Hit(string)                             {}
+func (nopMetrics) Miss(string)                            {}
+func (nopMetrics) NegativeHit(string)                     {}
+func (nopMetrics) DBLoad(string, time.Duration, error)    {}
+func (nopMetrics) DBUpsert(string, time.Duration, error)  {}
+func (nopMetrics) VersionMismatch(string)                 {}
+func (nopMetrics) Writeback(string, time.Duration, error) {}
+func (nopMetrics) ClearDirtyFailed(string, error)         {}
+func (nopMetrics) Sync(time.Duration, int, error)         {}
+
+// 设置指标收集，默认不收集
+func WithMetrics(m Metrics) Option {
+	return func(p *DataProxy) {
+		if m != nil {
+			p.metrics = m
+		}
+	}
+}
+
+// 版本号不一致时记录，返回err
+func (p *DataProxy) versionChecked(key string, err error) error {
+	if err != nil && err.Error() == "err_version_not_match" {
+		p.metrics.VersionMismatch(key)
+	}
+	return err
+}
+
+func (p *DataProxy) syncDone(start time.Time, err error) {
+	n, e := p.DirtyCount(context.Background())
+	if e != nil {
+		n = -1
+	}
+	p.metrics.Sync(time.Since(start), int(n), err)
+}
+
+var defaultBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+type histogram struct {
+	counts []uint64 //与buckets对应，不累加
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(buckets []float64, v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(buckets))
+	}
+	for i, b := range buckets {
+		if v <= b {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+type nsCounters struct {
+	hits, misses, negativeHits uint64
+	versionMismatches          uint64
+	clearDirtyFailures         uint64
+	loadErrors                 uint64
+	upsertErrors               uint64
+	writebackErrors            uint64
+	load, upsert, writeback    histogram
+}
+
+// Metrics的默认实现，ServeHTTP按Prometheus文本格式输出，
+// 除rcache_sync_*和rcache_dirty_keys外都带有namespace标签(key中第一个':'之前的部分)
+type PrometheusMetrics struct {
+	buckets []float64
+
+	mu         sync.Mutex
+	namespaces map[string]*nsCounters
+	sync       histogram
+	syncErrors uint64
+	backlog    int
+}
+
+// buckets为耗时直方图的上界(秒)，为空时使用默认值
+func NewPrometheusMetrics(buckets ...float64) *PrometheusMetrics {
+	if len(buckets) == 0 {
+		buckets = defaultBuckets
+	} else {
+		buckets = append([]float64(nil), buckets...)
+		sort.Float64s(buckets)
+	}
+	return &PrometheusMetrics{buckets: buckets, namespaces: map[string]*nsCounters{}}
+}
+
+func (m *PrometheusMetrics) ns(key string) *nsCounters {
+	name := namespaceOf(key)
+	c, ok := m.namespaces[name]
+	if !ok {
+		c = &nsCounters{}
+		m.namespaces[name] = c
+	}
+	return c
+}
+
+func (m *PrometheusMetrics) Hit(key string) {
+	m.mu.Lock()
+	m.ns(key).hits++
+	m.mu.Unlock()
+}
+
+func (m *PrometheusMetrics) Miss(key string) {
+	m.mu.Lock()
+	m.ns(key).misses++
+	m.mu.Unlock()
+}
+
+func (m *PrometheusMetrics) NegativeHit(key string) {
+	m.mu.Lock()
+	m.ns(key).negativeHits++
+	m.mu.Unlock()
+}
+
+func (m *PrometheusMetrics) DBLoad(key string, d time.Duration, err error) {
+	m.mu.Lock()
+	c := m.ns(key)
+	c.load.observe(m.buckets, d.Seconds())
+	if backendFailure(err) {
+		c.loadErrors++
+	}
+	m.mu.Unlock()
+}
+
+func (m *PrometheusMetrics) DBUpsert(key string, d time.Duration, err error) {
+	m.mu.Lock()
+	c := m.ns(key)
+	c.upsert.observe(m.buckets, d.Seconds())
+	if backendFailure(err) {
+		c.upsertErrors++
+	}
+	m.mu.Unlock()
+}
+
+func (m *PrometheusMetrics) VersionMismatch(key string) {
+	m.mu.Lock()
+	m.ns(key).versionMismatches++
+	m.mu.Unlock()
+}
+
+func (m *PrometheusMetrics) Writeback(key string, d time.Duration, err error) {
+	m.mu.Lock()
+	c := m.ns(key)
+	c.writeback.observe(m.buckets, d.Seconds())
+	if err != nil {
+		c.writebackErrors++
+	}
+	m.mu.Unlock()
+}
+
+func (m *PrometheusMetrics) ClearDirtyFailed(key string, err error) {
+	m.mu.Lock()
+	m.ns(key).clearDirtyFailures++
+	m.mu.Unlock()
+}
+
+func (m *PrometheusMetrics) Sync(d time.Duration, backlog int, err error) {
+	m.mu.Lock()
+	m.sync.observe(m.buckets, d.Seconds())
+	if err != nil {
+		m.syncErrors++
+	}
+	if backlog >= 0 {
+		m.backlog = backlog
+	}
+	m.mu.Unlock()
+}
+
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	m.writeTo(bw)
+	bw.Flush()
+}
+
+func (m *PrometheusMetrics) writeTo(w *bufio.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.namespaces))
+	for name := range m.namespaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	header := func(name, typ, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+	counter := func(name, help string, get func(c *nsCounters) uint64) {
+		header(name, "counter", help)
+		for _, ns := range names {
+			fmt.Fprintf(w, "%s{namespace=\"%s\"} %d\n", name, escapeLabel(ns), get(m.namespaces[ns]))
+		}
+	}
+
+	header("rcache_cache_requests_total", "counter", "Cache lookups by result.")
+	for _, ns := range names {
+		c := m.namespaces[ns]
+		l := escapeLabel(ns)
+		fmt.Fprintf(w, "rcache_cache_requests_total{namespace=\"%s\",result=\"hit\"} %d\n", l, c.hits)
+		fmt.Fprintf(w, "rcache_cache_requests_total{namespace=\"%s\",result=\"miss\"} %d\n", l, c.misses)
+		fmt.Fprintf(w, "rcache_cache_requests_total{namespace=\"%s\",result=\"negative_hit\"} %d\n", l, c.negativeHits)
+	}
+
+	header("rcache_db_errors_total", "counter", "Failed database operations by operation.")
+	for _, ns := range names {
+		c := m.namespaces[ns]
+		l := escapeLabel(ns)
+		fmt.Fprintf(w, "rcache_db_errors_total{namespace=\"%s\",op=\"load\"} %d\n", l, c.loadErrors)
+		fmt.Fprintf(w, "rcache_db_errors_total{namespace=\"%s\",op=\"upsert\"} %d\n", l, c.upsertErrors)
+		fmt.Fprintf(w, "rcache_db_errors_total{namespace=\"%s\",op=\"writeback\"} %d\n", l, c.writebackErrors)
+	}
+
+	counter("rcache_version_mismatch_total", "Writes rejected because of a version mismatch.", func(c *nsCounters) uint64 { return c.versionMismatches })
+	counter("rcache_clear_dirty_failures_total", "Written back keys whose dirty flag could not be cleared.", func(c *nsCounters) uint64 { return c.clearDirtyFailures })
+
+	histograms := []struct {
+		name, help string
+		get        func(c *nsCounters) *histogram
+	}{
+		{"rcache_db_load_seconds", "Latency of loading missed keys from the database.", func(c *nsCounters) *histogram { return &c.load }},
+		{"rcache_db_upsert_seconds", "Latency of writing keys not in redis to the database.", func(c *nsCounters) *histogram { return &c.upsert }},
+		{"rcache_writeback_seconds", "Latency of writing dirty keys back to the database.", func(c *nsCounters) *histogram { return &c.writeback }},
+	}
+	for _, h := range histograms {
+		header(h.name, "histogram", h.help)
+		for _, ns := range names {
+			m.writeHistogram(w, h.name, "namespace=\""+escapeLabel(ns)+"\",", h.get(m.namespaces[ns]))
+		}
+	}
+
+	header("rcache_sync_seconds", "histogram", "Duration of SyncDirtyToDB passes.")
+	m.writeHistogram(w, "rcache_sync_seconds", "", &m.sync)
+	header("rcache_sync_errors_total", "counter", "SyncDirtyToDB passes that returned an error.")
+	fmt.Fprintf(w, "rcache_sync_errors_total %d\n", m.syncErrors)
+	header("rcache_dirty_keys", "gauge", "Dirty keys left after the last SyncDirtyToDB pass.")
+	fmt.Fprintf(w, "rcache_dirty_keys %d\n", m.backlog)
+}
+
+// labels为空或以','结尾
+func (m *PrometheusMetrics) writeHistogram(w *bufio.Writer, name string, labels string, h *histogram) {
+	var n uint64
+	for i, b := range m.buckets {
+		if h.counts != nil {
+			n += h.counts[i]
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", name, labels, strconv.FormatFloat(b, 'g', -1, 64), n)
+	}
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, labels, h.count)
+	labels = strings.TrimSuffix(labels, ",")
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
@@ -0,0 +1,111 @@
+package rcache
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type PreloadOptions struct {
+	Prefix string //按key前缀加载
+	Where  string //任意where条件(不含where关键字)，参数占位符从$1开始
+	Args   []any  //Where使用的参数
+	Keys   []string
+
+	BatchSize    int //每批读取的行数，默认500
+	Rate         int //每秒最多加载的行数，<=0不限速
+	StartAfter   string
+	CacheTimeout int
+	Progress     func(PreloadProgress)
+}
+
+type PreloadProgress struct {
+	Loaded  int
+	LastKey string //续传时作为StartAfter传入
+}
+
+// 从pgsql按key顺序流式读取数据并加载到redis，用于redis故障转移或清空后的预热。
+// 已缓存且版本更新(包括dirty)的数据不会被覆盖。返回的LastKey可用于中断后续传。
+func (p *DataProxy) Preload(ctx context.Context, opt PreloadOptions) (progress PreloadProgress, err error) {
+	batchSize := opt.BatchSize
+	if batchSize <= 0 {
+		batchSize = 500
+	}
+	if opt.Rate > 0 && opt.Rate < batchSize {
+		batchSize = opt.Rate
+	}
+
+	cacheTime := func(key string) int {
+		if opt.CacheTimeout > 0 {
+			return opt.CacheTimeout
+		}
+		return p.cacheTime(key, nil)
+	}
+
+	var conds []string
+	args := append([]any{}, opt.Args...)
+	if opt.Where != "" {
+		conds = append(conds, opt.Where)
+	}
+	if opt.Prefix != "" {
+		args = append(args, likePrefix(opt.Prefix))
+		conds = append(conds, fmt.Sprintf(`key like $%d escape '\'`, len(args)))
+	}
+	if len(opt.Keys) > 0 {
+		keys := append([]string{}, opt.Keys...)
+		sort.Strings(keys)
+		args = append(args, pq.Array(keys))
+		conds = append(conds, fmt.Sprintf("key = any($%d)", len(args)))
+	}
+
+	var cond string
+	for i, c := range conds {
+		if i > 0 {
+			cond += " and "
+		}
+		cond += "(" + c + ")"
+	}
+
+	progress.LastKey = opt.StartAfter
+	beg := time.Now()
+
+	for {
+		var rows []row
+		if rows, err = queryRowsAfter(ctx, p.dbc, cond, args, progress.LastKey, batchSize); err != nil {
+			return progress, err
+		}
+
+		if len(rows) == 0 {
+			return progress, nil
+		}
+
+		if err = redisLoadSetPipeline(ctx, p.redisC, rows, cacheTime, p.staleGrace); err != nil {
+			return progress, err
+		}
+
+		progress.Loaded += len(rows)
+		progress.LastKey = rows[len(rows)-1].key
+		if opt.Progress != nil {
+			opt.Progress(progress)
+		}
+
+		if len(rows) < batchSize {
+			return progress, nil
+		}
+
+		if opt.Rate > 0 {
+			//按已加载的行数计算应耗时间，超前则等待
+			wait := time.Duration(progress.Loaded)*time.Second/time.Duration(opt.Rate) - time.Since(beg)
+			if wait > 0 {
+				select {
+				case <-ctx.Done():
+					return progress, ctx.Err()
+				case <-time.After(wait):
+				}
+			}
+		}
+	}
+}
@@ -4,16 +4,28 @@ package rcache
 //go tool cover -html=coverage.out
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	dbsql "database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
 	"time"
 
-	//"sync"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	//"time"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	redis "github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/assert"
 )
@@ -163,7 +175,7 @@ func TestPGUpdate(t *testing.T) {
 
 	defer dbc.Close()
 
-	version, err := insertUpdateRowPgsql(context.TODO(), dbc, "hello", "world")
+	version, err := insertUpdateRowPgsql(context.TODO(), dbc, "hello", "world", 0)
 
 	fmt.Println(version, err)
 }
@@ -345,3 +357,1489 @@ func TestRCache(t *testing.T) {
 	_, err = cli.HGet(context.TODO(), "testkey", "version").Result()
 	assert.Equal(t, err.Error(), "redis: nil")
 }
+
+func TestPreload(t *testing.T) {
+	dbc, _ := sqlx.Open("postgres", "host=localhost port=5432 dbname=test user=postgres password=802802 sslmode=disable")
+
+	cli := initRedis()
+
+	dbc.ExecContext(context.TODO(), "delete from kv;")
+	cli.FlushAll(context.TODO()).Result()
+
+	defer dbc.Close()
+
+	proxy := NewDataProxy(cli, dbc)
+
+	for i := 0; i < 100; i++ {
+		str := fmt.Sprintf("preload:%03d", i)
+		insertUpdateRowPgsql(context.TODO(), dbc, str, str, 0)
+	}
+
+	//redis中已有更新的版本，不应被覆盖
+	RedisLoadSet(context.TODO(), cli, "preload:000", 5, "newer")
+
+	progress, err := proxy.Preload(context.TODO(), PreloadOptions{
+		Prefix:    "preload:",
+		BatchSize: 30,
+		Rate:      1000,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 100, progress.Loaded)
+	assert.Equal(t, "preload:099", progress.LastKey)
+
+	value, ver, _ := RedisGet(context.TODO(), cli, "preload:000")
+	assert.Equal(t, "newer", value)
+	assert.Equal(t, 5, ver)
+
+	value, _, _ = RedisGet(context.TODO(), cli, "preload:050")
+	assert.Equal(t, "preload:050", value)
+
+	//续传
+	cli.FlushAll(context.TODO()).Result()
+	progress, err = proxy.Preload(context.TODO(), PreloadOptions{
+		Prefix:     "preload:",
+		StartAfter: "preload:089",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 10, progress.Loaded)
+}
+
+func TestHotKey(t *testing.T) {
+	d := newHotKeyDetector(HotKeyOptions{
+		SampleRate: 1,
+		Window:     time.Second,
+		Buckets:    10,
+		Threshold:  5,
+	})
+
+	for i := 0; i < 10; i++ {
+		d.sample("config")
+	}
+	d.sample("cold")
+
+	//窗口滚动后才重新计算热点
+	time.Sleep(time.Millisecond * 150)
+	hot := d.hotKeys()
+	assert.Equal(t, 1, len(hot))
+	assert.Equal(t, "config", hot[0].Key)
+	assert.Equal(t, 10, hot[0].Count)
+	assert.True(t, d.sample("config"))
+	assert.False(t, d.sample("cold"))
+
+	//移出窗口后不再是热点
+	time.Sleep(time.Second * 2)
+	assert.Equal(t, 0, len(d.hotKeys()))
+
+	//桶的边界不随采样的时间漂移
+	d.mu.Lock()
+	start := d.bucketStart
+	d.rotate(start.Add(time.Millisecond * 150))
+	assert.Equal(t, start.Add(time.Millisecond*100), d.bucketStart)
+	d.rotate(start.Add(time.Millisecond * 250))
+	assert.Equal(t, start.Add(time.Millisecond*200), d.bucketStart)
+	d.mu.Unlock()
+}
+
+func TestBreaker(t *testing.T) {
+	b := newBreaker(BreakerOptions{Failures: 2, OpenTimeout: time.Millisecond * 100})
+
+	dbErr := fmt.Errorf("dial tcp: connection refused")
+
+	assert.True(t, b.allow())
+	b.done(dbErr)
+	assert.False(t, b.isOpen())
+
+	//业务错误不计入
+	b.done(fmt.Errorf("err_version_not_match"))
+	b.done(dbErr)
+	assert.False(t, b.isOpen())
+	b.done(dbErr)
+	assert.True(t, b.isOpen())
+	assert.False(t, b.allow())
+
+	//超时后放行一次探测
+	time.Sleep(time.Millisecond * 150)
+	assert.True(t, b.allow())
+	assert.False(t, b.allow())
+	b.done(dbErr)
+	assert.False(t, b.allow())
+
+	time.Sleep(time.Millisecond * 150)
+	assert.True(t, b.allow())
+	b.done(nil)
+	assert.False(t, b.isOpen())
+	assert.True(t, b.allow())
+
+	//设置probe时半开期间不放行请求，只有probe能恢复
+	b = newBreaker(BreakerOptions{Failures: 1, OpenTimeout: time.Millisecond * 100})
+	probed := make(chan struct{})
+	b.probe = func() error {
+		<-probed
+		return nil
+	}
+	b.done(dbErr)
+	assert.True(t, b.rejecting())
+	time.Sleep(time.Millisecond * 150)
+	assert.False(t, b.allow())
+	assert.False(t, b.rejecting())
+	b.done(nil)
+	assert.True(t, b.isOpen())
+	close(probed)
+	assert.Eventually(t, func() bool { return !b.isOpen() }, time.Second, time.Millisecond*10)
+	assert.True(t, b.allow())
+}
+
+func TestRedisFallback(t *testing.T) {
+	dbc, _ := sqlx.Open("postgres", "host=localhost port=5432 dbname=test user=postgres password=802802 sslmode=disable")
+
+	dbc.ExecContext(context.TODO(), "delete from kv;")
+
+	defer dbc.Close()
+
+	InitScript()
+
+	//不可达的redis
+	cli := redis.NewClient(&redis.Options{
+		Addr:       "localhost:6390",
+		MaxRetries: -1,
+	})
+
+	proxy := NewDataProxy(cli, dbc, WithRedisFallback(BreakerOptions{Failures: 1, OpenTimeout: time.Minute}))
+
+	_, err := proxy.Set(context.TODO(), "hello", "world")
+	assert.NotNil(t, err)
+	assert.True(t, proxy.RedisUnavailable())
+
+	//熔断后直接写入数据库
+	ver, err := proxy.Set(context.TODO(), "hello", "world")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, ver)
+
+	_, err = proxy.SetWithVersion(context.TODO(), "hello", "world2", 5)
+	assert.Equal(t, "err_version_not_match", err.Error())
+
+	ver, err = proxy.SetWithVersion(context.TODO(), "hello", "world2", ver)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, ver)
+
+	value, ver, err := proxy.Get(context.TODO(), "hello")
+	assert.Nil(t, err)
+	assert.Equal(t, "world2", value)
+	assert.Equal(t, 2, ver)
+}
+
+func TestIncrBy(t *testing.T) {
+	dbc, _ := sqlx.Open("postgres", "host=localhost port=5432 dbname=test user=postgres password=802802 sslmode=disable")
+
+	cli := initRedis()
+
+	dbc.ExecContext(context.TODO(), "delete from kv;")
+	cli.FlushAll(context.TODO()).Result()
+
+	defer dbc.Close()
+
+	proxy := NewDataProxy(cli, dbc)
+
+	//不存在的key从0开始
+	value, ver, err := proxy.IncrBy(context.TODO(), "counter", 5)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), value)
+	assert.Equal(t, 1, ver)
+
+	value, ver, err = proxy.DecrBy(context.TODO(), "counter", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), value)
+	assert.Equal(t, 2, ver)
+
+	_, _, err = proxy.IncrByWithBounds(context.TODO(), "counter", -4, NonNegative)
+	assert.Equal(t, "err_out_of_range", err.Error())
+
+	proxy.SyncDirtyToDB(context.TODO())
+	cli.FlushAll(context.TODO()).Result()
+
+	//从数据库加载后计数
+	value, ver, err = proxy.Incr(context.TODO(), "counter")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), value)
+	assert.Equal(t, 3, ver)
+
+	proxy.Set(context.TODO(), "counter", "abc")
+	_, _, err = proxy.Incr(context.TODO(), "counter")
+	assert.Equal(t, "err_not_integer", err.Error())
+
+	//与strconv.ParseInt一致，小数和科学计数法不是整数
+	for _, v := range []string{"1.0", "1e3", " 1"} {
+		proxy.Set(context.TODO(), "counter", v)
+		_, _, err = proxy.Incr(context.TODO(), "counter")
+		assert.Equal(t, "err_not_integer", err.Error())
+	}
+
+	//超过2^53-1不能精确计算
+	proxy.Set(context.TODO(), "counter", "9007199254740990")
+	value, _, err = proxy.Incr(context.TODO(), "counter")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(maxCounter), value)
+	_, _, err = proxy.Incr(context.TODO(), "counter")
+	assert.Equal(t, "err_out_of_range", err.Error())
+	_, _, err = proxy.DecrBy(context.TODO(), "counter", math.MinInt64)
+	assert.Equal(t, "err_out_of_range", err.Error())
+	_, _, err = proxy.IncrBy(context.TODO(), "other", maxCounter+1)
+	assert.Equal(t, "err_out_of_range", err.Error())
+}
+
+func TestRetryBackoff(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: time.Millisecond * 10, MaxDelay: time.Millisecond * 50}.normalize()
+	assert.Equal(t, 10, policy.MaxAttempts)
+
+	for attempt := 1; attempt < 10; attempt++ {
+		d := policy.backoff(attempt)
+		max := time.Millisecond * 10 << (attempt - 1)
+		if max > time.Millisecond*50 {
+			max = time.Millisecond * 50
+		}
+		assert.True(t, d <= max && d >= max/2, d)
+	}
+
+	policy.Jitter = 0
+	assert.Equal(t, time.Millisecond*40, policy.backoff(3))
+}
+
+func TestUpdate(t *testing.T) {
+	dbc, _ := sqlx.Open("postgres", "host=localhost port=5432 dbname=test user=postgres password=802802 sslmode=disable")
+
+	cli := initRedis()
+
+	dbc.ExecContext(context.TODO(), "delete from kv;")
+	cli.FlushAll(context.TODO()).Result()
+
+	defer dbc.Close()
+
+	proxy := NewDataProxy(cli, dbc, WithRetryPolicy(RetryPolicy{MaxAttempts: 100}))
+
+	var wait sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			_, err := proxy.Update(context.TODO(), "update", func(old string, exists bool) (string, error) {
+				n := 0
+				if exists {
+					n, _ = strconv.Atoi(old)
+				}
+				return strconv.Itoa(n + 1), nil
+			})
+			assert.Nil(t, err)
+		}()
+	}
+	wait.Wait()
+
+	value, ver, _ := proxy.Get(context.TODO(), "update")
+	assert.Equal(t, "10", value)
+	assert.Equal(t, 10, ver)
+
+	//缓存未命中时走数据库的版本号校验
+	proxy.SyncDirtyToDB(context.TODO())
+	cli.FlushAll(context.TODO()).Result()
+
+	ver, err := proxy.Update(context.TODO(), "update", func(old string, exists bool) (string, error) {
+		return old + "0", nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 11, ver)
+}
+
+func TestConditional(t *testing.T) {
+	dbc, _ := sqlx.Open("postgres", "host=localhost port=5432 dbname=test user=postgres password=802802 sslmode=disable")
+
+	cli := initRedis()
+
+	dbc.ExecContext(context.TODO(), "delete from kv;")
+	cli.FlushAll(context.TODO()).Result()
+
+	defer dbc.Close()
+
+	proxy := NewDataProxy(cli, dbc)
+
+	_, err := proxy.SetIfExists(context.TODO(), "name", "a")
+	assert.Equal(t, "err_not_exist", err.Error())
+
+	ver, err := proxy.SetNX(context.TODO(), "name", "a")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, ver)
+
+	_, err = proxy.SetNX(context.TODO(), "name", "b")
+	assert.Equal(t, "err_exist", err.Error())
+
+	ver, err = proxy.SetIfExists(context.TODO(), "name", "b")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, ver)
+
+	err = proxy.CompareAndDelete(context.TODO(), "name", 1)
+	assert.Equal(t, "err_version_not_match", err.Error())
+
+	err = proxy.CompareAndDelete(context.TODO(), "name", 2)
+	assert.Nil(t, err)
+
+	_, _, err = proxy.Get(context.TODO(), "name")
+	assert.Equal(t, "err_not_exist", err.Error())
+
+	//删除前和墓碑的版本号都不能再用于CAS
+	_, err = proxy.SetWithVersion(context.TODO(), "name", "x", 2)
+	assert.Equal(t, "err_version_not_match", err.Error())
+	_, err = proxy.SetWithVersion(context.TODO(), "name", "x", 3)
+	assert.Equal(t, "err_version_not_match", err.Error())
+
+	//墓碑同步后数据库中保留版本号
+	proxy.SyncDirtyToDB(context.TODO())
+	version, _, expireAt, err := queryRow(context.TODO(), dbc, "name")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, version)
+	assert.True(t, expired(expireAt))
+
+	//删除后可以再次创建，版本号继续递增
+	ver, err = proxy.SetNX(context.TODO(), "name", "c")
+	assert.Nil(t, err)
+	assert.Equal(t, 4, ver)
+
+	//缓存未命中时在数据库中执行
+	proxy.SyncDirtyToDB(context.TODO())
+	cli.FlushAll(context.TODO()).Result()
+
+	_, err = proxy.SetNX(context.TODO(), "name", "d")
+	assert.Equal(t, "err_exist", err.Error())
+
+	cli.FlushAll(context.TODO()).Result()
+	err = proxy.CompareAndDelete(context.TODO(), "name", 1)
+	assert.Equal(t, "err_version_not_match", err.Error())
+
+	err = proxy.Delete(context.TODO(), "name")
+	assert.Nil(t, err)
+
+	err = proxy.Delete(context.TODO(), "name")
+	assert.Equal(t, "err_not_exist", err.Error())
+
+	//数据库中的墓碑同样拒绝旧版本号，重新创建后版本号继续递增
+	cli.FlushAll(context.TODO()).Result()
+	_, err = proxy.SetWithVersion(context.TODO(), "name", "x", 5)
+	assert.Equal(t, "err_version_not_match", err.Error())
+	cli.FlushAll(context.TODO()).Result()
+	ver, err = proxy.SetNX(context.TODO(), "name", "e")
+	assert.Nil(t, err)
+	assert.Equal(t, 6, ver)
+}
+
+func TestTxn(t *testing.T) {
+	dbc, _ := sqlx.Open("postgres", "host=localhost port=5432 dbname=test user=postgres password=802802 sslmode=disable")
+
+	cli := initRedis()
+
+	dbc.ExecContext(context.TODO(), "delete from kv;")
+	cli.FlushAll(context.TODO()).Result()
+
+	defer dbc.Close()
+
+	proxy := NewDataProxy(cli, dbc)
+
+	va, _ := proxy.Set(context.TODO(), "balance:a", "100")
+	vb, _ := proxy.Set(context.TODO(), "balance:b", "0")
+	proxy.SyncDirtyToDB(context.TODO())
+	cli.FlushAll(context.TODO()).Result()
+
+	//版本号不一致，都不写入
+	_, err := proxy.Txn(context.TODO(), []Op{
+		{Key: "balance:a", Value: "50", Version: va},
+		{Key: "balance:b", Value: "50", Version: vb + 1},
+	})
+	assert.Equal(t, "err_version_not_match", err.Error())
+	assert.Equal(t, 1, err.(*TxnError).Index)
+
+	value, _, _ := proxy.Get(context.TODO(), "balance:a")
+	assert.Equal(t, "100", value)
+
+	versions, err := proxy.Txn(context.TODO(), []Op{
+		{Key: "balance:a", Value: "50", Version: va},
+		{Key: "balance:b", Value: "50", Version: vb},
+		{Type: OpCheck, Key: "order:1"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []int{va + 1, vb + 1, 0}, versions)
+
+	//同一组的dirty标记关联在一起
+	gid, _ := cli.HGet(context.TODO(), dirtyGroupKey, "balance:a").Result()
+	gid2, _ := cli.HGet(context.TODO(), dirtyGroupKey, "balance:b").Result()
+	assert.Equal(t, gid, gid2)
+
+	assert.Nil(t, proxy.SyncDirtyToDB(context.TODO()))
+
+	_, value, _, _ = queryRow(context.TODO(), dbc, "balance:b")
+	assert.Equal(t, "50", value)
+
+	n, _ := cli.HLen(context.TODO(), groupsKey).Result()
+	assert.Equal(t, int64(0), n)
+
+	//HSCAN读取组信息之后才加入事务组的key，单独写回时也要整组写回
+	_, err = proxy.Txn(context.TODO(), []Op{
+		{Key: "balance:a", Value: "30"},
+		{Key: "balance:b", Value: "70"},
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, proxy.syncKey(context.TODO(), "balance:a"))
+	_, value, _, _ = queryRow(context.TODO(), dbc, "balance:b")
+	assert.Equal(t, "70", value)
+	n, _ = cli.HLen(context.TODO(), dirtyKey).Result()
+	assert.Equal(t, int64(0), n)
+}
+
+func TestExpiry(t *testing.T) {
+	dbc, _ := sqlx.Open("postgres", "host=localhost port=5432 dbname=test user=postgres password=802802 sslmode=disable")
+
+	cli := initRedis()
+
+	dbc.ExecContext(context.TODO(), "delete from kv;")
+	cli.FlushAll(context.TODO()).Result()
+
+	defer dbc.Close()
+
+	proxy := NewDataProxy(cli, dbc)
+
+	_, err := proxy.SetWithExpiry(context.TODO(), "otp", "1234", time.Now().Add(time.Second*2))
+	assert.Nil(t, err)
+
+	value, _, err := proxy.Get(context.TODO(), "otp")
+	assert.Nil(t, err)
+	assert.Equal(t, "1234", value)
+
+	//过期时间随记录写回数据库
+	proxy.SyncDirtyToDB(context.TODO())
+	cli.FlushAll(context.TODO()).Result()
+
+	value, _, err = proxy.Get(context.TODO(), "otp")
+	assert.Nil(t, err)
+	assert.Equal(t, "1234", value)
+
+	time.Sleep(time.Second * 3)
+
+	_, _, err = proxy.Get(context.TODO(), "otp")
+	assert.Equal(t, "err_not_exist", err.Error())
+
+	//未删除的过期记录保留版本号
+	_, _, expireAt, err := queryRow(context.TODO(), dbc, "otp")
+	assert.Nil(t, err)
+	assert.True(t, expired(expireAt))
+
+	//过期的key可以重新创建
+	_, err = proxy.SetNX(context.TODO(), "otp", "5678")
+	assert.Nil(t, err)
+
+	//取消过期
+	_, err = proxy.ExpireAt(context.TODO(), "otp", time.Now().Add(time.Second))
+	assert.Nil(t, err)
+	_, err = proxy.ExpireAt(context.TODO(), "otp", time.Time{})
+	assert.Nil(t, err)
+	time.Sleep(time.Second * 2)
+	value, _, err = proxy.Get(context.TODO(), "otp")
+	assert.Nil(t, err)
+	assert.Equal(t, "5678", value)
+
+	dbc.ExecContext(context.TODO(), `insert into kv("key","value","version","expire_at") values('reap','v',1,1)`)
+	n, err := proxy.ReapExpired(context.TODO(), 10, time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+
+	//过期的记录先转为墓碑，超过保留时间后删除
+	version, _, expireAt, err := queryRow(context.TODO(), dbc, "reap")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, version)
+	assert.True(t, expireAt < 0)
+	dbc.ExecContext(context.TODO(), `update kv set expire_at = $1 where key = 'reap'`, -time.Now().Add(-time.Hour*2).Unix())
+	n, err = proxy.ReapExpired(context.TODO(), 10, time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	_, _, _, err = queryRow(context.TODO(), dbc, "reap")
+	assert.Equal(t, dbsql.ErrNoRows, err)
+
+	//过期但未删除的记录，重新写入后写回不能丢失
+	dbc.ExecContext(context.TODO(), `insert into kv("key","value","version","expire_at") values('stale','old',5,1)`)
+	_, _, err = proxy.Get(context.TODO(), "stale")
+	assert.Equal(t, "err_not_exist", err.Error())
+	ver, err := proxy.Set(context.TODO(), "stale", "new")
+	assert.Nil(t, err)
+	assert.Equal(t, 6, ver)
+	assert.Nil(t, proxy.SyncDirtyToDB(context.TODO()))
+	version, value, expireAt, err = queryRow(context.TODO(), dbc, "stale")
+	assert.Nil(t, err)
+	assert.Equal(t, 6, version)
+	assert.Equal(t, "new", value)
+	assert.Equal(t, int64(0), expireAt)
+}
+
+func TestHistory(t *testing.T) {
+	dbc, _ := sqlx.Open("postgres", "host=localhost port=5432 dbname=test user=postgres password=802802 sslmode=disable")
+
+	cli := initRedis()
+
+	dbc.ExecContext(context.TODO(), "delete from kv;")
+	dbc.ExecContext(context.TODO(), "delete from kv_history;")
+	cli.FlushAll(context.TODO()).Result()
+
+	defer dbc.Close()
+
+	proxy := NewDataProxy(cli, dbc, WithHistory(HistoryOptions{Keep: 3}))
+
+	proxy.Set(context.TODO(), "doc", "v1")
+	//缓存命中后的写入都在redis中合并，同步前被覆盖的版本也要记录
+	for i := 2; i <= 4; i++ {
+		proxy.Set(context.TODO(), "doc", fmt.Sprintf("v%d", i))
+	}
+	ver, err := proxy.Set(context.TODO(), "doc", "v5")
+	assert.Nil(t, err)
+
+	assert.Nil(t, proxy.SyncDirtyToDB(context.TODO()))
+
+	value, err := proxy.GetVersion(context.TODO(), "doc", ver-1)
+	assert.Nil(t, err)
+	assert.Equal(t, "v4", value)
+
+	entries, err := proxy.History(context.TODO(), "doc", 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(entries))
+	assert.Equal(t, ver, entries[0].Version)
+	assert.Equal(t, "v5", entries[0].Value)
+
+	_, err = proxy.GetVersion(context.TODO(), "doc", 1)
+	assert.Equal(t, "err_not_exist", err.Error())
+
+	assert.Nil(t, proxy.Delete(context.TODO(), "doc"))
+	assert.Nil(t, proxy.SyncDirtyToDB(context.TODO()))
+	entries, _ = proxy.History(context.TODO(), "doc", 1)
+	assert.True(t, entries[0].Deleted)
+
+	//直接在数据库中删除(写成墓碑)，由触发器记录
+	dbc.ExecContext(context.TODO(), `insert into kv("key","value","version") values('doc2','v1',1);`)
+	ver, err = deleteRowPgsql(context.TODO(), dbc, "doc2", 0)
+	assert.Nil(t, err)
+	entries, _ = proxy.History(context.TODO(), "doc2", 10)
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, ver, entries[0].Version)
+	assert.True(t, entries[0].Deleted)
+	assert.Equal(t, "", entries[0].Value)
+	assert.False(t, entries[1].Deleted)
+
+	//清理墓碑不记录
+	dbc.ExecContext(context.TODO(), "delete from kv where key = 'doc2';")
+	entries, _ = proxy.History(context.TODO(), "doc2", 10)
+	assert.Equal(t, 2, len(entries))
+}
+
+func TestCompression(t *testing.T) {
+	p := NewDataProxy(nil, nil, WithCompression(CompressOptions{Threshold: 64}))
+
+	small := "hello"
+	v, err := p.encodeValue(context.TODO(), "k", small)
+	assert.Nil(t, err)
+	assert.Equal(t, small, v)
+
+	large := strings.Repeat(`{"name":"rcache","value":12345}`, 100)
+	v, err = p.encodeValue(context.TODO(), "k", large)
+	assert.Nil(t, err)
+	assert.True(t, len(v) < len(large))
+
+	d, err := p.decodeValue(context.TODO(), "k", v, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, large, d)
+
+	//更换codec后仍能读取旧数据，未压缩的数据原样返回
+	p2 := NewDataProxy(nil, nil, WithCompression(CompressOptions{Codec: FlateCodec{}}))
+	d, err = p2.decodeValue(context.TODO(), "k", v, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, large, d)
+
+	d, _ = p2.decodeValue(context.TODO(), "k", small, nil)
+	assert.Equal(t, small, d)
+
+	stats := p.CompressStats()
+	assert.Equal(t, int64(1), stats.Values)
+	assert.True(t, stats.Ratio() > 1)
+
+	//本身以头部开头的value写入时转义，读取时原样返回
+	for _, raw := range []string{"\x1bgabc", "\x1bf", "\x1b\x00x", "\x1be" + strings.Repeat("z", 100)} {
+		v, err = p.encodeValue(context.TODO(), "k", raw)
+		assert.Nil(t, err)
+		d, err = p.decodeValue(context.TODO(), "k", v, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, raw, d)
+	}
+	v, _ = p.encodeValue(context.TODO(), "k", "\x1bgabc")
+	assert.Equal(t, "\x1b\x00\x1bgabc", v)
+}
+
+func TestEncryption(t *testing.T) {
+	provider := &StaticKeyProvider{
+		Keys: map[string][]byte{
+			"k1": []byte("0123456789abcdef0123456789abcdef"),
+			"k2": []byte("fedcba9876543210fedcba9876543210"),
+		},
+		Current: map[string]string{"": "k1"},
+	}
+	p := NewDataProxy(nil, nil, WithEncryption(EncryptOptions{Provider: provider}), WithCompression(CompressOptions{Threshold: 16}))
+
+	plain := strings.Repeat("secret", 10)
+	v, err := p.encodeValue(context.TODO(), "user:1", plain)
+	assert.Nil(t, err)
+	assert.False(t, strings.Contains(v, "secret"))
+
+	keyID, ok := encryptedKeyID(v)
+	assert.True(t, ok)
+	assert.Equal(t, "k1", keyID)
+
+	d, err := p.decodeValue(context.TODO(), "user:1", v, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, plain, d)
+
+	//密文与key绑定
+	_, err = p.decodeValue(context.TODO(), "user:2", v, nil)
+	assert.Equal(t, "err_decrypt", err.Error())
+
+	//轮换后旧数据仍可读取
+	provider.Current["user"] = "k2"
+	p2 := NewDataProxy(nil, nil, WithEncryption(EncryptOptions{Provider: provider}), WithCompression(CompressOptions{Threshold: 16}))
+	v2, _ := p2.encodeValue(context.TODO(), "user:1", plain)
+	keyID, _ = encryptedKeyID(v2)
+	assert.Equal(t, "k2", keyID)
+
+	d, err = p2.decodeValue(context.TODO(), "user:1", v, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, plain, d)
+
+	//只开启加密时，以头部开头的value同样转义
+	p3 := NewDataProxy(nil, nil, WithEncryption(EncryptOptions{Provider: provider}))
+	for _, raw := range []string{"\x1bek1:abc", "\x1b\x00", "plain"} {
+		v, err = p3.encodeValue(context.TODO(), "user:1", raw)
+		assert.Nil(t, err)
+		d, err = p3.decodeValue(context.TODO(), "user:1", v, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, raw, d)
+	}
+}
+
+func TestBytes(t *testing.T) {
+	dbc, _ := sqlx.Open("postgres", "host=localhost port=5432 dbname=test user=postgres password=802802 sslmode=disable")
+
+	cli := initRedis()
+
+	dbc.ExecContext(context.TODO(), "delete from kv;")
+	cli.FlushAll(context.TODO()).Result()
+
+	defer dbc.Close()
+
+	proxy := NewDataProxy(cli, dbc)
+
+	value := []byte{0, 1, 2, 0xff, 0xfe, '\\', 'x', 0}
+
+	ver, err := proxy.SetBytes(context.TODO(), "blob", value)
+	assert.Nil(t, err)
+	ver, err = proxy.SetBytesWithVersion(context.TODO(), "blob", value, ver)
+	assert.Nil(t, err)
+
+	assert.Nil(t, proxy.SyncDirtyToDB(context.TODO()))
+	cli.FlushAll(context.TODO()).Result()
+
+	//从数据库加载后与写入的字节一致
+	v, version, err := proxy.GetBytes(context.TODO(), "blob")
+	assert.Nil(t, err)
+	assert.Equal(t, ver, version)
+	assert.Equal(t, value, v)
+}
+
+func TestScanPrefix(t *testing.T) {
+	dbc, _ := sqlx.Open("postgres", "host=localhost port=5432 dbname=test user=postgres password=802802 sslmode=disable")
+
+	cli := initRedis()
+
+	dbc.ExecContext(context.TODO(), "delete from kv;")
+	cli.FlushAll(context.TODO()).Result()
+
+	defer dbc.Close()
+
+	proxy := NewDataProxy(cli, dbc)
+
+	for i := 0; i < 5; i++ {
+		proxy.Set(context.TODO(), fmt.Sprintf("scan:%d", i), "db")
+	}
+	proxy.Set(context.TODO(), "other:0", "db")
+	proxy.SyncDirtyToDB(context.TODO())
+
+	//未同步的修改、删除和只在redis中的key
+	proxy.Set(context.TODO(), "scan:1", "redis")
+	proxy.Delete(context.TODO(), "scan:2")
+	cli.HSet(context.TODO(), "scan:5", "version", 1, "value", "new", "__cache_timeout__", 1800)
+	cli.HSet(context.TODO(), dirtyKey, "scan:5", 1)
+
+	var keys, values []string
+	cursor := ""
+	for {
+		items, next, err := proxy.Scan(context.TODO(), "scan:", cursor, 2)
+		assert.Nil(t, err)
+		for _, item := range items {
+			keys = append(keys, item.Key)
+			values = append(values, item.Value)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	assert.Equal(t, []string{"scan:0", "scan:1", "scan:3", "scan:4", "scan:5"}, keys)
+	assert.Equal(t, []string{"db", "redis", "db", "db", "new"}, values)
+
+	//大小写和标点在en_US等排序规则下与字节序不同
+	mixed := []string{"mix:B", "mix:a", "mix:_x", "mix:A-1", "mix:b.2", "mix:A1", "mix:~z"}
+	for i, key := range mixed {
+		proxy.Set(context.TODO(), key, "v")
+		if i%2 == 0 {
+			proxy.SyncDirtyToDB(context.TODO())
+		}
+	}
+	keys = nil
+	cursor = ""
+	for {
+		items, next, err := proxy.Scan(context.TODO(), "mix:", cursor, 2)
+		assert.Nil(t, err)
+		for _, item := range items {
+			keys = append(keys, item.Key)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	sort.Strings(mixed)
+	assert.Equal(t, mixed, keys)
+
+	//dirty key只读取一次
+	keys = nil
+	err := proxy.ScanAll(context.TODO(), "mix:", 2, func(items []ScanItem) error {
+		for _, item := range items {
+			keys = append(keys, item.Key)
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, mixed, keys)
+
+	dirty := dirtyKeys{"a", "b", "c", "d"}
+	assert.Equal(t, []string{"b", "c"}, []string(dirty.between("a", "c", false)))
+	assert.Equal(t, []string{"b", "c", "d"}, []string(dirty.between("a", "", true)))
+	assert.Equal(t, 0, len(dirty.between("d", "", true)))
+}
+
+func TestHTTPHandler(t *testing.T) {
+	status, e := httpStatus(errors.New("err_version_not_match"))
+	assert.Equal(t, http.StatusPreconditionFailed, status)
+	assert.Equal(t, "err_version_not_match", e.Code)
+
+	status, _ = httpStatus(&TxnError{Index: 1, err: errors.New("err_not_exist")})
+	assert.Equal(t, http.StatusNotFound, status)
+
+	status, e = httpStatus(errors.New("dial tcp: connection refused"))
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, "err_backend_unavailable", e.Code)
+
+	v, err := parseETag(`W/"12"`)
+	assert.Nil(t, err)
+	assert.Equal(t, 12, v)
+
+	//请求格式错误时不访问后端
+	h := NewHTTPHandler(NewDataProxy(nil, nil))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/kv/user:1", strings.NewReader(`{"val":1}`)))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.JSONEq(t, `{"error":{"code":"err_bad_request","message":"bad request"}}`, rec.Body.String())
+
+	status, _ = httpStatus(errors.New("err_cross_slot"))
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	//请求体过大
+	rec = httptest.NewRecorder()
+	big := `{"value":"` + strings.Repeat("a", maxHTTPBody) + `"}`
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/kv/user:1", strings.NewReader(big)))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(`{"ops":[`+big+`]}`)))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+}
+
+func TestHTTPGateway(t *testing.T) {
+	dbc, _ := sqlx.Open("postgres", "host=localhost port=5432 dbname=test user=postgres password=802802 sslmode=disable")
+
+	cli := initRedis()
+
+	dbc.ExecContext(context.TODO(), "delete from kv;")
+	cli.FlushAll(context.TODO()).Result()
+
+	defer dbc.Close()
+
+	srv := httptest.NewServer(NewHTTPHandler(NewDataProxy(cli, dbc)))
+	defer srv.Close()
+
+	do := func(method, path, body string, header ...string) *http.Response {
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	//If-None-Match: *只在不存在时创建
+	resp := do(http.MethodPut, "/kv/user:1", `{"value":"a"}`, "If-None-Match", "*")
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, `"1"`, resp.Header.Get("ETag"))
+	resp = do(http.MethodPut, "/kv/user:1", `{"value":"b"}`, "If-None-Match", "*")
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+
+	resp = do(http.MethodGet, "/kv/user:1", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `"1"`, resp.Header.Get("ETag"))
+	var item httpItem
+	json.NewDecoder(resp.Body).Decode(&item)
+	assert.Equal(t, "a", *item.Value)
+	assert.Equal(t, 1, item.Version)
+
+	resp = do(http.MethodGet, "/kv/user:1", "", "If-None-Match", `"1"`)
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+	//If-Match版本号不一致
+	resp = do(http.MethodPut, "/kv/user:1", `{"value":"b"}`, "If-Match", `"2"`)
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+	resp = do(http.MethodPut, "/kv/user:1", `{"value":"b"}`, "If-Match", `"1"`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `"2"`, resp.Header.Get("ETag"))
+
+	resp = do(http.MethodDelete, "/kv/user:1", "", "If-Match", `"1"`)
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+	resp = do(http.MethodDelete, "/kv/user:1", "")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp = do(http.MethodDelete, "/kv/user:1", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp = do(http.MethodGet, "/kv/user:1", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	//非atomic时每个操作独立执行
+	resp = do(http.MethodPost, "/batch", `{"ops":[
+		{"op":"set","key":"user:2","value":"x"},
+		{"op":"set","key":"user:3","value":"y","version":5},
+		{"op":"get","key":"user:2"},
+		{"op":"delete","key":"user:4"}]}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var results struct {
+		Results []httpItem `json:"results"`
+	}
+	json.NewDecoder(resp.Body).Decode(&results)
+	assert.Equal(t, 4, len(results.Results))
+	assert.Equal(t, 1, results.Results[0].Version)
+	assert.Equal(t, "err_version_not_match", results.Results[1].Error.Code)
+	assert.Equal(t, "x", *results.Results[2].Value)
+	assert.Equal(t, "err_not_exist", results.Results[3].Error.Code)
+
+	//atomic时任一失败则都不执行
+	resp = do(http.MethodPost, "/batch", `{"atomic":true,"ops":[
+		{"op":"set","key":"user:2","value":"x2","version":1},
+		{"op":"set","key":"user:3","value":"y","version":1}]}`)
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+	var txnErr struct {
+		Error httpError `json:"error"`
+		Index int       `json:"index"`
+	}
+	json.NewDecoder(resp.Body).Decode(&txnErr)
+	assert.Equal(t, "err_version_not_match", txnErr.Error.Code)
+	assert.Equal(t, 1, txnErr.Index)
+	resp = do(http.MethodGet, "/kv/user:2", "")
+	assert.Equal(t, `"1"`, resp.Header.Get("ETag"))
+
+	resp = do(http.MethodPost, "/batch", `{"atomic":true,"ops":[
+		{"op":"set","key":"user:2","value":"x2","version":1},
+		{"op":"set","key":"user:3","value":"y"},
+		{"op":"check","key":"user:4"}]}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	json.NewDecoder(resp.Body).Decode(&results)
+	assert.Equal(t, []int{2, 1, 0}, []int{results.Results[0].Version, results.Results[1].Version, results.Results[2].Version})
+}
+
+func TestConfig(t *testing.T) {
+	t.Setenv("RCACHE_DB_DSN", "host=db dbname=test")
+	cfg, err := ParseConfig([]byte(`
+redis:
+  mode: sentinel
+  master_name: mymaster
+  sentinel_addrs: ["127.0.0.1:26379"]
+  pool_size: 20
+  read_timeout: 500ms
+db:
+  dsn: placeholder
+cache_timeout: 600
+namespaces:
+  session:
+    cache_timeout: 60
+sync:
+  interval: 2s
+`))
+	assert.Nil(t, err)
+	assert.Equal(t, "host=db dbname=test", cfg.DB.DSN)
+	assert.Equal(t, 500*time.Millisecond, cfg.Redis.ReadTimeout)
+	assert.Equal(t, 60, cfg.Namespaces["session"].CacheTimeout)
+	assert.Equal(t, 2*time.Second, cfg.Sync.Interval)
+
+	p := &DataProxy{ttl: &ttlPolicy{def: 600, namespaces: map[string]int{"session": 60}}}
+	assert.Equal(t, 60, p.cacheTime("session:1", nil))
+	assert.Equal(t, 600, p.cacheTime("user:1", nil))
+	assert.Equal(t, 5, p.cacheTime("session:1", []int{5}))
+
+	for field, doc := range map[string]string{
+		"redis.addr":                       "db: {dsn: x}",
+		"redis.master_name":                "redis: {mode: sentinel, sentinel_addrs: [a]}\ndb: {dsn: x}",
+		"redis.mode":                       "redis: {mode: ring, addr: a}\ndb: {dsn: x}",
+		"redis.cluster_addrs":              "redis: {mode: cluster, addr: a}\ndb: {dsn: x}",
+		"cdc":                              "redis: {mode: cluster, cluster_addrs: [a]}\ndb: {dsn: x}\ncdc: {}",
+		"namespaces.session.cache_timeout": "redis: {addr: a}\ndb: {dsn: x}\nnamespaces: {session: {cache_timeout: -1}}",
+		"compression.codec":                "redis: {addr: a}\ndb: {dsn: x}\ncompression: {codec: zstd}",
+	} {
+		_, err := ParseConfig([]byte(doc))
+		var cerr *ConfigError
+		if assert.True(t, errors.As(err, &cerr), field) {
+			assert.Equal(t, field, cerr.Field)
+		}
+	}
+
+	_, err = ParseConfig([]byte("redis: {addr: a, unknown: 1}\ndb: {dsn: x}"))
+	assert.NotNil(t, err)
+
+	cfg, err = ParseConfig([]byte("redis: {mode: cluster, cluster_addrs: [\"127.0.0.1:7000\"]}\ndb: {dsn: x}"))
+	if assert.Nil(t, err) {
+		p, err := NewFromConfig(cfg)
+		assert.Nil(t, err)
+		assert.True(t, p.cluster)
+		p.Close()
+	}
+}
+
+func TestKeySlot(t *testing.T) {
+	assert.Equal(t, uint16(0x31c3), crc16("123456789"))
+	assert.Equal(t, 12182, keySlot("foo"))
+	assert.Equal(t, keySlot("user1000"), keySlot("{user1000}.following"))
+	assert.Equal(t, keySlot("{user1000}.following"), keySlot("{user1000}.followers"))
+	//空的{}不是hash tag
+	assert.Equal(t, int(crc16("foo{}{bar}")%slotCount), keySlot("foo{}{bar}"))
+
+	//内部key与数据key在同一个slot
+	for _, key := range []string{"user:1", "{order:7}:items", "balance:a"} {
+		ks := keysOfSlot(keySlot(key))
+		for _, k := range append([]string{ks.dirty, ks.dirtyGroup, ks.groups, ks.groupSeq, ks.deadLetter}, recorder{history: true}.keys(ks)...) {
+			assert.Equal(t, keySlot(key), keySlot(k), k)
+		}
+	}
+	for slot := 0; slot < slotCount; slot++ {
+		if keySlot(keysOfSlot(slot).dirty) != slot {
+			t.Fatalf("slot %d", slot)
+		}
+	}
+}
+
+func TestKeyState(t *testing.T) {
+	redisRow := map[string]string{"version": "3", "value": "hello"}
+	assert.Equal(t, KeyNotCached, keyState(KeyInfo{DB: &DBRow{Version: 3, Value: "hello"}}))
+	assert.Equal(t, KeyInSync, keyState(KeyInfo{Redis: redisRow, DB: &DBRow{Version: 3, Value: "hello"}}))
+	assert.Equal(t, KeyDiverged, keyState(KeyInfo{Redis: redisRow, DB: &DBRow{Version: 2, Value: "hi"}}))
+	assert.Equal(t, KeyDiverged, keyState(KeyInfo{Redis: redisRow}))
+	assert.Equal(t, KeyDirty, keyState(KeyInfo{Redis: redisRow, DirtyVersion: 3, DB: &DBRow{Version: 2, Value: "hi"}}))
+	assert.Equal(t, KeyDeadLetter, keyState(KeyInfo{Redis: redisRow, DirtyVersion: 3, DeadLetter: &DeadLetter{Version: 3}}))
+	assert.Equal(t, KeyDirty, keyState(KeyInfo{Redis: redisRow, DirtyVersion: 4, DeadLetter: &DeadLetter{Version: 3}}))
+
+	//删除的key在数据库中也不存在
+	assert.Equal(t, KeyInSync, keyState(KeyInfo{Redis: map[string]string{"version": "4", "__deleted__": "1"}}))
+
+	assert.True(t, poisonError(fmt.Errorf("writeback: %w", &pq.Error{Code: "22021"})))
+	assert.False(t, poisonError(&pq.Error{Code: "57P01"}))
+	assert.False(t, poisonError(errors.New("connection refused")))
+}
+
+func TestClassify(t *testing.T) {
+	now := time.Now().Unix()
+	cached := func(version int, value string) cachedRow {
+		return cachedRow{row: row{key: "k", version: version, value: value}}
+	}
+
+	assert.Equal(t, "", classify(cached(3, "a"), &row{key: "k", version: 3, value: "a"}, now).Kind)
+	assert.Equal(t, DivergeCacheBehind, classify(cached(2, "a"), &row{key: "k", version: 3, value: "b"}, now).Kind)
+	d := classify(cached(4, "a"), &row{key: "k", version: 3, value: "b"}, now)
+	assert.Equal(t, DivergeCacheAhead, d.Kind)
+	assert.Equal(t, "writeback", d.Repair)
+	assert.Equal(t, DivergeValue, classify(cached(3, "a"), &row{key: "k", version: 3, value: "b"}, now).Kind)
+	assert.Equal(t, DivergeValue, classify(cached(3, "a"), &row{key: "k", version: 3, value: "a", expireAt: now + 60}, now).Kind)
+	//数据库中没有记录时默认只报告
+	d = classify(cached(1, "a"), nil, now)
+	assert.Equal(t, DivergeMissingInDB, d.Kind)
+	assert.Equal(t, "", d.Repair)
+
+	//已过期的缓存和数据库中没有记录是一致的
+	expired := cached(1, "a")
+	expired.expireAt = now - 1
+	assert.Equal(t, "", classify(expired, nil, now).Kind)
+
+	tombstone := cached(5, "")
+	tombstone.deleted = true
+	assert.Equal(t, DivergeCacheAhead, classify(tombstone, &row{key: "k", version: 4, value: "a"}, now).Kind)
+
+	assert.True(t, isInternalKey(dirtyKey))
+	assert.True(t, isInternalKey(keysOfSlot(7).groups))
+	assert.False(t, isInternalKey("__user__"))
+	assert.False(t, isInternalKey("__dirty__:1"))
+}
+
+func TestVerify(t *testing.T) {
+	dbc, _ := sqlx.Open("postgres", "host=localhost port=5432 dbname=test user=postgres password=802802 sslmode=disable")
+
+	cli := initRedis()
+
+	dbc.ExecContext(context.TODO(), "delete from kv;")
+	cli.FlushAll(context.TODO()).Result()
+
+	defer dbc.Close()
+
+	proxy := NewDataProxy(cli, dbc)
+
+	for _, key := range []string{"v:behind", "v:ahead", "__v:missing", "v:ok"} {
+		proxy.Set(context.TODO(), key, "a")
+	}
+	assert.Nil(t, proxy.SyncDirtyToDB(context.TODO()))
+	dbc.ExecContext(context.TODO(), "update kv set value = 'b',version = version+1 where key = 'v:behind';")
+	dbc.ExecContext(context.TODO(), "update kv set value = 'old',version = version-1 where key = 'v:ahead';")
+	dbc.ExecContext(context.TODO(), "delete from kv where key = '__v:missing';")
+
+	report, err := proxy.Verify(context.TODO(), VerifyOptions{Repair: true})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int{DivergeCacheBehind: 1, DivergeCacheAhead: 1, DivergeMissingInDB: 1}, report.Counts)
+	assert.Equal(t, 2, report.Repaired)
+	for _, d := range report.Divergences {
+		//以__开头的用户key同样检查，数据库中没有记录时不写回
+		if d.Key == "__v:missing" {
+			assert.Equal(t, "", d.Repair)
+			assert.False(t, d.Repaired)
+		}
+	}
+
+	//删除缓存后从数据库加载
+	n, _ := cli.Exists(context.TODO(), "v:behind").Result()
+	assert.Equal(t, int64(0), n)
+	value, _, _ := proxy.Get(context.TODO(), "v:behind")
+	assert.Equal(t, "b", value)
+
+	//写回丢失的版本
+	_, value, _, _ = queryRow(context.TODO(), dbc, "v:ahead")
+	assert.Equal(t, "a", value)
+	_, _, _, err = queryRow(context.TODO(), dbc, "__v:missing")
+	assert.Equal(t, dbsql.ErrNoRows, err)
+
+	report, err = proxy.Verify(context.TODO(), VerifyOptions{Repair: true, WritebackMissing: true})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int{DivergeMissingInDB: 1}, report.Counts)
+	assert.Equal(t, 1, report.Repaired)
+	_, value, _, _ = queryRow(context.TODO(), dbc, "__v:missing")
+	assert.Equal(t, "a", value)
+
+	report, err = proxy.Verify(context.TODO(), VerifyOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(report.Divergences))
+}
+
+func TestTransferRecord(t *testing.T) {
+	records := []transferRecord{
+		{key: "a", value: []byte("hello"), version: 1},
+		{key: "b\tc", value: []byte("line1\nline2\\end"), version: 7, expireAt: 1700000000},
+		{key: "bin", value: []byte{0x1b, 'g', 0xff, 0x00}, version: 2},
+		{key: "empty", value: []byte{}, version: 3},
+	}
+	for _, format := range []Format{FormatJSONL, FormatCopy} {
+		for _, bytea := range []bool{false, true} {
+			if format == FormatCopy && !bytea {
+				//varchar不能保存非法的UTF-8
+				continue
+			}
+			var buf strings.Builder
+			w := bufio.NewWriter(&buf)
+			for _, r := range records {
+				assert.Nil(t, writeRecord(w, format, bytea, r))
+			}
+			w.Flush()
+			lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+			assert.Equal(t, len(records), len(lines))
+			for i, line := range lines {
+				r, err := parseRecord([]byte(line), format, bytea)
+				assert.Nil(t, err)
+				assert.Equal(t, records[i].key, r.key)
+				assert.Equal(t, string(records[i].value), string(r.value))
+				assert.Equal(t, records[i].version, r.version)
+				assert.Equal(t, records[i].expireAt, r.expireAt)
+			}
+		}
+	}
+
+	s, err := copyUnescape(`a\\b\tc\101\x42`)
+	assert.Nil(t, err)
+	assert.Equal(t, "a\\b\tcAB", s)
+
+	_, err = parseRecord([]byte(`{"key":"","version":1}`), FormatJSONL, false)
+	assert.NotNil(t, err)
+	_, err = parseRecord([]byte("k\tv\t0\t\\N"), FormatCopy, false)
+	assert.NotNil(t, err)
+}
+
+// 第一次Read之前调用fn
+type hookReader struct {
+	io.Reader
+	fn func()
+}
+
+func (r *hookReader) Read(b []byte) (int, error) {
+	if r.fn != nil {
+		r.fn()
+		r.fn = nil
+	}
+	return r.Reader.Read(b)
+}
+
+func TestImportExport(t *testing.T) {
+	dbc, _ := sqlx.Open("postgres", "host=localhost port=5432 dbname=test user=postgres password=802802 sslmode=disable")
+
+	cli := initRedis()
+
+	dbc.ExecContext(context.TODO(), "delete from kv;")
+	cli.FlushAll(context.TODO()).Result()
+
+	defer dbc.Close()
+
+	proxy := NewDataProxy(cli, dbc)
+
+	//导出前写回dirty数据
+	proxy.Set(context.TODO(), "t:a", "a")
+	proxy.Set(context.TODO(), "t:b", "b")
+	var out bytes.Buffer
+	n, err := proxy.Export(context.TODO(), &out, FormatJSONL)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	exported := out.String()
+	assert.Equal(t, `{"key":"t:a","value":"a","version":1}`+"\n"+`{"key":"t:b","value":"b","version":1}`+"\n", exported)
+
+	ver, _ := proxy.Set(context.TODO(), "t:a", "a2")
+	assert.Equal(t, 2, ver)
+
+	//newer：版本号不高于数据库中的记录时不覆盖
+	res, err := proxy.Import(context.TODO(), strings.NewReader(exported), FormatJSONL, ImportNewerWins)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, res.Rows)
+	assert.Equal(t, 0, res.Written)
+	value, _, _ := proxy.Get(context.TODO(), "t:a")
+	assert.Equal(t, "a2", value)
+
+	//skip：只写入不存在的key
+	res, err = proxy.Import(context.TODO(), strings.NewReader(exported+`{"key":"t:c","value":"c","version":5}`), FormatJSONL, ImportSkipExisting)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, res.Rows)
+	assert.Equal(t, 1, res.Written)
+	value, ver, _ = proxy.Get(context.TODO(), "t:c")
+	assert.Equal(t, "c", value)
+	assert.Equal(t, 5, ver)
+
+	//overwrite：覆盖已有的记录，版本号递增，并删除redis中的缓存
+	proxy.Get(context.TODO(), "t:a")
+	res, err = proxy.Import(context.TODO(), strings.NewReader(`{"key":"t:a","value":"x","version":1}`), FormatJSONL, ImportOverwrite)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, res.Written)
+	assert.Equal(t, 0, len(res.Conflicts))
+	exists, _ := cli.Exists(context.TODO(), "t:a").Result()
+	assert.Equal(t, int64(0), exists)
+	value, ver, _ = proxy.Get(context.TODO(), "t:a")
+	assert.Equal(t, "x", value)
+	assert.Equal(t, 3, ver)
+
+	//导入期间被修改的key不能删除缓存
+	r := &hookReader{Reader: strings.NewReader(exported), fn: func() {
+		proxy.Set(context.TODO(), "t:b", "b2")
+	}}
+	res, err = proxy.Import(context.TODO(), r, FormatJSONL, ImportOverwrite)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, res.Written)
+	assert.Equal(t, []string{"t:b"}, res.Conflicts)
+	value, _, _ = proxy.Get(context.TODO(), "t:b")
+	assert.Equal(t, "b2", value)
+}
+
+func TestWatch(t *testing.T) {
+	dbc, _ := sqlx.Open("postgres", "host=localhost port=5432 dbname=test user=postgres password=802802 sslmode=disable")
+
+	cli := initRedis()
+
+	dbc.ExecContext(context.TODO(), "delete from kv;")
+	cli.FlushAll(context.TODO()).Result()
+
+	defer dbc.Close()
+
+	proxy := NewDataProxy(cli, dbc)
+	ver, err := proxy.Set(context.TODO(), "cfg:a", "1")
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	events := proxy.Watch(ctx, "cfg:a", "feature:*")
+	time.Sleep(time.Millisecond * 100)
+
+	ver, err = proxy.Set(context.TODO(), "cfg:a", "2")
+	assert.Nil(t, err)
+	e := <-events
+	assert.Equal(t, Event{Key: "cfg:a", Version: ver}, e)
+
+	proxy.Set(context.TODO(), "other", "x")
+	ver, err = proxy.Set(context.TODO(), "feature:x", "on")
+	assert.Nil(t, err)
+	e = <-events
+	assert.Equal(t, Event{Key: "feature:x", Version: ver}, e)
+
+	assert.Nil(t, proxy.Delete(context.TODO(), "feature:x"))
+	e = <-events
+	assert.Equal(t, "feature:x", e.Key)
+	assert.True(t, e.Deleted)
+
+	//断开连接期间的修改在重连后通知
+	cli.ClientKillByFilter(context.TODO(), "TYPE", "pubsub")
+	ver, err = proxy.Set(context.TODO(), "cfg:a", "3")
+	assert.Nil(t, err)
+	for e = range events {
+		if e.Version == ver {
+			break
+		}
+	}
+	assert.Equal(t, Event{Key: "cfg:a", Version: ver}, e)
+
+	cancel()
+	for range events {
+	}
+}
+
+func TestWatchFilter(t *testing.T) {
+	e, ok := parseChange("__change__:cfg:a", "12 del")
+	assert.True(t, ok)
+	assert.Equal(t, Event{Key: "cfg:a", Version: 12, Deleted: true}, e)
+	_, ok = parseChange("other", "1")
+	assert.False(t, ok)
+
+	w := &watcher{seen: map[string]int{"k": 5}}
+	assert.False(t, w.accept(Event{Key: "k", Version: 4}))
+	assert.False(t, w.accept(Event{Key: "k", Version: 5}))
+	assert.True(t, w.accept(Event{Key: "k", Version: 6}))
+	assert.True(t, w.accept(Event{Key: "k", Version: 7, Deleted: true}))
+	//删除后重新创建的key版本号可能变小
+	assert.True(t, w.accept(Event{Key: "k", Version: 1}))
+}
+
+func TestCDC(t *testing.T) {
+	dbc, _ := sqlx.Open("postgres", "host=localhost port=5432 dbname=test user=postgres password=802802 sslmode=disable")
+
+	cli := initRedis()
+
+	dbc.ExecContext(context.TODO(), "delete from kv;")
+	cli.FlushAll(context.TODO()).Result()
+
+	defer dbc.Close()
+
+	proxy := NewDataProxy(cli, dbc, WithCDC(CDCOptions{MaxLen: 1000}))
+	v1, err := proxy.Set(context.TODO(), "order:1", "new")
+	assert.Nil(t, err)
+	v2, err := proxy.Set(context.TODO(), "order:1", "paid")
+	assert.Nil(t, err)
+	_, err = proxy.SetNX(context.TODO(), "order:2", "new")
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Second*5)
+	defer cancel()
+	var changes []Change
+	err = proxy.Consume(ctx, ConsumeOptions{Group: "indexer", Block: time.Millisecond * 100}, func(ctx context.Context, c Change) error {
+		changes = append(changes, c)
+		if len(changes) == 3 {
+			cancel()
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(changes))
+	assert.Equal(t, v1, changes[0].Version)
+	//处理时读取的是当前值
+	assert.Equal(t, "paid", changes[0].Value)
+	assert.Equal(t, v2, changes[0].CurrentVersion)
+	assert.Equal(t, "order:2", changes[2].Key)
+
+	pending, err := cli.XPending(context.TODO(), "__cdc__", "indexer").Result()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), pending.Count)
+
+	//裁剪掉未读取的变更
+	for i := 0; i < 10; i++ {
+		proxy.Set(context.TODO(), "order:1", strconv.Itoa(i))
+	}
+	cli.XTrimMaxLen(context.TODO(), "__cdc__", 2)
+	var gaps []Gap
+	ctx, cancel = context.WithTimeout(context.TODO(), time.Second)
+	defer cancel()
+	proxy.Consume(ctx, ConsumeOptions{
+		Group: "indexer",
+		Block: time.Millisecond * 100,
+		OnGap: func(ctx context.Context, gap Gap) error {
+			gaps = append(gaps, gap)
+			return nil
+		},
+	}, func(ctx context.Context, c Change) error { return nil })
+	assert.Equal(t, 1, len(gaps))
+
+	//阻塞读取期间写入并裁剪，读取会越过裁剪的位置
+	gapc := make(chan Gap, 1)
+	ctx, cancel = context.WithTimeout(context.TODO(), time.Second*2)
+	defer cancel()
+	go proxy.Consume(ctx, ConsumeOptions{
+		Group: "indexer",
+		Block: time.Second,
+		OnGap: func(ctx context.Context, gap Gap) error {
+			gapc <- gap
+			return nil
+		},
+	}, func(ctx context.Context, c Change) error { return nil })
+	time.Sleep(time.Millisecond * 200)
+	cli.TxPipelined(context.TODO(), func(pipe redis.Pipeliner) error {
+		for i := 0; i < 10; i++ {
+			pipe.XAdd(context.TODO(), &redis.XAddArgs{Stream: "__cdc__", Values: []any{"key", "order:1", "version", i, "op", "set"}})
+		}
+		pipe.XTrimMaxLen(context.TODO(), "__cdc__", 2)
+		return nil
+	})
+	select {
+	case gap := <-gapc:
+		assert.True(t, compareStreamID(gap.MaxDeleted, gap.LastDelivered) > 0)
+	case <-ctx.Done():
+		t.Fatal("gap not reported")
+	}
+
+	assert.Equal(t, 1, compareStreamID("2-0", "1-5"))
+	assert.Equal(t, -1, compareStreamID("10-1", "10-2"))
+	assert.Equal(t, 0, compareStreamID("3-3", "3-3"))
+}
+
+func TestFallbackCapture(t *testing.T) {
+	dbc, _ := sqlx.Open("postgres", "host=localhost port=5432 dbname=test user=postgres password=802802 sslmode=disable")
+
+	cli := initRedis()
+
+	dbc.ExecContext(context.TODO(), "delete from kv;")
+	cli.FlushAll(context.TODO()).Result()
+
+	defer dbc.Close()
+
+	proxy := NewDataProxy(cli, dbc, WithCDC(CDCOptions{}), WithRedisFallback(BreakerOptions{}))
+
+	//熔断期间直接写入数据库的key在核对后补发到变更流
+	ver, err := insertUpdateRowPgsql(context.TODO(), dbc, "order:1", "new", 0)
+	assert.Nil(t, err)
+	proxy.fallback.add("order:1")
+	_, err = insertUpdateRowPgsql(context.TODO(), dbc, "order:2", "new", 0)
+	assert.Nil(t, err)
+	delVer, err := deleteRowPgsql(context.TODO(), dbc, "order:2", 0)
+	assert.Nil(t, err)
+	proxy.fallback.add("order:2")
+	assert.Nil(t, proxy.reconcile(context.TODO()))
+
+	msgs, err := cli.XRange(context.TODO(), "__cdc__", "-", "+").Result()
+	assert.Nil(t, err)
+	got := map[string][]any{}
+	for _, m := range msgs {
+		got[m.Values["key"].(string)] = []any{m.Values["version"], m.Values["op"]}
+	}
+	assert.Equal(t, map[string][]any{
+		"order:1": {strconv.Itoa(ver), "set"},
+		"order:2": {strconv.Itoa(delVer), "del"},
+	}, got)
+}
+
+func TestInvalidate(t *testing.T) {
+	dsn := "host=localhost port=5432 dbname=test user=postgres password=802802 sslmode=disable"
+	dbc, _ := sqlx.Open("postgres", dsn)
+
+	cli := initRedis()
+
+	dbc.ExecContext(context.TODO(), "delete from kv;")
+	cli.FlushAll(context.TODO()).Result()
+
+	defer dbc.Close()
+
+	proxy := NewDataProxy(cli, dbc)
+	_, err := proxy.Set(context.TODO(), "cfg:a", "1")
+	assert.Nil(t, err)
+	_, err = proxy.Set(context.TODO(), "cfg:b", "1")
+	assert.Nil(t, err)
+	assert.Nil(t, proxy.SyncDirtyToDB(context.TODO()))
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	conflicts := make(chan Conflict, 1)
+	go proxy.ListenInvalidations(ctx, InvalidationOptions{DSN: dsn, OnConflict: func(c Conflict) { conflicts <- c }})
+	time.Sleep(time.Millisecond * 200)
+
+	//干净的缓存被删除，重新从数据库加载
+	dbc.ExecContext(context.TODO(), "update kv set value = '2' where key = 'cfg:a'")
+	time.Sleep(time.Millisecond * 200)
+	v, _, err := proxy.Get(context.TODO(), "cfg:a")
+	assert.Nil(t, err)
+	assert.Equal(t, "2", v)
+
+	//dirty的缓存记录为dead letter
+	ver, err := proxy.Set(context.TODO(), "cfg:b", "3")
+	assert.Nil(t, err)
+	dbc.ExecContext(context.TODO(), "update kv set value = '4', version = version + 1 where key = 'cfg:b'")
+	c := <-conflicts
+	assert.Equal(t, Conflict{Key: "cfg:b", DBVersion: ver, CacheVersion: ver, Op: "update"}, c)
+	letters, err := proxy.DeadLetters(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(letters))
+	assert.Equal(t, "cfg:b", letters[0].Key)
+
+	//已经开始的同步在写回前重新检查dead letter，不覆盖外部的修改
+	assert.Nil(t, proxy.syncKey(context.TODO(), "cfg:b"))
+	_, v, _, err = queryRow(context.TODO(), dbc, "cfg:b")
+	assert.Nil(t, err)
+	assert.Equal(t, "4", v)
+}
+
+func TestMetrics(t *testing.T) {
+	m := NewPrometheusMetrics(0.01, 0.1)
+	m.Hit("user:1")
+	m.Hit("user:2")
+	m.Miss("user:3")
+	m.NegativeHit("order:1")
+	m.DBLoad("user:3", time.Millisecond*50, nil)
+	m.DBLoad("user:4", time.Millisecond, errors.New("connection refused"))
+	m.VersionMismatch("a\"b:1")
+	m.Sync(time.Millisecond*5, 7, nil)
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	assert.Contains(t, body, `rcache_cache_requests_total{namespace="user",result="hit"} 2`)
+	assert.Contains(t, body, `rcache_cache_requests_total{namespace="user",result="miss"} 1`)
+	assert.Contains(t, body, `rcache_cache_requests_total{namespace="order",result="negative_hit"} 1`)
+	assert.Contains(t, body, `rcache_db_errors_total{namespace="user",op="load"} 1`)
+	assert.Contains(t, body, `rcache_db_load_seconds_bucket{namespace="user",le="0.01"} 1`)
+	assert.Contains(t, body, `rcache_db_load_seconds_bucket{namespace="user",le="0.1"} 2`)
+	assert.Contains(t, body, `rcache_db_load_seconds_count{namespace="user"} 2`)
+	assert.Contains(t, body, `rcache_version_mismatch_total{namespace="a\"b"} 1`)
+	assert.Contains(t, body, "rcache_sync_seconds_count 1")
+	assert.Contains(t, body, "rcache_dirty_keys 7")
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/hex"
 	"errors"
 	"io"
+	"strconv"
 	"strings"
 
 	redis "github.com/redis/go-redis/v9"
@@ -27,7 +28,7 @@ func newScript(src string) *script {
 	}
 }
 
-func (s *script) eval(ctx context.Context, c *redis.Client, keys []string, args ...any) (result any, err error) {
+func (s *script) eval(ctx context.Context, c redis.UniversalClient, keys []string, args ...any) (result any, err error) {
 	result, err = c.EvalSha(ctx, s.sha, keys, args...).Result()
 	if err != nil && strings.Contains(err.Error(), "NOSCRIPT") {
 		result, err = c.Eval(ctx, s.src, keys, args...).Result()
@@ -35,53 +36,205 @@ func (s *script) eval(ctx context.Context, c *redis.Client, keys []string, args
 	return
 }
 
+// 确保脚本已加载，pipeline中只能使用evalsha
+func (s *script) load(ctx context.Context, c redis.UniversalClient) error {
+	return c.ScriptLoad(ctx, s.src).Err()
+}
+
 const dirtyKey = "__dirty__"
 
-const scriptSet string = `
-	local cacheTimeout = ARGV[3]
+// 事务写入的一组dirty key：key -> 组id，组id -> key列表(json)
+const (
+	dirtyGroupKey = "__dirty_group__"
+	groupsKey     = "__groups__"
+	groupSeqKey   = "__group_seq__"
+)
+
+// 开启历史记录时每次写入的版本追加到这个list，同步时写入kv_history
+const historyKey = "__history__"
+
+// 写入时的附加记录：history为是否记录历史版本，stream不为空时追加到变更流(WithCDC)
+type recorder struct {
+	history bool
+	stream  string
+	maxLen  int64
+}
+
+// 历史记录和变更流的key，写入脚本的KEYS中紧跟在dirty key之后，未开启时传入ks.none
+func (r recorder) keys(ks slotKeys) []string {
+	keys := []string{ks.none, ks.none}
+	if r.history {
+		keys[0] = ks.history
+	}
+	if r.stream != "" {
+		keys[1] = r.stream
+	}
+	return keys
+}
+
+// 干净的数据设置ttl，开启了宽限期时redis中保留cacheTimeout+grace秒，
+// 其中后grace秒为逻辑过期，只在冷存储不可用时作为陈旧数据返回
+const luaTouch string = `
+	local function touch(key,cacheTimeout,grace)
+		redis.call('Expire',key,cacheTimeout+grace)
+		if grace > 0 then
+			redis.call('hset',key,'__fresh__',tonumber(redis.call('TIME')[1])+cacheTimeout)
+		end
+	end
+
+	local function stale(fresh)
+		return fresh and tonumber(fresh) < tonumber(redis.call('TIME')[1])
+	end
+`
+
+// 数据是否存在：版本号大于0，不是墓碑，且没有到达expire_at(逻辑过期时间，unix秒)
+const luaExist string = `
+	local function exist(version,deleted,expireAt)
+		return tonumber(version) > 0 and not deleted and (not expireAt or tonumber(expireAt) > tonumber(redis.call('TIME')[1]))
+	end
+`
+
+// hkey为空或__none__开头(集群模式下的占位)时不记录。每个版本追加两项：json编码的元数据和原始的value，
+// value可能是任意字节，不能放在json中
+const luaHistory string = `
+	local function record(hkey,key,version,value,deleted,expireAt)
+		if hkey ~= '' and string.sub(hkey,1,8) ~= '__none__' then
+			local meta = cjson.encode({key,tonumber(version),value ~= false and value ~= nil,deleted,tonumber(expireAt) or 0,tonumber(redis.call('TIME')[1])})
+			redis.call('rpush',hkey,meta,value or '')
+		end
+	end
+`
+
+// skey为空或__none__开头时不记录，否则追加{key,version,op}到stream，ARGV的最后一项为stream的长度上限(近似)
+const luaCapture string = `
+	local function capture(skey,key,version,op)
+		if skey ~= '' and string.sub(skey,1,8) ~= '__none__' then
+			redis.call('xadd',skey,'MAXLEN','~',ARGV[#ARGV],'*','key',key,'version',version,'op',op)
+		end
+	end
+`
+
+// 写入后发布到__change__:key，Watch据此通知key的变化。payload为版本号，删除时追加" del"
+const luaNotify string = `
+	local function notify(key,version,deleted)
+		redis.call('publish','__change__:'..key,deleted and (version..' del') or tostring(version))
+	end
+`
+
+const scriptSet string = luaTouch + luaExist + luaHistory + luaNotify + luaCapture + `
+	local cacheTimeout = tonumber(ARGV[3])
+	local grace = tonumber(ARGV[4])
 	local input_version = tonumber(ARGV[2])
-	local version = redis.call('hget',KEYS[1],'version')
+	local v = redis.call('hmget',KEYS[1],'version','__cache_timeout__','__deleted__','expire_at')
+	local version = v[1]
 	if not version then
 		return {'err_not_in_redis'}
 	else
-        version = tonumber(version)
-        if input_version > 0 and version ~= input_version then
-			redis.call('Expire',KEYS[1],cacheTimeout)
+		--ARGV[5]为1时只更新已存在的key
+		if ARGV[5] == '1' and not exist(version,v[3],v[4]) then
+			return {'err_not_exist'}
+		end
+		version = tonumber(version)
+		--已删除或过期的key不能按版本号写入，与数据库中的墓碑一致
+		if input_version > 0 and (version ~= input_version or not exist(version,v[3],v[4])) then
+			--dirty数据不能设置ttl
+			if not v[2] then
+				touch(KEYS[1],cacheTimeout,grace)
+			end
 			return {'err_version_not_match'}
-		end	   
+		end
 		version = version + 1
 		redis.call('hmset',KEYS[1],'version',version,'value',ARGV[1],'__cache_timeout__',cacheTimeout)
+		redis.call('hdel',KEYS[1],'__fresh__','__deleted__')
+		--ARGV[6]为逻辑过期时间，0表示不过期
+		if tonumber(ARGV[6]) > 0 then
+			redis.call('hset',KEYS[1],'expire_at',ARGV[6])
+		else
+			redis.call('hdel',KEYS[1],'expire_at')
+		end
 		--清除ttl
 		redis.call('PERSIST',KEYS[1])
-		
+		record(KEYS[3],KEYS[1],version,ARGV[1],false,ARGV[6])
+
 		--设置dirty
 		redis.call('hset',KEYS[2], KEYS[1],version)
+		capture(KEYS[4],KEYS[1],version,'set')
+		notify(KEYS[1],version,false)
 		return {'err_ok',version}
 	end
 `
 
-const scriptGet string = `
-	local cacheTimeout = ARGV[1]
-	local v = redis.call('hmget',KEYS[1],'version','value','__cache_timeout__')
+// 冷存储不可用时写入redis中不存在的key，此时不知道数据库中的版本号，
+// 用__blind__标记，由同步时根据数据库中的版本号重新调整
+// 快照的版本是否被记录为dead letter(外部修改或数据库拒绝)，是则返回1，否则返回false
+const luaDeadLetter string = `
+	local function dead(dkey,key,version)
+		local d = redis.call('hget',dkey,key)
+		if d and version and cjson.decode(d).version == tonumber(version) then
+			return 1
+		end
+		return false
+	end
+`
+
+const scriptSetBlind string = luaNotify + luaCapture + `
+	local cacheTimeout = ARGV[2]
+	local version = redis.call('hget',KEYS[1],'version')
+	if version then
+		version = tonumber(version) + 1
+	else
+		version = 1
+		redis.call('hset',KEYS[1],'__blind__',1)
+	end
+	redis.call('hmset',KEYS[1],'version',version,'value',ARGV[1],'__cache_timeout__',cacheTimeout)
+	redis.call('hdel',KEYS[1],'__fresh__','__deleted__')
+	if tonumber(ARGV[3]) > 0 then
+		redis.call('hset',KEYS[1],'expire_at',ARGV[3])
+	else
+		redis.call('hdel',KEYS[1],'expire_at')
+	end
+	redis.call('PERSIST',KEYS[1])
+	redis.call('hset',KEYS[2], KEYS[1],version)
+	capture(KEYS[3],KEYS[1],version,'set')
+	notify(KEYS[1],version,false)
+	return {'err_ok',version}
+`
+
+const scriptGet string = luaTouch + luaExist + `
+	local cacheTimeout = tonumber(ARGV[1])
+	local grace = tonumber(ARGV[2])
+	local v = redis.call('hmget',KEYS[1],'version','value','__cache_timeout__','__fresh__','__deleted__','expire_at')
 	local version = v[1]
 	local value = v[2]
 	if not version then
 		return {'err_not_in_redis'}
 	else
+		--已删除或到达expire_at的数据按不存在处理
+		local alive = exist(version,v[5],v[6])
 		if not v[3] then
-			redis.call('Expire',KEYS[1],cacheTimeout)
+			if stale(v[4]) then
+				--缓存逻辑过期，只在允许时返回陈旧数据
+				if ARGV[3] ~= '1' then
+					return {'err_not_in_redis'}
+				elseif not alive then
+					return {'err_not_exist'}
+				else
+					return {'err_stale',value,tonumber(version),tonumber(v[6] or 0)}
+				end
+			end
+			touch(KEYS[1],cacheTimeout,grace)
 		end
-		
-		if tonumber(version) == 0 then
+
+		if not alive then
 			return {'err_not_exist'}
 		else
-			return {'err_ok',value,tonumber(version)}
-		end	
+			return {'err_ok',value,tonumber(version),tonumber(v[6] or 0)}
+		end
 	end
 
 `
 
-const scriptClearDirty string = `
+const scriptClearDirty string = luaTouch + `
 	local dirtyKey = KEYS[1]
 	local key = KEYS[2]
 	local version = redis.call('hget',dirtyKey,key)
@@ -90,60 +243,403 @@ const scriptClearDirty string = `
 		local cacheTimeout = redis.call('hget',key,'__cache_timeout__')
 		if cacheTimeout then
 			redis.call('hdel', key,'__cache_timeout__')
-			redis.call('Expire',key,cacheTimeout)
+			touch(key,tonumber(cacheTimeout),tonumber(ARGV[2]))
+		end
+	end
+`
+
+// 数据库返回blind数据的版本号后，按差值调整redis中的版本号
+const scriptRebase string = luaTouch + luaNotify + `
+	local v = redis.call('hmget',KEYS[1],'version','__blind__','__cache_timeout__')
+	if not v[1] or not v[2] then
+		return
+	end
+	local version = tonumber(v[1]) + tonumber(ARGV[2]) - tonumber(ARGV[1])
+	redis.call('hset',KEYS[1],'version',version)
+	redis.call('hdel',KEYS[1],'__blind__')
+	if tonumber(redis.call('hget',KEYS[2],KEYS[1])) == tonumber(ARGV[1]) then
+		redis.call('hdel',KEYS[2],KEYS[1])
+		if v[3] then
+			redis.call('hdel',KEYS[1],'__cache_timeout__')
+			touch(KEYS[1],tonumber(v[3]),tonumber(ARGV[3]))
 		end
+	else
+		redis.call('hset',KEYS[2],KEYS[1],version)
 	end
+	notify(KEYS[1],version,redis.call('hexists',KEYS[1],'__deleted__') == 1)
 `
 
-const scriptLoadGet string = `
-	local cacheTimeout = ARGV[3]
-	local v = redis.call('hmget',KEYS[1],'version','value','__cache_timeout__')
+const scriptLoadGet string = luaTouch + luaExist + `
+	local cacheTimeout = tonumber(ARGV[3])
+	local grace = tonumber(ARGV[4])
+	local v = redis.call('hmget',KEYS[1],'version','value','__cache_timeout__','__fresh__','__deleted__','expire_at')
 	local version = v[1]
 	local value = v[2]
-	if version then
+	if version and (v[3] or not stale(v[4])) then
 		if not v[3] then
-			redis.call('Expire',KEYS[1],cacheTimeout)
+			touch(KEYS[1],cacheTimeout,grace)
 		end
 
-		if tonumber(version) > 0 then
-			return {'err_ok',value,tonumber(version)}
-		else 
+		if exist(version,v[5],v[6]) then
+			return {'err_ok',value,tonumber(version),tonumber(v[6] or 0)}
+		else
 			return {'err_not_exist'}
 		end
 	else
+		--缓存逻辑过期的干净数据直接用数据库中的数据替换
+		if version then
+			redis.call('del',KEYS[1])
+		end
+
 		if tonumber(ARGV[1]) > 0 then
 			redis.call('hmset',KEYS[1],'version',ARGV[1],'value',ARGV[2])
-			redis.call('Expire',KEYS[1],cacheTimeout)
-			return {'err_ok',ARGV[2],tonumber(ARGV[1])}	
+			--数据库中的墓碑expire_at小于0，按过期处理
+			if tonumber(ARGV[5]) ~= 0 then
+				redis.call('hset',KEYS[1],'expire_at',ARGV[5])
+			end
+			touch(KEYS[1],cacheTimeout,grace)
+			if exist(ARGV[1],false,ARGV[5] ~= '0' and ARGV[5] or nil) then
+				return {'err_ok',ARGV[2],tonumber(ARGV[1]),tonumber(ARGV[5])}
+			else
+				return {'err_not_exist'}
+			end
 		else
 			redis.call('hmset',KEYS[1],'version',ARGV[1])
-			redis.call('Expire',KEYS[1],cacheTimeout)
-			return {'err_not_exist'}				
+			touch(KEYS[1],cacheTimeout,grace)
+			return {'err_not_exist'}
 		end
 	end
 `
 
-const scriptLoadSet string = `
-	local cacheTimeout = ARGV[3]
+const scriptLoadSet string = luaTouch + `
+	local cacheTimeout = tonumber(ARGV[3])
+	local grace = tonumber(ARGV[4])
 	redis.call('select',0)
-	local version = redis.call('hget',KEYS[1],'version')
-	if not version or tonumber(version) < tonumber(ARGV[1]) then
+	local v = redis.call('hmget',KEYS[1],'version','__cache_timeout__')
+	--不覆盖dirty数据
+	if not v[2] and (not v[1] or tonumber(v[1]) < tonumber(ARGV[1])) then
+		redis.call('hdel',KEYS[1],'__deleted__','expire_at')
 		redis.call('hmset',KEYS[1],'version',ARGV[1],'value',ARGV[2])
-		redis.call('Expire',KEYS[1],cacheTimeout)
+		if tonumber(ARGV[5]) ~= 0 then
+			redis.call('hset',KEYS[1],'expire_at',ARGV[5])
+		end
+		touch(KEYS[1],cacheTimeout,grace)
 	end
 `
 
+// redis恢复后，降级期间直接写入数据库的key，若redis中的数据不比数据库新则清除，
+// 比数据库新的dirty数据保留，由同步写回
+const scriptReconcile string = `
+	local v = redis.call('hmget',KEYS[1],'version','__cache_timeout__','__blind__')
+	if not v[1] then
+		return 0
+	end
+	if v[3] or (v[2] and tonumber(v[1]) > tonumber(ARGV[1])) then
+		return 0
+	end
+	redis.call('del',KEYS[1])
+	redis.call('hdel',KEYS[2],KEYS[1])
+	return 1
+`
+
+// 只在key不存在时写入
+const scriptSetNX string = luaExist + luaHistory + luaNotify + luaCapture + `
+	local cacheTimeout = ARGV[2]
+	local v = redis.call('hmget',KEYS[1],'version','__deleted__','expire_at')
+	if not v[1] then
+		return {'err_not_in_redis'}
+	end
+	if exist(v[1],v[2],v[3]) then
+		return {'err_exist'}
+	end
+	local version = tonumber(v[1]) + 1
+	redis.call('hmset',KEYS[1],'version',version,'value',ARGV[1],'__cache_timeout__',cacheTimeout)
+	redis.call('hdel',KEYS[1],'__fresh__','__deleted__','expire_at')
+	redis.call('PERSIST',KEYS[1])
+	redis.call('hset',KEYS[2],KEYS[1],version)
+	record(KEYS[3],KEYS[1],version,ARGV[1],false,0)
+	capture(KEYS[4],KEYS[1],version,'set')
+	notify(KEYS[1],version,false)
+	return {'err_ok',version}
+`
+
+// 计数器，value按整数处理，版本号和dirty标记与scriptSet一致。
+// ARGV[2],ARGV[3]为下界和上界，空字符串表示不限制
+const scriptIncrBy string = luaExist + luaHistory + luaNotify + luaCapture + `
+	local cacheTimeout = tonumber(ARGV[4])
+	local v = redis.call('hmget',KEYS[1],'version','value','__deleted__','expire_at')
+	if not v[1] then
+		return {'err_not_in_redis'}
+	end
+	local version = tonumber(v[1])
+	local n = 0
+	--与redis的INCR一致，存在的计数器保留过期时间
+	local alive = exist(version,v[3],v[4])
+	if alive then
+		--与strconv.ParseInt一致，只接受十进制整数
+		if not string.match(v[2],'^[-+]?%d+$') then
+			return {'err_not_integer'}
+		end
+		n = tonumber(v[2])
+	end
+	n = n + tonumber(ARGV[1])
+	--超过2^53-1的值不能精确表示(已保存的值超出时同样拒绝)
+	if math.abs(n) > 9007199254740991 or (alive and math.abs(tonumber(v[2])) > 9007199254740991) then
+		return {'err_out_of_range'}
+	end
+	if (ARGV[2] ~= '' and n < tonumber(ARGV[2])) or (ARGV[3] ~= '' and n > tonumber(ARGV[3])) then
+		return {'err_out_of_range'}
+	end
+	version = version + 1
+	local value = string.format('%d',n)
+	redis.call('hmset',KEYS[1],'version',version,'value',value,'__cache_timeout__',cacheTimeout)
+	redis.call('hdel',KEYS[1],'__fresh__','__deleted__')
+	if not alive then
+		redis.call('hdel',KEYS[1],'expire_at')
+	end
+	redis.call('PERSIST',KEYS[1])
+	redis.call('hset',KEYS[2],KEYS[1],version)
+	record(KEYS[3],KEYS[1],version,value,false,alive and v[4] or 0)
+	capture(KEYS[4],KEYS[1],version,'set')
+	notify(KEYS[1],version,false)
+	return {'err_ok',value,version}
+`
+
+// 删除，保留带版本号的墓碑(__deleted__)并设置dirty，由同步删除数据库中的记录。
+// ARGV[1]大于0时需要版本号一致
+const scriptDel string = luaTouch + luaExist + luaHistory + luaNotify + luaCapture + `
+	local cacheTimeout = tonumber(ARGV[2])
+	local grace = tonumber(ARGV[3])
+	local v = redis.call('hmget',KEYS[1],'version','__deleted__','__cache_timeout__','expire_at')
+	if not v[1] then
+		return {'err_not_in_redis'}
+	end
+	if not exist(v[1],v[2],v[4]) then
+		return {'err_not_exist'}
+	end
+	local version = tonumber(v[1])
+	if tonumber(ARGV[1]) > 0 and version ~= tonumber(ARGV[1]) then
+		if not v[3] then
+			touch(KEYS[1],cacheTimeout,grace)
+		end
+		return {'err_version_not_match'}
+	end
+	version = version + 1
+	redis.call('hdel',KEYS[1],'value','__fresh__','expire_at')
+	redis.call('hmset',KEYS[1],'version',version,'__deleted__',1,'__cache_timeout__',cacheTimeout)
+	redis.call('PERSIST',KEYS[1])
+	redis.call('hset',KEYS[2],KEYS[1],version)
+	record(KEYS[3],KEYS[1],version,false,true,0)
+	capture(KEYS[4],KEYS[1],version,'del')
+	notify(KEYS[1],version,true)
+	return {'err_ok',version}
+`
+
+// 多key事务：先校验所有key的版本号，全部通过后再写入。写入两个以上key时把它们的dirty标记
+// 关联为一组(与已有的组合并)，同步时整组在一个数据库事务中写回。
+// KEYS[5],KEYS[6]为历史记录和变更流的key，KEYS[7..]为操作的key，每个操作对应ARGV中的(类型,版本号,value)三项
+const scriptTxn string = luaExist + luaHistory + luaNotify + luaCapture + `
+	local cacheTimeout = tonumber(ARGV[1])
+	local n = #KEYS - 6
+	local cur = {}
+	for i = 1, n do
+		local v = redis.call('hmget',KEYS[6+i],'version','__deleted__','expire_at')
+		if not v[1] then
+			return {'err_not_in_redis',i}
+		end
+		local version = tonumber(v[1])
+		local expect = tonumber(ARGV[3*i])
+		if expect > 0 and (version ~= expect or not exist(version,v[2],v[3])) then
+			return {'err_version_not_match',i}
+		end
+		if ARGV[3*i-1] == 'del' and not exist(version,v[2],v[3]) then
+			return {'err_not_exist',i}
+		end
+		cur[i] = version
+	end
+
+	local versions = {}
+	local members = {}
+	for i = 1, n do
+		local key = KEYS[6+i]
+		local op = ARGV[3*i-1]
+		if op == 'check' then
+			versions[i] = cur[i]
+		else
+			local version = cur[i] + 1
+			if op == 'set' then
+				redis.call('hmset',key,'version',version,'value',ARGV[3*i+1],'__cache_timeout__',cacheTimeout)
+				redis.call('hdel',key,'__fresh__','__deleted__','expire_at')
+				record(KEYS[5],key,version,ARGV[3*i+1],false,0)
+				capture(KEYS[6],key,version,'set')
+				notify(key,version,false)
+			else
+				redis.call('hdel',key,'value','__fresh__','expire_at')
+				redis.call('hmset',key,'version',version,'__deleted__',1,'__cache_timeout__',cacheTimeout)
+				record(KEYS[5],key,version,false,true,0)
+				capture(KEYS[6],key,version,'del')
+				notify(key,version,true)
+			end
+			redis.call('PERSIST',key)
+			redis.call('hset',KEYS[1],key,version)
+			versions[i] = version
+			table.insert(members,key)
+		end
+	end
+
+	if #members > 1 then
+		local all = {}
+		local seen = {}
+		local function add(key)
+			if not seen[key] then
+				seen[key] = true
+				table.insert(all,key)
+			end
+		end
+		for _, key in ipairs(members) do
+			add(key)
+			local old = redis.call('hget',KEYS[2],key)
+			if old then
+				local group = redis.call('hget',KEYS[3],old)
+				if group then
+					for _, m in ipairs(cjson.decode(group)) do
+						add(m)
+					end
+					redis.call('hdel',KEYS[3],old)
+				end
+			end
+		end
+		local gid = redis.call('incr',KEYS[4])
+		for _, m in ipairs(all) do
+			redis.call('hset',KEYS[2],m,gid)
+		end
+		redis.call('hset',KEYS[3],gid,cjson.encode(all))
+	end
+	return {'err_ok',versions}
+`
+
+// 原子的读取一组key的数据，保证同步时不会读到另一个事务的一半。
+// 组成员不在KEYS中声明，集群模式下同一个事务的key在同一个slot(见Txn)，与组在同一个节点
+const scriptGroupSnapshot string = luaDeadLetter + `
+	local group = redis.call('hget',KEYS[1],ARGV[1])
+	if not group then
+		return {}
+	end
+	local result = {}
+	for _, key in ipairs(cjson.decode(group)) do
+		local v = redis.call('hmget',key,'version','value','__blind__','__deleted__','expire_at')
+		table.insert(result,{key,v[1] or false,v[2] or false,v[3] or false,v[4] or false,v[5] or false,dead(KEYS[2],key,v[1])})
+	end
+	return result
+`
+
+// 写回单个key时的快照，同时读取key所属的事务组和dead letter，保证与快照一致
+const scriptSyncSnapshot string = luaDeadLetter + `
+	local v = redis.call('hmget',KEYS[1],'version','value','__blind__','__deleted__','expire_at')
+	local group = redis.call('hget',KEYS[2],KEYS[1])
+	return {KEYS[1],v[1] or false,v[2] or false,v[3] or false,v[4] or false,v[5] or false,dead(KEYS[3],KEYS[1],v[1]),group or false}
+`
+
+// 整组写回后解除关联，已经并入其它组的key不受影响
+const scriptClearGroup string = `
+	local group = redis.call('hget',KEYS[2],ARGV[1])
+	if not group then
+		return
+	end
+	for _, key in ipairs(cjson.decode(group)) do
+		if redis.call('hget',KEYS[1],key) == ARGV[1] then
+			redis.call('hdel',KEYS[1],key)
+		end
+	end
+	redis.call('hdel',KEYS[2],ARGV[1])
+`
+
+// 修改逻辑过期时间，ARGV[1]为0时取消过期。与写入一样递增版本号并设置dirty
+const scriptExpireAt string = luaExist + luaHistory + luaNotify + luaCapture + `
+	local cacheTimeout = ARGV[2]
+	local v = redis.call('hmget',KEYS[1],'version','__deleted__','expire_at','value')
+	if not v[1] then
+		return {'err_not_in_redis'}
+	end
+	if not exist(v[1],v[2],v[3]) then
+		return {'err_not_exist'}
+	end
+	local version = tonumber(v[1]) + 1
+	if tonumber(ARGV[1]) > 0 then
+		redis.call('hset',KEYS[1],'expire_at',ARGV[1])
+	else
+		redis.call('hdel',KEYS[1],'expire_at')
+	end
+	redis.call('hmset',KEYS[1],'version',version,'__cache_timeout__',cacheTimeout)
+	redis.call('hdel',KEYS[1],'__fresh__')
+	redis.call('PERSIST',KEYS[1])
+	redis.call('hset',KEYS[2],KEYS[1],version)
+	record(KEYS[3],KEYS[1],version,v[4],false,ARGV[1])
+	capture(KEYS[4],KEYS[1],version,'expire')
+	notify(KEYS[1],version,false)
+	return {'err_ok',version}
+`
+
+// 删除缓存，dirty的key还未写回不能删除。ARGV[1]不为0时只删除该版本
+const scriptEvict string = `
+	if redis.call('hexists',KEYS[2],KEYS[1]) == 1 then
+		return {'err_dirty'}
+	end
+	if tonumber(ARGV[1]) > 0 and tonumber(redis.call('hget',KEYS[1],'version')) ~= tonumber(ARGV[1]) then
+		return {'err_version_not_match'}
+	end
+	return {'err_ok',redis.call('del',KEYS[1])}
+`
+
+// 丢弃版本号为ARGV[1]的未写回修改
+const scriptDiscard string = `
+	if tonumber(redis.call('hget',KEYS[2],KEYS[1])) ~= tonumber(ARGV[1]) then
+		return {'err_version_not_match'}
+	end
+	redis.call('hdel',KEYS[2],KEYS[1])
+	redis.call('hdel',KEYS[3],KEYS[1])
+	redis.call('del',KEYS[1])
+	return {'err_ok'}
+`
+
+// 历史记录写入数据库后从list头部删除ARGV[1]项。只有头部仍是读取的那一批时才删除，
+// 多个进程同时同步时不会删除别人还没写入的记录
+const scriptTrimHistory string = `
+	local n = tonumber(ARGV[1])
+	if redis.call('lindex',KEYS[1],0) == ARGV[2] and redis.call('lindex',KEYS[1],n-1) == ARGV[3] then
+		redis.call('ltrim',KEYS[1],n,-1)
+		return 1
+	end
+	return 0
+`
+
 var (
 	set        *script
+	setblind   *script
 	get        *script
 	loadset    *script
 	loadget    *script
 	cleardirty *script
+	rebase     *script
+	reconcile  *script
+	incrby     *script
+	setnx      *script
+	del        *script
+	txn        *script
+	groupsnap  *script
+	syncsnap   *script
+	cleargroup *script
+	expireat   *script
+	evict      *script
+	discard    *script
+	trimhist   *script
 )
 
 func InitScript() {
 	set = newScript(scriptSet)
 
+	setblind = newScript(scriptSetBlind)
+
 	get = newScript(scriptGet)
 
 	loadset = newScript(scriptLoadSet)
@@ -151,44 +647,88 @@ func InitScript() {
 	loadget = newScript(scriptLoadGet)
 
 	cleardirty = newScript(scriptClearDirty)
-}
 
-func RedisGet(ctx context.Context, c *redis.Client, key string, cacheTimeout ...int) (value string, version int, err error) {
+	rebase = newScript(scriptRebase)
+
+	reconcile = newScript(scriptReconcile)
+
+	incrby = newScript(scriptIncrBy)
+
+	setnx = newScript(scriptSetNX)
+
+	del = newScript(scriptDel)
+
+	txn = newScript(scriptTxn)
 
-	cacheTime := defaultCacheTimeout
+	groupsnap = newScript(scriptGroupSnapshot)
+
+	syncsnap = newScript(scriptSyncSnapshot)
+
+	cleargroup = newScript(scriptClearGroup)
+
+	expireat = newScript(scriptExpireAt)
+
+	evict = newScript(scriptEvict)
+
+	discard = newScript(scriptDiscard)
+
+	trimhist = newScript(scriptTrimHistory)
+}
+
+func getCacheTime(cacheTimeout []int) int {
 	if len(cacheTimeout) > 0 {
-		cacheTime = cacheTimeout[0]
+		return cacheTimeout[0]
+	}
+	return defaultCacheTimeout
+}
+
+func RedisGet(ctx context.Context, c redis.UniversalClient, key string, cacheTimeout ...int) (value string, version int, err error) {
+	value, version, _, err = redisGet(ctx, c, key, getCacheTime(cacheTimeout), 0, false)
+	return value, version, err
+}
+
+// allowStale为true时缓存逻辑过期的数据也会返回，同时返回err_stale。expireAt为数据的逻辑过期时间，0表示不过期
+func redisGet(ctx context.Context, c redis.UniversalClient, key string, cacheTime int, grace int, allowStale bool) (value string, version int, expireAt int64, err error) {
+	stale := 0
+	if allowStale {
+		stale = 1
 	}
 
 	var re any
-	if re, err = get.eval(ctx, c, []string{key}, cacheTime); err == nil {
+	if re, err = get.eval(ctx, c, []string{key}, cacheTime, grace, stale); err == nil {
 		result := re.([]any)
 		if len(result) == 1 {
 			err = errors.New(result[0].(string))
 		} else {
 			value = result[1].(string)
 			version = int(result[2].(int64))
+			expireAt = result[3].(int64)
+			if result[0].(string) == "err_stale" {
+				err = errors.New("err_stale")
+			}
 		}
 	}
-	return value, version, err
+	return value, version, expireAt, err
 }
 
-func RedisSet(ctx context.Context, c *redis.Client, key string, value string, cacheTimeout ...int) (ver int, err error) {
-	return redisSet(ctx, c, key, value, 0, cacheTimeout...)
+func RedisSet(ctx context.Context, c redis.UniversalClient, key string, value string, cacheTimeout ...int) (ver int, err error) {
+	return redisSet(ctx, c, key, value, 0, getCacheTime(cacheTimeout), 0, false, 0, recorder{})
 }
 
-func RedisSetWithVersion(ctx context.Context, c *redis.Client, key string, value string, version int, cacheTimeout ...int) (ver int, err error) {
-	return redisSet(ctx, c, key, value, version, cacheTimeout...)
+func RedisSetWithVersion(ctx context.Context, c redis.UniversalClient, key string, value string, version int, cacheTimeout ...int) (ver int, err error) {
+	return redisSet(ctx, c, key, value, version, getCacheTime(cacheTimeout), 0, false, 0, recorder{})
 }
 
-func redisSet(ctx context.Context, c *redis.Client, key string, value string, version int, cacheTimeout ...int) (ver int, err error) {
-	cacheTime := defaultCacheTimeout
-	if len(cacheTimeout) > 0 {
-		cacheTime = cacheTimeout[0]
+// mustExist为true时key不存在返回err_not_exist，expireAt为0表示不过期，history为true时记录写入的版本
+func redisSet(ctx context.Context, c redis.UniversalClient, key string, value string, version int, cacheTime int, grace int, mustExist bool, expireAt int64, rec recorder) (ver int, err error) {
+	exist := 0
+	if mustExist {
+		exist = 1
 	}
 
 	var re interface{}
-	if re, err = set.eval(ctx, c, []string{key, dirtyKey}, value, version, cacheTime); err == nil {
+	ks := keysOf(c, key)
+	if re, err = set.eval(ctx, c, append([]string{key, ks.dirty}, rec.keys(ks)...), value, version, cacheTime, grace, exist, expireAt, rec.maxLen); err == nil {
 		result := re.([]interface{})
 		if len(result) == 1 {
 			err = errors.New(result[0].(string))
@@ -199,38 +739,335 @@ func redisSet(ctx context.Context, c *redis.Client, key string, value string, ve
 	return ver, err
 }
 
-func RedisLoadGet(ctx context.Context, c *redis.Client, key string, version int, v string, cacheTimeout ...int) (value string, ver int, err error) {
-	cacheTime := defaultCacheTimeout
-	if len(cacheTimeout) > 0 {
-		cacheTime = cacheTimeout[0]
+func redisSetNX(ctx context.Context, c redis.UniversalClient, key string, value string, cacheTime int, rec recorder) (ver int, err error) {
+	var re any
+	ks := keysOf(c, key)
+	if re, err = setnx.eval(ctx, c, append([]string{key, ks.dirty}, rec.keys(ks)...), value, cacheTime, rec.maxLen); err == nil {
+		result := re.([]any)
+		if len(result) == 1 {
+			err = errors.New(result[0].(string))
+		} else {
+			ver = int(result[1].(int64))
+		}
+	}
+	return ver, err
+}
+
+func redisDel(ctx context.Context, c redis.UniversalClient, key string, version int, cacheTime int, grace int, rec recorder) (err error) {
+	var re any
+	ks := keysOf(c, key)
+	if re, err = del.eval(ctx, c, append([]string{key, ks.dirty}, rec.keys(ks)...), version, cacheTime, grace, rec.maxLen); err == nil {
+		if result := re.([]any); len(result) == 1 {
+			err = errors.New(result[0].(string))
+		}
+	}
+	return err
+}
+
+func redisSetBlind(ctx context.Context, c redis.UniversalClient, key string, value string, cacheTime int, expireAt int64, rec recorder) (ver int, err error) {
+	var re any
+	ks := keysOf(c, key)
+	if re, err = setblind.eval(ctx, c, []string{key, ks.dirty, rec.keys(ks)[1]}, value, cacheTime, expireAt, rec.maxLen); err == nil {
+		ver = int(re.([]any)[1].(int64))
 	}
+	return ver, err
+}
+
+func RedisLoadGet(ctx context.Context, c redis.UniversalClient, key string, version int, v string, cacheTimeout ...int) (value string, ver int, err error) {
+	value, ver, _, err = redisLoadGet(ctx, c, key, version, v, 0, getCacheTime(cacheTimeout), 0)
+	return value, ver, err
+}
+
+func redisLoadGet(ctx context.Context, c redis.UniversalClient, key string, version int, v string, expireAt int64, cacheTime int, grace int) (value string, ver int, exp int64, err error) {
 	var r any
-	if r, err = loadget.eval(ctx, c, []string{key}, version, v, cacheTime); err == nil {
+	if r, err = loadget.eval(ctx, c, []string{key}, version, v, cacheTime, grace, expireAt); err == nil {
 		result := r.([]any)
 		if len(result) == 1 {
 			err = errors.New(result[0].(string))
 		} else {
 			value = result[1].(string)
 			ver = int(result[2].(int64))
+			exp = result[3].(int64)
 		}
 	}
-	return value, ver, err
+	return value, ver, exp, err
 }
 
-func RedisLoadSet(ctx context.Context, c *redis.Client, key string, version int, value string, cacheTimeout ...int) (err error) {
-	cacheTime := defaultCacheTimeout
-	if len(cacheTimeout) > 0 {
-		cacheTime = cacheTimeout[0]
+func RedisLoadSet(ctx context.Context, c redis.UniversalClient, key string, version int, value string, cacheTimeout ...int) (err error) {
+	return redisLoadSet(ctx, c, key, version, value, 0, getCacheTime(cacheTimeout), 0)
+}
+
+func redisLoadSet(ctx context.Context, c redis.UniversalClient, key string, version int, value string, expireAt int64, cacheTime int, grace int) (err error) {
+	if _, err = loadset.eval(ctx, c, []string{key}, version, value, cacheTime, grace, expireAt); err == redis.Nil {
+		err = nil
 	}
-	if _, err = loadset.eval(ctx, c, []string{key}, version, value, cacheTime); err == redis.Nil {
+	return err
+}
+
+func RedisClearDirty(ctx context.Context, c redis.UniversalClient, key string, version int) (err error) {
+	return redisClearDirty(ctx, c, key, version, 0)
+}
+
+func redisClearDirty(ctx context.Context, c redis.UniversalClient, key string, version int, grace int) (err error) {
+	if _, err = cleardirty.eval(ctx, c, []string{keysOf(c, key).dirty, key}, version, grace); err == redis.Nil {
+		err = nil
+	}
+	return err
+}
+
+func redisRebase(ctx context.Context, c redis.UniversalClient, key string, version int, dbversion int, grace int) (err error) {
+	if _, err = rebase.eval(ctx, c, []string{key, keysOf(c, key).dirty}, version, dbversion, grace); err == redis.Nil {
 		err = nil
 	}
 	return err
 }
 
-func RedisClearDirty(ctx context.Context, c *redis.Client, key string, version int) (err error) {
-	if _, err = cleardirty.eval(ctx, c, []string{dirtyKey, key}, version); err == redis.Nil {
+// 以pipeline方式批量执行loadset，已缓存的更新版本不会被覆盖
+func redisLoadSetPipeline(ctx context.Context, c redis.UniversalClient, rows []row, cacheTime func(key string) int, grace int) (err error) {
+	if err = loadset.load(ctx, c); err != nil {
+		return err
+	}
+
+	pipe := c.Pipeline()
+	for _, r := range rows {
+		pipe.EvalSha(ctx, loadset.sha, []string{r.key}, r.version, r.value, cacheTime(r.key), grace, r.expireAt)
+	}
+
+	cmds, _ := pipe.Exec(ctx)
+	for _, cmd := range cmds {
+		if err = cmd.Err(); err != nil && err != redis.Nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 以pipeline方式批量删除缓存，返回因为dirty未能删除的key
+func redisEvictPipeline(ctx context.Context, c redis.UniversalClient, keys []string) (dirty []string, err error) {
+	if err = evict.load(ctx, c); err != nil {
+		return nil, err
+	}
+
+	pipe := c.Pipeline()
+	cmds := make([]*redis.Cmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.EvalSha(ctx, evict.sha, []string{key, keysOf(c, key).dirty}, 0)
+	}
+	pipe.Exec(ctx)
+	for i, cmd := range cmds {
+		re, err := cmd.Result()
+		if err != nil {
+			return nil, err
+		}
+		if result := re.([]any); len(result) == 1 {
+			dirty = append(dirty, keys[i])
+		}
+	}
+	return dirty, nil
+}
+
+// redis中缓存的一条数据，只读取不续期
+type cachedRow struct {
+	row
+	deleted bool
+	dirty   bool
+	blind   bool
+}
+
+func (r cachedRow) alive(now int64) bool {
+	return r.version > 0 && !r.deleted && (r.expireAt == 0 || r.expireAt > now)
+}
+
+// 以pipeline方式批量读取，不在redis中的key不返回
+func redisPeekPipeline(ctx context.Context, c redis.UniversalClient, keys []string) (rows map[string]cachedRow, err error) {
+	pipe := c.Pipeline()
+	cmds := make([]*redis.SliceCmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.HMGet(ctx, key, "version", "value", "__deleted__", "expire_at", "__cache_timeout__", "__blind__")
+	}
+	if _, err = pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	rows = map[string]cachedRow{}
+	for i, cmd := range cmds {
+		v := cmd.Val()
+		if v[0] == nil {
+			continue
+		}
+		r := cachedRow{row: row{key: keys[i]}}
+		r.version, _ = strconv.Atoi(v[0].(string))
+		r.value, _ = v[1].(string)
+		r.deleted = v[2] != nil
+		if v[3] != nil {
+			r.expireAt, _ = strconv.ParseInt(v[3].(string), 10, 64)
+		}
+		r.dirty = v[4] != nil
+		r.blind = v[5] != nil
+		rows[keys[i]] = r
+	}
+	return rows, nil
+}
+
+func redisReconcile(ctx context.Context, c redis.UniversalClient, key string, dbversion int) (err error) {
+	_, err = reconcile.eval(ctx, c, []string{key, keysOf(c, key).dirty}, dbversion)
+	return err
+}
+
+func redisIncrBy(ctx context.Context, c redis.UniversalClient, key string, delta int64, bounds Bounds, cacheTime int, rec recorder) (value int64, ver int, err error) {
+	min, max := "", ""
+	if bounds.HasMin {
+		min = strconv.FormatInt(bounds.Min, 10)
+	}
+	if bounds.HasMax {
+		max = strconv.FormatInt(bounds.Max, 10)
+	}
+
+	var re any
+	ks := keysOf(c, key)
+	if re, err = incrby.eval(ctx, c, append([]string{key, ks.dirty}, rec.keys(ks)...), delta, min, max, cacheTime, rec.maxLen); err == nil {
+		result := re.([]any)
+		if len(result) == 1 {
+			err = errors.New(result[0].(string))
+		} else {
+			value, _ = strconv.ParseInt(result[1].(string), 10, 64)
+			ver = int(result[2].(int64))
+		}
+	}
+	return value, ver, err
+}
+
+// 返回出错的操作序号(从0开始)。集群模式下ops中的key需要在同一个slot
+func redisTxn(ctx context.Context, c redis.UniversalClient, ops []Op, cacheTime int, rec recorder) (versions []int, index int, err error) {
+	ks := keysOf(c, ops[0].Key)
+	keys := append([]string{ks.dirty, ks.dirtyGroup, ks.groups, ks.groupSeq}, rec.keys(ks)...)
+	args := []any{cacheTime}
+	for _, op := range ops {
+		keys = append(keys, op.Key)
+		args = append(args, op.Type.String(), op.Version, op.Value)
+	}
+	args = append(args, rec.maxLen)
+
+	var re any
+	if re, err = txn.eval(ctx, c, keys, args...); err == nil {
+		result := re.([]any)
+		if result[0].(string) != "err_ok" {
+			return nil, int(result[1].(int64)) - 1, errors.New(result[0].(string))
+		}
+		for _, v := range result[1].([]any) {
+			versions = append(versions, int(v.(int64)))
+		}
+	}
+	return versions, 0, err
+}
+
+type groupMember struct {
+	key      string
+	version  int
+	value    string
+	blind    bool
+	deleted  bool
+	expireAt int64
+	dead     bool //当前版本在dead letter中
+}
+
+// v为{key,version,value,blind,deleted,expire_at,dead}，key不在redis中时返回false
+func parseGroupMember(v []any) (m groupMember, ok bool) {
+	//lua中的false转换为nil
+	if len(v) < 2 || v[1] == nil {
+		return m, false
+	}
+	m.key = v[0].(string)
+	m.version, _ = strconv.Atoi(v[1].(string))
+	if len(v) > 2 && v[2] != nil {
+		m.value = v[2].(string)
+	}
+	m.blind = len(v) > 3 && v[3] != nil
+	m.deleted = len(v) > 4 && v[4] != nil
+	if len(v) > 5 && v[5] != nil {
+		m.expireAt, _ = strconv.ParseInt(v[5].(string), 10, 64)
+	}
+	m.dead = len(v) > 6 && v[6] != nil
+	return m, true
+}
+
+// gid为key所属的事务组，不属于任何组时为空
+func redisSyncSnapshot(ctx context.Context, c redis.UniversalClient, key string) (m groupMember, gid string, ok bool, err error) {
+	var re any
+	ks := keysOf(c, key)
+	if re, err = syncsnap.eval(ctx, c, []string{key, ks.dirtyGroup, ks.deadLetter}); err != nil {
+		return m, gid, false, err
+	}
+	v := re.([]any)
+	m, ok = parseGroupMember(v)
+	if len(v) > 7 && v[7] != nil {
+		gid = v[7].(string)
+	}
+	return m, gid, ok, nil
+}
+
+// gid只在ks所在的slot中唯一
+func redisGroupSnapshot(ctx context.Context, c redis.UniversalClient, ks slotKeys, gid string) (members []groupMember, err error) {
+	var re any
+	if re, err = groupsnap.eval(ctx, c, []string{ks.groups, ks.deadLetter}, gid); err != nil {
+		return nil, err
+	}
+	for _, r := range re.([]any) {
+		if m, ok := parseGroupMember(r.([]any)); ok {
+			members = append(members, m)
+		}
+	}
+	return members, nil
+}
+
+// 返回是否删除了缓存
+func redisEvict(ctx context.Context, c redis.UniversalClient, key string, version int) (evicted bool, err error) {
+	var re any
+	if re, err = evict.eval(ctx, c, []string{key, keysOf(c, key).dirty}, version); err == nil {
+		result := re.([]any)
+		if len(result) == 1 {
+			err = errors.New(result[0].(string))
+		} else {
+			evicted = result[1].(int64) > 0
+		}
+	}
+	return evicted, err
+}
+
+func redisDiscard(ctx context.Context, c redis.UniversalClient, key string, version int) (err error) {
+	var re any
+	ks := keysOf(c, key)
+	if re, err = discard.eval(ctx, c, []string{key, ks.dirty, ks.dirtyGroup}, version); err == nil {
+		if result := re.([]any); result[0].(string) != "err_ok" {
+			err = errors.New(result[0].(string))
+		}
+	}
+	return err
+}
+
+func redisClearGroup(ctx context.Context, c redis.UniversalClient, ks slotKeys, gid string) (err error) {
+	if _, err = cleargroup.eval(ctx, c, []string{ks.dirtyGroup, ks.groups}, gid); err == redis.Nil {
 		err = nil
 	}
 	return err
 }
+
+func redisExpireAt(ctx context.Context, c redis.UniversalClient, key string, expireAt int64, cacheTime int, rec recorder) (ver int, err error) {
+	var re any
+	ks := keysOf(c, key)
+	if re, err = expireat.eval(ctx, c, append([]string{key, ks.dirty}, rec.keys(ks)...), expireAt, cacheTime, rec.maxLen); err == nil {
+		result := re.([]any)
+		if len(result) == 1 {
+			err = errors.New(result[0].(string))
+		} else {
+			ver = int(result[1].(int64))
+		}
+	}
+	return ver, err
+}
+
+// items为从list头部读取的记录
+func redisTrimHistory(ctx context.Context, c redis.UniversalClient, list string, items []string) (err error) {
+	_, err = trimhist.eval(ctx, c, []string{list}, len(items), items[0], items[len(items)-1])
+	return err
+}
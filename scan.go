@@ -0,0 +1,198 @@
+package rcache
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+)
+
+type ScanItem struct {
+	Key     string
+	Value   string
+	Version int
+}
+
+// 转义redis match中的通配符
+func globPrefix(prefix string) string {
+	return strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`).Replace(prefix) + "*"
+}
+
+// 按key顺序列出前缀为prefix的key，cursor为上一页返回的next，第一页传入空字符串。
+// 每页从pgsql分页读取，再用redis中更新的版本(包括未同步的dirty数据和还不在数据库中的key)覆盖，
+// 已删除和已过期的key不返回。next为空字符串时表示已经读完。
+// 每次调用都要读取一遍dirty key(集群模式下还要检查所有slot)，遍历所有的key时使用ScanAll
+func (p *DataProxy) Scan(ctx context.Context, prefix string, cursor string, limit int) (items []ScanItem, next string, err error) {
+	dirty, err := p.dirtySnapshot(ctx, prefix)
+	if err != nil {
+		return nil, "", err
+	}
+	return p.scanPage(ctx, prefix, cursor, limit, dirty)
+}
+
+// 按key顺序遍历前缀为prefix的所有key，每页limit个，对每页调用fn，fn返回错误时停止。
+// dirty key只在开始时读取一次，遍历期间新创建且还未同步的key不会返回
+func (p *DataProxy) ScanAll(ctx context.Context, prefix string, limit int, fn func(items []ScanItem) error) error {
+	dirty, err := p.dirtySnapshot(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	for cursor := ""; ; {
+		items, next, err := p.scanPage(ctx, prefix, cursor, limit, dirty)
+		if err != nil {
+			return err
+		}
+		if len(items) > 0 {
+			if err = fn(items); err != nil {
+				return err
+			}
+		}
+		if cursor = next; cursor == "" {
+			return nil
+		}
+	}
+}
+
+// 按key排序的dirty key，为nil时不合并redis中的数据(redis熔断)
+type dirtyKeys []string
+
+func (p *DataProxy) dirtySnapshot(ctx context.Context, prefix string) (dirty dirtyKeys, err error) {
+	if !p.redisAllow() {
+		return nil, nil
+	}
+	keys, err := p.dirtyKeysWithPrefix(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	if keys == nil {
+		return dirtyKeys{}, nil
+	}
+	return keys, nil
+}
+
+// (after,last]范围内的key，all为true时不限制上界
+func (d dirtyKeys) between(after string, last string, all bool) []string {
+	i := sort.Search(len(d), func(i int) bool { return d[i] > after })
+	j := len(d)
+	if !all {
+		j = sort.Search(len(d), func(i int) bool { return d[i] > last })
+	}
+	if j <= i {
+		return nil
+	}
+	return d[i:j]
+}
+
+func (p *DataProxy) scanPage(ctx context.Context, prefix string, cursor string, limit int, dirtyAll dirtyKeys) (items []ScanItem, next string, err error) {
+	if limit <= 0 {
+		limit = 100
+	}
+
+	var cond string
+	var args []any
+	if prefix != "" {
+		cond = `key like $1 escape '\'`
+		args = []any{likePrefix(prefix)}
+	}
+
+	rows, err := queryRowsAfter(ctx, p.dbc, cond, args, cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	//数据库已经读完时，本页包含cursor之后所有的dirty key
+	exhausted := len(rows) < limit
+	var last string
+	if !exhausted {
+		last = rows[len(rows)-1].key
+	}
+
+	merged := map[string]cachedRow{}
+	for _, r := range rows {
+		merged[r.key] = cachedRow{row: r}
+	}
+
+	if dirtyAll != nil {
+		dirty := dirtyAll.between(cursor, last, exhausted)
+		keys := make([]string, 0, len(rows)+len(dirty))
+		for _, r := range rows {
+			keys = append(keys, r.key)
+		}
+		for _, key := range dirty {
+			if _, ok := merged[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+
+		var cached map[string]cachedRow
+		cached, err = redisPeekPipeline(ctx, p.redisC, keys)
+		p.redisDone(err)
+		if err != nil {
+			return nil, "", err
+		}
+
+		for key, c := range cached {
+			db, ok := merged[key]
+			//dirty数据(包括降级期间写入的数据)比数据库新，干净数据按版本号比较
+			if !ok || c.dirty || c.version >= db.version {
+				merged[key] = c
+			}
+		}
+	}
+
+	now := time.Now().Unix()
+	keys := make([]string, 0, len(merged))
+	for key, r := range merged {
+		if r.alive(now) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	if len(keys) > limit {
+		keys = keys[:limit]
+		exhausted = false
+		last = keys[len(keys)-1]
+	}
+
+	for _, key := range keys {
+		r := merged[key]
+		var value string
+		if value, err = p.decodeValue(ctx, key, r.value, nil); err != nil {
+			return nil, "", err
+		}
+		items = append(items, ScanItem{Key: key, Value: value, Version: r.version})
+	}
+
+	if exhausted {
+		return items, "", nil
+	}
+	return items, last, nil
+}
+
+// 返回前缀为prefix的dirty key，没有排序
+func (p *DataProxy) dirtyKeysWithPrefix(ctx context.Context, prefix string) (keys []string, err error) {
+	slots, err := p.slots(ctx, func(ks slotKeys) string { return ks.dirty })
+	if err != nil {
+		p.redisDone(err)
+		return nil, err
+	}
+	for _, slot := range slots {
+		for cursor := uint64(0); ; {
+			var kvs []string
+			cc, cancel := context.WithTimeout(ctx, time.Second)
+			kvs, cursor, err = p.redisC.HScan(cc, p.slotKeys(slot).dirty, cursor, globPrefix(prefix), 500).Result()
+			if err = p.checkError(cc, cancel, err); err != nil {
+				p.redisDone(err)
+				return nil, err
+			}
+			for i := 0; i < len(kvs); i = i + 2 {
+				keys = append(keys, kvs[i])
+			}
+			if cursor == 0 {
+				break
+			}
+		}
+	}
+	return keys, nil
+}
@@ -3,8 +3,14 @@ package rcache
 import (
 	"context"
 	dbsql "database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 )
 
 /*
@@ -18,36 +24,145 @@ CREATE TABLE public.kv (
 	"key" varchar NOT NULL,
 	value varchar NOT NULL,
 	"version" int4 NOT NULL,
+	expire_at int8 NULL,
 	CONSTRAINT kv_pk PRIMARY KEY (key)
 );
+
+-- expire_at小于0的记录为删除后保留的墓碑，由ReapExpired在保留时间之后删除
+CREATE INDEX kv_expire_at_idx ON public.kv (expire_at) WHERE expire_at IS NOT NULL;
+
+-- 已有的表
+-- ALTER TABLE public.kv ADD COLUMN expire_at int8 NULL;
+
+-- 历史记录(WithHistory)，通过redis写入的每个版本在同步时写入，
+-- 直接写入数据库的版本由触发器记录
+CREATE TABLE public.kv_history (
+	"key" varchar NOT NULL,
+	"version" int4 NOT NULL,
+	value varchar NULL,
+	deleted bool NOT NULL DEFAULT false,
+	expire_at int8 NULL,
+	created_at timestamptz NOT NULL DEFAULT now(),
+	CONSTRAINT kv_history_pk PRIMARY KEY (key, version)
+);
+
+-- 删除是把记录改成墓碑(expire_at小于0)，记为deleted。ReapExpired把过期记录转为墓碑时版本号不变，
+-- 不会重复记录；清理墓碑时的DELETE也不记录，直接DELETE有效的记录时按下一个版本记为删除
+CREATE OR REPLACE FUNCTION public.kv_history_capture() RETURNS trigger AS $$
+BEGIN
+	IF TG_OP = 'DELETE' THEN
+		IF OLD.expire_at IS NULL OR OLD.expire_at >= 0 THEN
+			INSERT INTO kv_history("key","version",deleted) VALUES (OLD.key,OLD.version+1,true) ON CONFLICT DO NOTHING;
+		END IF;
+	ELSIF NEW.expire_at < 0 THEN
+		INSERT INTO kv_history("key","version",value,deleted,expire_at) VALUES (NEW.key,NEW.version,NULL,true,NULL) ON CONFLICT DO NOTHING;
+	ELSE
+		INSERT INTO kv_history("key","version",value,expire_at) VALUES (NEW.key,NEW.version,NEW.value,NEW.expire_at) ON CONFLICT DO NOTHING;
+	END IF;
+	RETURN NULL;
+END $$ LANGUAGE plpgsql;
+
+CREATE TRIGGER kv_history_trg AFTER INSERT OR UPDATE OR DELETE ON public.kv FOR EACH ROW EXECUTE FUNCTION public.kv_history_capture();
+
+-- 已有的触发器，执行上面的CREATE OR REPLACE FUNCTION之后
+-- DROP TRIGGER kv_history_trg ON public.kv;
+-- CREATE TRIGGER kv_history_trg AFTER INSERT OR UPDATE OR DELETE ON public.kv FOR EACH ROW EXECUTE FUNCTION public.kv_history_capture();
+
+-- 外部修改通知(ListenInvalidations)，rcache自己的写入带有rcacheMark标记，不发送通知
+CREATE FUNCTION public.kv_notify() RETURNS trigger AS $$
+BEGIN
+	IF position('/*rcache' in current_query()) > 0 THEN
+		RETURN NULL;
+	END IF;
+	IF TG_OP = 'DELETE' THEN
+		PERFORM pg_notify('rcache_kv', json_build_object('key',OLD.key,'version',OLD.version,'op','delete')::text);
+	ELSE
+		PERFORM pg_notify('rcache_kv', json_build_object('key',NEW.key,'version',NEW.version,'op',lower(TG_OP))::text);
+	END IF;
+	RETURN NULL;
+END $$ LANGUAGE plpgsql;
+
+CREATE TRIGGER kv_notify_trg AFTER INSERT OR UPDATE OR DELETE ON public.kv FOR EACH ROW EXECUTE FUNCTION public.kv_notify();
+
+-- 保存二进制value(SetBytes)时value使用bytea，kv_history.value的类型需要与kv一致。
+-- 代码不区分两种表结构，varchar不能保存NUL字节和非法的UTF-8
+CREATE TABLE public.kv (
+	"key" varchar NOT NULL,
+	value bytea NOT NULL,
+	"version" int4 NOT NULL,
+	expire_at int8 NULL,
+	CONSTRAINT kv_pk PRIMARY KEY (key)
+);
+
+-- 按key分页(Scan、Reencrypt等)使用字节序，与redis中的dirty key排序一致
+CREATE INDEX kv_key_c_idx ON public.kv (key COLLATE "C");
+
+-- 已有的表
+-- ALTER TABLE public.kv ALTER COLUMN value TYPE bytea USING convert_to(value, 'UTF8');
+-- ALTER TABLE public.kv_history ALTER COLUMN value TYPE bytea USING convert_to(value, 'UTF8');
 */
 
-func queryRow(ctx context.Context, dbc *sqlx.DB, key string) (version int, value string, err error) {
-	err = dbc.QueryRowContext(ctx, "select version,value from kv where key = $1", key).Scan(&version, &value)
-	return version, value, err
+// rcache对kv的写入语句带有这个标记，kv_notify触发器据此忽略rcache自己的写入，只通知外部的修改
+const rcacheMark = "/*rcache*/ "
+
+// expire_at为逻辑过期时间(unix秒)，NULL表示不过期。到期的记录按不存在处理，由ReapExpired转为墓碑
+const notExpired = "(expire_at is null or expire_at > extract(epoch from now()))"
+
+// 删除的记录保留为墓碑：value清空，expire_at为删除时间的相反数，按已过期处理。
+// 墓碑保留版本号，之后的写入从它继续递增，删除前的版本号不会再次出现，旧版本号的CAS也不会成功
+const tombstoneExpire = "-extract(epoch from now())::int8"
+
+// expireAt为0时写入NULL
+func nullExpire(expireAt int64) any {
+	if expireAt > 0 {
+		return expireAt
+	}
+	return nil
 }
 
-func updateRowPgsql(ctx context.Context, dbc *sqlx.DB, key string, value string, verison int) (ver int, err error) {
-	const str = `UPDATE kv SET value = $2,version = kv.version+1 where kv.key = $1 and kv.version = $3;`
-	_, err = dbc.ExecContext(ctx, str, key, value, verison)
-	if err != nil {
+// *sqlx.DB和*sqlx.Tx都实现了execer，写回同一组数据时在事务中执行
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (dbsql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *dbsql.Row
+}
+
+// 已过期但还没有删除的记录也会返回，由调用方根据expireAt判断(redis中由exist判断)。
+// 加载到redis时需要保留其版本号，否则之后的写入从版本号1开始，写回时因kv.version < $3不成立而丢失
+func queryRow(ctx context.Context, dbc execer, key string) (version int, value string, expireAt int64, err error) {
+	var exp dbsql.NullInt64
+	err = dbc.QueryRowContext(ctx, "select version,value,expire_at from kv where key = $1", key).Scan(&version, &value, &exp)
+	return version, value, exp.Int64, err
+}
+
+// 墓碑的expireAt小于0，同样按已过期处理
+func expired(expireAt int64) bool {
+	return expireAt != 0 && expireAt <= time.Now().Unix()
+}
+
+func updateRowPgsql(ctx context.Context, dbc *sqlx.DB, key string, value string, verison int, expireAt int64) (ver int, err error) {
+	const str = rcacheMark + `UPDATE kv SET value = $2,version = kv.version+1,expire_at = $4 where kv.key = $1 and kv.version = $3 and ` + notExpired + `;`
+	var r dbsql.Result
+	if r, err = dbc.ExecContext(ctx, str, key, value, verison, nullExpire(expireAt)); err != nil {
 		return ver, err
 	}
+	if n, _ := r.RowsAffected(); n == 0 {
+		return ver, errors.New("err_version_not_match")
+	}
 	ver = verison + 1
 	return ver, err
 }
 
-func insertUpdateRowPgsql(ctx context.Context, dbc *sqlx.DB, key string, value string) (version int, err error) {
+func insertUpdateRowPgsql(ctx context.Context, dbc *sqlx.DB, key string, value string, expireAt int64) (version int, err error) {
 	var tx *dbsql.Tx
 	tx, err = dbc.BeginTx(ctx, &dbsql.TxOptions{Isolation: dbsql.LevelReadCommitted})
 	if nil != err {
 		return version, err
 	}
 
-	const str = `insert into kv("key","value","version") values($1,$2,$3) ON conflict(key) DO UPDATE SET 
-		value = $2,version = kv.version+1 where kv.key = $1;`
+	const str = rcacheMark + `insert into kv("key","value","version","expire_at") values($1,$2,$3,$4) ON conflict(key) DO UPDATE SET 
+		value = $2,version = kv.version+1,expire_at = $4 where kv.key = $1;`
 
-	_, err = tx.ExecContext(ctx, str, key, value, 1)
+	_, err = tx.ExecContext(ctx, str, key, value, 1, nullExpire(expireAt))
 
 	if err != nil {
 		if rollbackErr := tx.Rollback(); rollbackErr != nil {
@@ -70,9 +185,272 @@ func insertUpdateRowPgsql(ctx context.Context, dbc *sqlx.DB, key string, value s
 	return version, err
 }
 
-func writebackPgsql(ctx context.Context, dbc *sqlx.DB, key string, value string, version int) (err error) {
-	const str = `insert into kv("key","value","version") values($1,$2,$3) ON conflict(key) DO UPDATE SET 
-	value = $2,version = $3 where kv.key = $1 and kv.version < $3;`
-	_, err = dbc.ExecContext(ctx, str, key, value, version)
+// 只在key不存在时插入，已过期的记录和墓碑直接覆盖
+func insertRowPgsql(ctx context.Context, dbc *sqlx.DB, key string, value string) (ver int, err error) {
+	const str = rcacheMark + `insert into kv("key","value","version") values($1,$2,1) ON conflict(key) DO UPDATE SET 
+	value = $2,version = kv.version+1,expire_at = null where kv.key = $1 and kv.expire_at <= extract(epoch from now()) returning version;`
+	if err = dbc.QueryRowContext(ctx, str, key, value).Scan(&ver); err == dbsql.ErrNoRows {
+		err = errors.New("err_exist")
+	}
+	return ver, err
+}
+
+// 只更新已存在的key
+func updateExistRowPgsql(ctx context.Context, dbc *sqlx.DB, key string, value string) (ver int, err error) {
+	const str = rcacheMark + `UPDATE kv SET value = $2,version = kv.version+1,expire_at = null where kv.key = $1 and ` + notExpired + ` returning version;`
+	if err = dbc.QueryRowContext(ctx, str, key, value).Scan(&ver); err == dbsql.ErrNoRows {
+		err = errors.New("err_not_exist")
+	}
+	return ver, err
+}
+
+// version为0时不校验版本号，返回墓碑的版本号
+func deleteRowPgsql(ctx context.Context, dbc execer, key string, version int) (ver int, err error) {
+	str := rcacheMark + `UPDATE kv SET value = '',version = kv.version+1,expire_at = ` + tombstoneExpire + ` where kv.key = $1 and ` + notExpired
+	args := []any{key}
+	if version > 0 {
+		str += " and kv.version = $2"
+		args = append(args, version)
+	}
+	if err = dbc.QueryRowContext(ctx, str+" returning version;", args...).Scan(&ver); err != dbsql.ErrNoRows {
+		return ver, err
+	}
+
+	if version > 0 {
+		var expireAt int64
+		if _, _, expireAt, err = queryRow(ctx, dbc, key); err == nil && !expired(expireAt) {
+			return ver, errors.New("err_version_not_match")
+		} else if err != nil && err != dbsql.ErrNoRows {
+			return ver, err
+		}
+	}
+	return ver, errors.New("err_not_exist")
+}
+
+// 同步墓碑，只覆盖版本号更小的记录，数据库中没有记录时也写入墓碑
+func writebackDeletePgsql(ctx context.Context, dbc execer, key string, version int) (err error) {
+	const str = rcacheMark + `insert into kv("key","value","version","expire_at") values($1,'',$2,` + tombstoneExpire + `) ON conflict(key) DO UPDATE SET 
+	value = '',version = $2,expire_at = ` + tombstoneExpire + ` where kv.key = $1 and kv.version < $2;`
+	_, err = dbc.ExecContext(ctx, str, key, version)
 	return err
 }
+
+func writebackPgsql(ctx context.Context, dbc execer, key string, value string, version int, expireAt int64) (err error) {
+	const str = rcacheMark + `insert into kv("key","value","version","expire_at") values($1,$2,$3,$4) ON conflict(key) DO UPDATE SET 
+	value = $2,version = $3,expire_at = $4 where kv.key = $1 and kv.version < $3;`
+	_, err = dbc.ExecContext(ctx, str, key, value, version, nullExpire(expireAt))
+	return err
+}
+
+// 只修改未过期记录的过期时间
+func expireRowPgsql(ctx context.Context, dbc *sqlx.DB, key string, expireAt int64) (ver int, err error) {
+	const str = rcacheMark + `UPDATE kv SET version = kv.version+1,expire_at = $2 where kv.key = $1 and ` + notExpired + ` returning version;`
+	if err = dbc.QueryRowContext(ctx, str, key, nullExpire(expireAt)).Scan(&ver); err == dbsql.ErrNoRows {
+		err = errors.New("err_not_exist")
+	}
+	return ver, err
+}
+
+// 把至多limit条已过期的记录转为墓碑(版本号不变)，并删除至多limit条删除时间早于before的墓碑，
+// 被其它事务锁定的记录留到下一批
+func reapExpiredPgsql(ctx context.Context, dbc *sqlx.DB, limit int, before int64) (expiredN int, purged int, err error) {
+	const expire = rcacheMark + `UPDATE kv SET value = '',expire_at = ` + tombstoneExpire + ` where key in (select key from kv 
+	where expire_at > 0 and expire_at <= extract(epoch from now()) limit $1 for update skip locked) and expire_at > 0 and expire_at <= extract(epoch from now());`
+	const purge = rcacheMark + `delete from kv where key in (select key from kv where expire_at < 0 and expire_at >= $2 
+	limit $1 for update skip locked) and expire_at < 0 and expire_at >= $2;`
+	var r dbsql.Result
+	if r, err = dbc.ExecContext(ctx, expire, limit); err != nil {
+		return expiredN, purged, err
+	}
+	affected, _ := r.RowsAffected()
+	expiredN = int(affected)
+	if r, err = dbc.ExecContext(ctx, purge, limit, -before); err != nil {
+		return expiredN, purged, err
+	}
+	affected, _ = r.RowsAffected()
+	return expiredN, int(affected), nil
+}
+
+type row struct {
+	key      string
+	value    string
+	version  int
+	expireAt int64
+}
+
+// 按key的字节序分页读取，cond为附加的where条件，args为cond使用的参数($1..$n)。
+// 数据库的排序规则(如en_US)与Go的字符串比较不同，合并redis中的dirty key时会遗漏或重复，所以使用COLLATE "C"
+func queryRowsAfter(ctx context.Context, dbc *sqlx.DB, cond string, args []any, after string, limit int) (rows []row, err error) {
+	str := fmt.Sprintf(`select key,value,version,expire_at from kv where key COLLATE "C" > $%d and `+notExpired, len(args)+1)
+	if cond != "" {
+		str += " and (" + cond + ")"
+	}
+	str += fmt.Sprintf(` order by key COLLATE "C" limit $%d`, len(args)+2)
+
+	params := make([]any, 0, len(args)+2)
+	params = append(params, args...)
+	params = append(params, after, limit)
+
+	var rs *dbsql.Rows
+	if rs, err = dbc.QueryContext(ctx, str, params...); err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+
+	for rs.Next() {
+		var r row
+		var exp dbsql.NullInt64
+		if err = rs.Scan(&r.key, &r.value, &r.version, &exp); err != nil {
+			return nil, err
+		}
+		r.expireAt = exp.Int64
+		rows = append(rows, r)
+	}
+	return rows, rs.Err()
+}
+
+// 转义like中的通配符
+func likePrefix(prefix string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(prefix) + "%"
+}
+
+// 写入降级期间产生的数据，返回的版本号不小于redis中的版本号
+func upsertBlindPgsql(ctx context.Context, dbc execer, key string, value string, version int, expireAt int64) (ver int, err error) {
+	const str = rcacheMark + `insert into kv("key","value","version","expire_at") values($1,$2,$3,$4) ON conflict(key) DO UPDATE SET 
+	value = $2,version = greatest(kv.version+1,$3),expire_at = $4 where kv.key = $1 returning version;`
+	err = dbc.QueryRowContext(ctx, str, key, value, version, nullExpire(expireAt)).Scan(&ver)
+	return ver, err
+}
+
+// 降级期间的删除，与upsertBlindPgsql一致，返回墓碑的版本号
+func deleteBlindPgsql(ctx context.Context, dbc execer, key string, version int) (ver int, err error) {
+	const str = rcacheMark + `insert into kv("key","value","version","expire_at") values($1,'',$2,` + tombstoneExpire + `) ON conflict(key) DO UPDATE SET 
+	value = '',version = greatest(kv.version+1,$2),expire_at = ` + tombstoneExpire + ` where kv.key = $1 returning version;`
+	err = dbc.QueryRowContext(ctx, str, key, version).Scan(&ver)
+	return ver, err
+}
+
+// redis不可用时直接在数据库中执行计数
+func incrRowPgsql(ctx context.Context, dbc *sqlx.DB, key string, delta int64, bounds Bounds) (value int64, ver int, err error) {
+	var tx *dbsql.Tx
+	if tx, err = dbc.BeginTx(ctx, &dbsql.TxOptions{Isolation: dbsql.LevelReadCommitted}); err != nil {
+		return value, ver, err
+	}
+	defer tx.Rollback()
+
+	var str string
+	var exp dbsql.NullInt64
+	err = tx.QueryRowContext(ctx, "select value,version,expire_at from kv where key = $1 for update", key).Scan(&str, &ver, &exp)
+	if err == nil && exp.Valid && exp.Int64 <= time.Now().Unix() {
+		//已过期的计数器和墓碑从0开始
+		str = "0"
+	}
+	if err == nil {
+		if value, err = strconv.ParseInt(str, 10, 64); errors.Is(err, strconv.ErrRange) {
+			return value, ver, errors.New("err_out_of_range")
+		} else if err != nil {
+			return value, ver, errors.New("err_not_integer")
+		}
+	} else if err != dbsql.ErrNoRows {
+		return value, ver, err
+	}
+
+	//与redis中的计算一致
+	value += delta
+	if value > maxCounter || value < -maxCounter || (bounds.HasMin && value < bounds.Min) || (bounds.HasMax && value > bounds.Max) {
+		return value, ver, errors.New("err_out_of_range")
+	}
+
+	const upsert = rcacheMark + `insert into kv("key","value","version") values($1,$2,1) ON conflict(key) DO UPDATE SET 
+	value = $2,version = kv.version+1,expire_at = case when kv.expire_at <= extract(epoch from now()) then null else kv.expire_at end 
+	where kv.key = $1 returning version;`
+	if err = tx.QueryRowContext(ctx, upsert, key, strconv.FormatInt(value, 10)).Scan(&ver); err != nil {
+		return value, ver, err
+	}
+
+	err = tx.Commit()
+	return value, ver, err
+}
+
+type historyRow struct {
+	key       string
+	version   int
+	value     dbsql.NullString
+	deleted   bool
+	expireAt  int64
+	createdAt int64
+}
+
+// 同一个版本只记录一次，先写入的为准
+func insertHistoryPgsql(ctx context.Context, dbc execer, h historyRow) (err error) {
+	const str = `insert into kv_history("key","version",value,deleted,expire_at,created_at) values($1,$2,$3,$4,$5,to_timestamp($6)) 
+	ON conflict(key,version) DO NOTHING;`
+	_, err = dbc.ExecContext(ctx, str, h.key, h.version, h.value, h.deleted, nullExpire(h.expireAt), h.createdAt)
+	return err
+}
+
+// 只保留最近的keep个版本
+func pruneHistoryPgsql(ctx context.Context, dbc execer, key string, keep int) (err error) {
+	const str = `delete from kv_history where key = $1 and version <= (select max(version) from kv_history where key = $1) - $2;`
+	_, err = dbc.ExecContext(ctx, str, key, keep)
+	return err
+}
+
+func queryHistoryPgsql(ctx context.Context, dbc *sqlx.DB, key string, version int, limit int) (rows []historyRow, err error) {
+	str := "select version,value,deleted,expire_at,extract(epoch from created_at)::int8 from kv_history where key = $1"
+	args := []any{key}
+	if version > 0 {
+		str += " and version = $2"
+		args = append(args, version)
+	} else {
+		str += " order by version desc limit $2"
+		args = append(args, limit)
+	}
+
+	var rs *dbsql.Rows
+	if rs, err = dbc.QueryContext(ctx, str, args...); err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+
+	for rs.Next() {
+		h := historyRow{key: key}
+		var exp dbsql.NullInt64
+		if err = rs.Scan(&h.version, &h.value, &h.deleted, &exp, &h.createdAt); err != nil {
+			return nil, err
+		}
+		h.expireAt = exp.Int64
+		rows = append(rows, h)
+	}
+	return rows, rs.Err()
+}
+
+// 包括已过期的记录，用于检查数据
+func queryRawRow(ctx context.Context, dbc execer, key string) (r row, err error) {
+	var exp dbsql.NullInt64
+	err = dbc.QueryRowContext(ctx, "select version,value,expire_at from kv where key = $1", key).Scan(&r.version, &r.value, &exp)
+	r.key = key
+	r.expireAt = exp.Int64
+	return r, err
+}
+
+// 批量读取，包括已过期的记录，不存在的key不返回
+func queryRawRows(ctx context.Context, dbc *sqlx.DB, keys []string) (rows map[string]*row, err error) {
+	var rs *dbsql.Rows
+	if rs, err = dbc.QueryContext(ctx, "select key,value,version,expire_at from kv where key = any($1)", pq.Array(keys)); err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+
+	rows = map[string]*row{}
+	for rs.Next() {
+		r := &row{}
+		var exp dbsql.NullInt64
+		if err = rs.Scan(&r.key, &r.value, &r.version, &exp); err != nil {
+			return nil, err
+		}
+		r.expireAt = exp.Int64
+		rows[r.key] = r
+	}
+	return rows, rs.Err()
+}
@@ -0,0 +1,30 @@
+package rcache
+
+import (
+	"context"
+	"time"
+)
+
+// DataProxy的键值操作，嵌入模式(DataProxy)和远程模式(client.Client)都实现了Store，
+// 调用方只需更换构造函数即可切换。错误与DataProxy一致，Error()返回err_xxx错误码。
+// 远程模式下cacheTimeout由服务端决定，传入的值被忽略。
+// 多key事务(Txn)、Scan、历史版本(GetVersion、History)、Watch、Consume以及运维接口只在嵌入模式下提供
+type Store interface {
+	Get(ctx context.Context, key string, cacheTimeout ...int) (value string, ver int, err error)
+	GetBytes(ctx context.Context, key string, cacheTimeout ...int) (value []byte, ver int, err error)
+	Set(ctx context.Context, key string, value string, cacheTimeout ...int) (ver int, err error)
+	SetWithVersion(ctx context.Context, key string, value string, version int, cacheTimeout ...int) (ver int, err error)
+	SetBytes(ctx context.Context, key string, value []byte, cacheTimeout ...int) (ver int, err error)
+	SetBytesWithVersion(ctx context.Context, key string, value []byte, version int, cacheTimeout ...int) (ver int, err error)
+	SetNX(ctx context.Context, key string, value string, cacheTimeout ...int) (ver int, err error)
+	SetIfExists(ctx context.Context, key string, value string, cacheTimeout ...int) (ver int, err error)
+	SetWithExpiry(ctx context.Context, key string, value string, expireAt time.Time, cacheTimeout ...int) (ver int, err error)
+	ExpireAt(ctx context.Context, key string, expireAt time.Time, cacheTimeout ...int) (ver int, err error)
+	Delete(ctx context.Context, key string, cacheTimeout ...int) (err error)
+	CompareAndDelete(ctx context.Context, key string, version int, cacheTimeout ...int) (err error)
+	IncrBy(ctx context.Context, key string, delta int64, cacheTimeout ...int) (value int64, ver int, err error)
+	DecrBy(ctx context.Context, key string, delta int64, cacheTimeout ...int) (value int64, ver int, err error)
+	Update(ctx context.Context, key string, fn func(old string, exists bool) (string, error), cacheTimeout ...int) (ver int, err error)
+}
+
+var _ Store = (*DataProxy)(nil)
@@ -0,0 +1,391 @@
+package rcache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	dbsql "database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+type Format int
+
+const (
+	FormatJSONL Format = iota //每行一个{"key","value","version","expire_at"}，非UTF-8的value保存在value_base64中
+	FormatCopy                //pgsql COPY的text格式，列为key,value,version,expire_at，可以直接COPY kv FROM STDIN
+)
+
+type ImportMode int
+
+const (
+	ImportOverwrite    ImportMode = iota //覆盖已有的记录，版本号取两者中较大的值并递增
+	ImportSkipExisting                   //只写入不存在(或已过期)的key
+	ImportNewerWins                      //只在导入的版本号更高时覆盖
+)
+
+type ImportResult struct {
+	Rows      int      //读取的记录数
+	Written   int      //写入数据库的记录数
+	Conflicts []string //导入期间在redis中被修改、缓存未能清除的key
+}
+
+// 导入时每批写入的记录数
+const importBatch = 1000
+
+type transferRecord struct {
+	key      string
+	value    []byte
+	version  int
+	expireAt int64
+}
+
+type jsonRecord struct {
+	Key         string  `json:"key"`
+	Value       *string `json:"value,omitempty"`
+	ValueBase64 []byte  `json:"value_base64,omitempty"`
+	Version     int     `json:"version"`
+	ExpireAt    int64   `json:"expire_at,omitempty"`
+}
+
+// value列是否为bytea，bytea与varchar在COPY格式中的表示不同
+func valueIsBytea(ctx context.Context, q interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *dbsql.Row
+}) (bytea bool, err error) {
+	var typ string
+	err = q.QueryRowContext(ctx, `select data_type from information_schema.columns 
+	where table_name = 'kv' and column_name = 'value' and table_schema = any(current_schemas(false)) limit 1`).Scan(&typ)
+	return typ == "bytea", err
+}
+
+// 导出所有未过期的key。先将dirty数据写回数据库，再以一条查询读取，导出的是写回之后某一时刻的快照。
+// 写回失败的dead letter不包括在内。value按数据库中保存的原样导出，压缩和加密的数据需要导入到使用相同配置的环境
+func (p *DataProxy) Export(ctx context.Context, w io.Writer, format Format) (n int, err error) {
+	if err = p.SyncDirtyToDB(ctx); err != nil {
+		return 0, err
+	}
+
+	var bytea bool
+	if format == FormatCopy {
+		if bytea, err = valueIsBytea(ctx, p.dbc); err != nil {
+			return 0, err
+		}
+	}
+
+	rs, err := p.dbc.QueryContext(ctx, "select key,value,version,expire_at from kv where "+notExpired+` order by key COLLATE "C"`)
+	if err != nil {
+		return 0, err
+	}
+	defer rs.Close()
+
+	bw := bufio.NewWriter(w)
+	for rs.Next() {
+		var r transferRecord
+		var exp dbsql.NullInt64
+		if err = rs.Scan(&r.key, &r.value, &r.version, &exp); err != nil {
+			return n, err
+		}
+		r.expireAt = exp.Int64
+		if err = writeRecord(bw, format, bytea, r); err != nil {
+			return n, err
+		}
+		n++
+	}
+	if err = rs.Err(); err != nil {
+		return n, err
+	}
+	return n, bw.Flush()
+}
+
+func writeRecord(w *bufio.Writer, format Format, bytea bool, r transferRecord) error {
+	if format == FormatJSONL {
+		jr := jsonRecord{Key: r.key, Version: r.version, ExpireAt: r.expireAt}
+		if utf8.Valid(r.value) {
+			v := string(r.value)
+			jr.Value = &v
+		} else {
+			jr.ValueBase64 = r.value
+		}
+		b, err := json.Marshal(jr)
+		if err != nil {
+			return err
+		}
+		w.Write(b)
+		return w.WriteByte('\n')
+	}
+
+	w.WriteString(copyEscape(r.key))
+	w.WriteByte('\t')
+	if bytea {
+		//bytea的hex格式，反斜杠需要按COPY的规则转义
+		w.WriteString(`\\x`)
+		w.WriteString(hex.EncodeToString(r.value))
+	} else {
+		w.WriteString(copyEscape(string(r.value)))
+	}
+	w.WriteByte('\t')
+	w.WriteString(strconv.Itoa(r.version))
+	w.WriteByte('\t')
+	if r.expireAt > 0 {
+		w.WriteString(strconv.FormatInt(r.expireAt, 10))
+	} else {
+		w.WriteString(`\N`)
+	}
+	return w.WriteByte('\n')
+}
+
+var copyEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+
+func copyEscape(s string) string {
+	return copyEscaper.Replace(s)
+}
+
+// COPY text格式的反转义，\N由调用方处理
+func copyUnescape(s string) (string, error) {
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i++; i == len(s) {
+			return "", errors.New("trailing backslash")
+		}
+		switch c := s[i]; c {
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'v':
+			b.WriteByte('\v')
+		case 'x':
+			j := i + 1
+			for j < len(s) && j < i+3 && isHex(s[j]) {
+				j++
+			}
+			if j == i+1 {
+				b.WriteByte('x')
+				continue
+			}
+			v, _ := strconv.ParseUint(s[i+1:j], 16, 8)
+			b.WriteByte(byte(v))
+			i = j - 1
+		default:
+			if c >= '0' && c <= '7' {
+				j := i
+				for j < len(s) && j < i+3 && s[j] >= '0' && s[j] <= '7' {
+					j++
+				}
+				v, _ := strconv.ParseUint(s[i:j], 8, 8)
+				b.WriteByte(byte(v))
+				i = j - 1
+			} else {
+				b.WriteByte(c)
+			}
+		}
+	}
+	return b.String(), nil
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func parseRecord(line []byte, format Format, bytea bool) (r transferRecord, err error) {
+	if format == FormatJSONL {
+		var jr jsonRecord
+		if err = json.Unmarshal(line, &jr); err != nil {
+			return r, err
+		}
+		r = transferRecord{key: jr.Key, value: jr.ValueBase64, version: jr.Version, expireAt: jr.ExpireAt}
+		if jr.Value != nil {
+			r.value = []byte(*jr.Value)
+		}
+	} else {
+		cols := strings.Split(string(line), "\t")
+		if len(cols) != 4 {
+			return r, fmt.Errorf("expected 4 columns, got %d", len(cols))
+		}
+		if r.key, err = copyUnescape(cols[0]); err != nil {
+			return r, err
+		}
+		var value string
+		if value, err = copyUnescape(cols[1]); err != nil {
+			return r, err
+		}
+		if bytea && strings.HasPrefix(value, `\x`) {
+			if r.value, err = hex.DecodeString(value[2:]); err != nil {
+				return r, err
+			}
+		} else {
+			r.value = []byte(value)
+		}
+		if r.version, err = strconv.Atoi(cols[2]); err != nil {
+			return r, err
+		}
+		if cols[3] != `\N` {
+			if r.expireAt, err = strconv.ParseInt(cols[3], 10, 64); err != nil {
+				return r, err
+			}
+		}
+	}
+	switch {
+	case r.key == "":
+		err = errors.New("empty key")
+	case r.version <= 0:
+		err = errors.New("version must be positive")
+	case r.expireAt < 0:
+		err = errors.New("expire_at must not be negative")
+	}
+	return r, err
+}
+
+// 导入Export导出的数据，按批通过COPY写入临时表后合并到kv，并删除写入的key在redis中的缓存。
+// 导入前先写回dirty数据，导入期间被修改的key无法清除缓存，在ImportResult.Conflicts中返回
+func (p *DataProxy) Import(ctx context.Context, r io.Reader, format Format, mode ImportMode) (res ImportResult, err error) {
+	if err = p.SyncDirtyToDB(ctx); err != nil {
+		return res, err
+	}
+
+	bytea, err := valueIsBytea(ctx, p.dbc)
+	if err != nil {
+		return res, err
+	}
+
+	br := bufio.NewReader(r)
+	batch := map[string]transferRecord{}
+	for line := 1; ; line++ {
+		b, rerr := br.ReadBytes('\n')
+		if rerr != nil && rerr != io.EOF {
+			return res, rerr
+		}
+		if b = bytes.TrimRight(b, "\r\n"); len(b) > 0 {
+			rec, err := parseRecord(b, format, bytea)
+			if err != nil {
+				return res, fmt.Errorf("line %d: %w", line, err)
+			}
+			res.Rows++
+			//同一批中重复的key只保留一条，否则ON CONFLICT会报错
+			if old, ok := batch[rec.key]; !ok || mode != ImportNewerWins || rec.version >= old.version {
+				batch[rec.key] = rec
+			}
+		}
+		if len(batch) >= importBatch || (rerr == io.EOF && len(batch) > 0) {
+			if err = p.importBatch(ctx, batch, bytea, mode, &res); err != nil {
+				return res, err
+			}
+			batch = map[string]transferRecord{}
+		}
+		if rerr == io.EOF {
+			return res, nil
+		}
+	}
+}
+
+func (p *DataProxy) importBatch(ctx context.Context, batch map[string]transferRecord, bytea bool, mode ImportMode, res *ImportResult) error {
+	var merge string
+	switch mode {
+	case ImportOverwrite:
+		merge = `do update set value = excluded.value,version = greatest(kv.version+1,excluded.version),expire_at = excluded.expire_at`
+	case ImportSkipExisting:
+		merge = `do update set value = excluded.value,version = greatest(kv.version+1,excluded.version),expire_at = excluded.expire_at 
+		where kv.expire_at <= extract(epoch from now())`
+	case ImportNewerWins:
+		merge = `do update set value = excluded.value,version = excluded.version,expire_at = excluded.expire_at 
+		where kv.version < excluded.version`
+	default:
+		return fmt.Errorf("unknown import mode %d", mode)
+	}
+
+	cc, cancel := context.WithTimeout(ctx, time.Second*30)
+	versions := map[string]int{}
+	keys, err := func() (keys []string, err error) {
+		tx, err := p.dbc.BeginTxx(cc, nil)
+		if err != nil {
+			return nil, err
+		}
+		defer tx.Rollback()
+
+		if _, err = tx.ExecContext(cc, "create temp table kv_import (like kv including defaults) on commit drop"); err != nil {
+			return nil, err
+		}
+		stmt, err := tx.PrepareContext(cc, pq.CopyIn("kv_import", "key", "value", "version", "expire_at"))
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range batch {
+			var value any = string(r.value)
+			if bytea {
+				value = r.value
+			}
+			if _, err = stmt.ExecContext(cc, r.key, value, r.version, nullExpire(r.expireAt)); err != nil {
+				stmt.Close()
+				return nil, err
+			}
+		}
+		if _, err = stmt.ExecContext(cc); err != nil {
+			stmt.Close()
+			return nil, err
+		}
+		if err = stmt.Close(); err != nil {
+			return nil, err
+		}
+
+		rs, err := tx.QueryContext(cc, rcacheMark+`insert into kv("key","value","version","expire_at") 
+		select "key","value","version","expire_at" from kv_import on conflict(key) `+merge+` returning key,version`)
+		if err != nil {
+			return nil, err
+		}
+		for rs.Next() {
+			var key string
+			var version int
+			if err = rs.Scan(&key, &version); err != nil {
+				rs.Close()
+				return nil, err
+			}
+			keys = append(keys, key)
+			versions[key] = version
+		}
+		if err = rs.Err(); err != nil {
+			return nil, err
+		}
+		return keys, tx.Commit()
+	}()
+	if err = p.checkError(cc, cancel, err); err != nil {
+		return err
+	}
+	res.Written += len(keys)
+
+	//删除缓存，下次读取时加载导入的数据
+	if p.hotkey != nil {
+		for _, key := range keys {
+			p.hotkey.invalidate(key)
+		}
+	}
+	cc, cancel = context.WithTimeout(ctx, time.Second*5)
+	dirty, err := redisEvictPipeline(cc, p.redisC, keys)
+	if err = p.checkError(cc, cancel, err); err != nil {
+		return err
+	}
+	res.Conflicts = append(res.Conflicts, dirty...)
+	p.publishVersions(ctx, versions, "set")
+	return nil
+}
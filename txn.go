@@ -0,0 +1,211 @@
+package rcache
+
+import (
+	"context"
+	dbsql "database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+type OpType int
+
+const (
+	OpSet    OpType = iota //写入Value
+	OpDelete               //删除
+	OpCheck                //只校验版本号
+)
+
+func (t OpType) String() string {
+	switch t {
+	case OpDelete:
+		return "del"
+	case OpCheck:
+		return "check"
+	default:
+		return "set"
+	}
+}
+
+type Op struct {
+	Type    OpType
+	Key     string
+	Value   string
+	Version int //大于0时需要版本号一致
+}
+
+// 事务中某个操作失败，Error()与单key操作返回的错误一致
+type TxnError struct {
+	Index int //失败的操作在ops中的序号
+	err   error
+}
+
+func (e *TxnError) Error() string {
+	return e.err.Error()
+}
+
+func (e *TxnError) Unwrap() error {
+	return e.err
+}
+
+// 原子的执行一组操作：所有版本号校验通过后才写入，任一失败则都不写入。
+// 写入的key在同步时会在同一个数据库事务中写回，数据库不会看到事务的一部分。
+// 返回每个操作之后key的版本号。
+// redis cluster下所有key需要在同一个hash slot(使用相同的hash tag，如{user:1}:profile)，否则返回err_cross_slot
+func (p *DataProxy) Txn(ctx context.Context, ops []Op, cacheTimeout ...int) (versions []int, err error) {
+	if len(ops) == 0 {
+		return nil, nil
+	}
+
+	seen := map[string]bool{}
+	ops = append([]Op{}, ops...)
+	for i, op := range ops {
+		if seen[op.Key] {
+			return nil, errors.New("err_duplicate_key")
+		}
+		seen[op.Key] = true
+		if p.cluster && keySlot(op.Key) != keySlot(ops[0].Key) {
+			return nil, errors.New("err_cross_slot")
+		}
+		if p.hotkey != nil {
+			p.hotkey.invalidate(op.Key)
+		}
+		if op.Type == OpSet {
+			if ops[i].Value, err = p.encodeValue(ctx, op.Key, op.Value); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if !p.redisAllow() {
+		return nil, errors.New("err_redis_unavailable")
+	}
+
+	//一组key使用其中最长的缓存时间
+	cacheTime := 0
+	for _, op := range ops {
+		cacheTime = max(cacheTime, p.cacheTime(op.Key, cacheTimeout))
+	}
+	var index int
+	versions, index, err = redisTxn(ctx, p.redisC, ops, cacheTime, p.recorder())
+	p.redisDone(err)
+	//不在redis中的key从数据库加载后重试
+	for i := 0; i < len(ops) && err != nil && err.Error() == "err_not_in_redis"; i++ {
+		if !p.coldAllow() {
+			return nil, errors.New("err_cold_unavailable")
+		}
+
+		key := ops[index].Key
+		start := time.Now()
+		version, value, expireAt, e := queryRow(ctx, p.dbc, key)
+		p.metrics.DBLoad(key, time.Since(start), e)
+		p.coldDone(e)
+		if e != nil && e != dbsql.ErrNoRows {
+			return nil, e
+		}
+
+		if _, _, _, e = redisLoadGet(ctx, p.redisC, key, version, value, expireAt, cacheTime, p.staleGrace); e != nil && e.Error() != "err_not_exist" {
+			return nil, e
+		}
+		versions, index, err = redisTxn(ctx, p.redisC, ops, cacheTime, p.recorder())
+	}
+
+	if err != nil && strings.HasPrefix(err.Error(), "err_") {
+		if index < len(ops) {
+			p.versionChecked(ops[index].Key, err)
+		}
+		err = &TxnError{Index: index, err: err}
+	}
+	return versions, err
+}
+
+// 在一个数据库事务中写回一组dirty key，组已不存在时返回false
+func (p *DataProxy) syncGroup(ctx context.Context, ks slotKeys, gid string) (ok bool, err error) {
+	cc, cancel := context.WithTimeout(ctx, time.Second)
+	members, err := redisGroupSnapshot(cc, p.redisC, ks, gid)
+	if err = p.checkError(cc, cancel, err); err != nil || len(members) == 0 {
+		return false, err
+	}
+	for _, m := range members {
+		if m.dead {
+			//组中有key等待人工处理，整组跳过
+			return true, nil
+		}
+	}
+
+	dbversions := make([]int, len(members))
+	cc, cancel = context.WithTimeout(ctx, time.Second*5)
+	start := time.Now()
+	err = func() error {
+		tx, err := p.dbc.BeginTxx(cc, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		for i, m := range members {
+			dbversions[i] = m.version
+			switch {
+			case m.blind && m.deleted:
+				dbversions[i], err = deleteBlindPgsql(cc, tx, m.key, m.version)
+			case m.blind:
+				dbversions[i], err = upsertBlindPgsql(cc, tx, m.key, m.value, m.version, m.expireAt)
+			case m.deleted:
+				err = writebackDeletePgsql(cc, tx, m.key, m.version)
+			default:
+				err = writebackPgsql(cc, tx, m.key, m.value, m.version, m.expireAt)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	}()
+	err = p.checkError(cc, cancel, err)
+	//整组在一个事务中写回，每个key记录事务的耗时
+	elapsed := time.Since(start)
+	for _, m := range members {
+		p.metrics.Writeback(m.key, elapsed, err)
+	}
+	if poisonError(err) {
+		//整组记录为dead letter，同步时跳过
+		for _, m := range members {
+			if err := p.addDeadLetter(ctx, m.key, m.version, err); err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	for i, m := range members {
+		cc, cancel = context.WithTimeout(ctx, time.Second)
+		if m.blind {
+			err = redisRebase(cc, p.redisC, m.key, m.version, dbversions[i], p.staleGrace)
+		} else {
+			err = redisClearDirty(cc, p.redisC, m.key, m.version, p.staleGrace)
+		}
+		if err = p.checkError(cc, cancel, err); err != nil {
+			if !m.blind {
+				p.metrics.ClearDirtyFailed(m.key, err)
+			}
+			return false, err
+		}
+	}
+
+	cc, cancel = context.WithTimeout(ctx, time.Second)
+	err = redisClearGroup(cc, p.redisC, ks, gid)
+	if err = p.checkError(cc, cancel, err); err != nil {
+		return false, err
+	}
+
+	//整组重试成功后清除成员的dead letter记录
+	keys := make([]string, len(members))
+	for i, m := range members {
+		keys[i] = m.key
+	}
+	cc, cancel = context.WithTimeout(ctx, time.Second)
+	err = p.redisC.HDel(cc, ks.deadLetter, keys...).Err()
+	return true, p.checkError(cc, cancel, err)
+}
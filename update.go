@@ -0,0 +1,107 @@
+package rcache
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+)
+
+type RetryPolicy struct {
+	MaxAttempts int           //最多尝试次数，默认10
+	BaseDelay   time.Duration //首次重试前的等待时间，之后每次翻倍，默认5ms
+	MaxDelay    time.Duration //等待时间上限，默认500ms
+	Jitter      float64       //等待时间随机减少的比例[0,1]，默认0.5
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 10,
+	BaseDelay:   5 * time.Millisecond,
+	MaxDelay:    500 * time.Millisecond,
+	Jitter:      0.5,
+}
+
+// 设置Update使用的重试策略
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(p *DataProxy) {
+		p.retry = policy
+	}
+}
+
+func (r RetryPolicy) normalize() RetryPolicy {
+	if r.MaxAttempts <= 0 {
+		r.MaxAttempts = DefaultRetryPolicy.MaxAttempts
+	}
+	if r.BaseDelay <= 0 {
+		r.BaseDelay = DefaultRetryPolicy.BaseDelay
+	}
+	if r.MaxDelay <= 0 {
+		r.MaxDelay = DefaultRetryPolicy.MaxDelay
+	}
+	if r.Jitter < 0 {
+		r.Jitter = 0
+	} else if r.Jitter > 1 {
+		r.Jitter = 1
+	}
+	return r
+}
+
+// 第attempt次失败后的等待时间
+func (r RetryPolicy) backoff(attempt int) time.Duration {
+	d := r.BaseDelay << (attempt - 1)
+	if d > r.MaxDelay || d <= 0 {
+		d = r.MaxDelay
+	}
+	return d - time.Duration(float64(d)*r.Jitter*rand.Float64())
+}
+
+// 读取-修改-写入，版本号冲突时按代理的重试策略自动重试。
+// fn的exists为false表示key不存在，此时只在key仍不存在时写入。fn返回错误则放弃更新。
+func (p *DataProxy) Update(ctx context.Context, key string, fn func(old string, exists bool) (string, error), cacheTimeout ...int) (ver int, err error) {
+	return p.UpdateWithPolicy(ctx, key, p.retry, fn, cacheTimeout...)
+}
+
+func (p *DataProxy) UpdateWithPolicy(ctx context.Context, key string, policy RetryPolicy, fn func(old string, exists bool) (string, error), cacheTimeout ...int) (ver int, err error) {
+	return UpdateStore(ctx, p, key, policy, fn, cacheTimeout...)
+}
+
+// 在任意Store上执行读取-修改-写入，远程客户端与DataProxy共用同样的重试逻辑
+func UpdateStore(ctx context.Context, s Store, key string, policy RetryPolicy, fn func(old string, exists bool) (string, error), cacheTimeout ...int) (ver int, err error) {
+	policy = policy.normalize()
+	for attempt := 1; ; attempt++ {
+		var old string
+		exists := true
+		if old, ver, err = s.Get(ctx, key, cacheTimeout...); err != nil {
+			switch err.Error() {
+			case "err_not_exist":
+				exists = false
+			case "err_stale":
+				//陈旧数据仍在redis中，版本号校验依然有效
+			default:
+				return 0, err
+			}
+		}
+
+		var value string
+		if value, err = fn(old, exists); err != nil {
+			return 0, err
+		}
+
+		if exists {
+			ver, err = s.SetWithVersion(ctx, key, value, ver, cacheTimeout...)
+		} else {
+			ver, err = s.SetNX(ctx, key, value, cacheTimeout...)
+		}
+
+		if err == nil {
+			return ver, nil
+		} else if (err.Error() != "err_version_not_match" && err.Error() != "err_exist") || attempt >= policy.MaxAttempts {
+			return 0, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(policy.backoff(attempt)):
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package rcache
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// 不一致的类型
+const (
+	DivergeCacheBehind  = "cache_behind"   //干净的缓存版本号低于数据库
+	DivergeCacheAhead   = "cache_ahead"    //干净的缓存版本号高于数据库，写回丢失
+	DivergeValue        = "value_mismatch" //版本号相同但内容(值、删除标记、过期时间)不同
+	DivergeMissingInDB  = "missing_in_db"  //干净的缓存在数据库中没有记录，写回丢失
+	DivergeDeadLetter   = "dead_letter"    //数据库拒绝写入的dirty key
+	DivergeRepairFailed = "repair_failed"
+)
+
+type VerifyOptions struct {
+	Prefix           string
+	SampleRate       float64 //(0,1)之间时按比例抽样检查，否则检查所有的key
+	BatchSize        int     //每批检查的key数量，默认500
+	Repair           bool    //修复发现的不一致
+	WritebackMissing bool    //Repair时把数据库中没有记录的缓存写回，记录可能是在数据库中被直接删除的，默认只报告
+	MaxDivergences   int     //报告中最多记录的不一致数量，超出的只计数，默认1000
+	Progress         func(VerifyReport)
+}
+
+type Divergence struct {
+	Key          string `json:"key"`
+	Kind         string `json:"kind"`
+	CacheVersion int    `json:"cache_version"`
+	DBVersion    int    `json:"db_version"`       //数据库中没有记录时为0
+	Repair       string `json:"repair,omitempty"` //evict或writeback，为空时只报告
+	Repaired     bool   `json:"repaired"`
+	Error        string `json:"error,omitempty"`
+}
+
+type VerifyReport struct {
+	Started     time.Time      `json:"started"`
+	Finished    time.Time      `json:"finished"`
+	DBRows      int            `json:"db_rows"`     //检查的数据库记录
+	CachedKeys  int            `json:"cached_keys"` //检查的redis key
+	Dirty       int            `json:"dirty"`       //等待写回，不参与比较
+	Counts      map[string]int `json:"counts"`      //按类型统计的不一致数量
+	Repaired    int            `json:"repaired"`
+	Divergences []Divergence   `json:"divergences"`
+	Truncated   bool           `json:"truncated"` //不一致数量超过MaxDivergences
+}
+
+// 比较redis和数据库中的数据。先按key顺序遍历数据库，再遍历redis找出数据库中没有的key。
+// dirty key等待写回，不认为是不一致。修复时以数据库为准删除缓存，写回丢失的版本则重新写回数据库，
+// 都在版本号不变的前提下执行，检查之后有新的写入时放弃修复。数据库中没有记录的缓存只在WritebackMissing时写回
+func (p *DataProxy) Verify(ctx context.Context, opt VerifyOptions) (report VerifyReport, err error) {
+	if opt.BatchSize <= 0 {
+		opt.BatchSize = 500
+	}
+	if opt.MaxDivergences <= 0 {
+		opt.MaxDivergences = 1000
+	}
+	report.Started = time.Now()
+	report.Counts = map[string]int{}
+	report.Divergences = []Divergence{}
+	defer func() {
+		report.Finished = time.Now()
+	}()
+
+	sample := func() bool {
+		return opt.SampleRate <= 0 || opt.SampleRate >= 1 || rand.Float64() < opt.SampleRate
+	}
+
+	var cond string
+	var args []any
+	if opt.Prefix != "" {
+		cond = `key like $1 escape '\'`
+		args = []any{likePrefix(opt.Prefix)}
+	}
+
+	//数据库中的key
+	for after := ""; ; {
+		cc, cancel := context.WithTimeout(ctx, time.Second*5)
+		rows, err := queryRowsAfter(cc, p.dbc, cond, args, after, opt.BatchSize)
+		if err = p.checkError(cc, cancel, err); err != nil {
+			return report, err
+		}
+		db := map[string]*row{}
+		keys := []string{}
+		for i := range rows {
+			if sample() {
+				db[rows[i].key] = &rows[i]
+				keys = append(keys, rows[i].key)
+			}
+		}
+		report.DBRows += len(keys)
+		if err = p.verifyBatch(ctx, opt, keys, db, &report); err != nil {
+			return report, err
+		}
+		if opt.Progress != nil {
+			opt.Progress(report)
+		}
+		if len(rows) < opt.BatchSize {
+			break
+		}
+		after = rows[len(rows)-1].key
+	}
+
+	//只在redis中的key
+	match := "*"
+	if opt.Prefix != "" {
+		match = globPrefix(opt.Prefix)
+	}
+	nodes, err := p.nodes(ctx)
+	if err != nil {
+		return report, err
+	}
+	for _, node := range nodes {
+		for cursor := uint64(0); ; {
+			cc, cancel := context.WithTimeout(ctx, time.Second*5)
+			keys, next, err := node.ScanType(cc, cursor, match, int64(opt.BatchSize), "hash").Result()
+			if err = p.checkError(cc, cancel, err); err != nil {
+				return report, err
+			}
+			candidates := []string{}
+			for _, key := range keys {
+				//跳过__dirty__等内部使用的key
+				if !isInternalKey(key) && sample() {
+					candidates = append(candidates, key)
+				}
+			}
+			if len(candidates) > 0 {
+				cc, cancel = context.WithTimeout(ctx, time.Second*5)
+				rows, err := queryRowsAfter(cc, p.dbc, "key = any($1)", []any{pq.Array(candidates)}, "", len(candidates))
+				if err = p.checkError(cc, cancel, err); err != nil {
+					return report, err
+				}
+				inDB := map[string]bool{}
+				for _, r := range rows {
+					inDB[r.key] = true
+				}
+				//数据库中存在的key已经在上一步检查过
+				missing := []string{}
+				for _, key := range candidates {
+					if !inDB[key] {
+						missing = append(missing, key)
+					}
+				}
+				report.CachedKeys += len(missing)
+				if err = p.verifyBatch(ctx, opt, missing, map[string]*row{}, &report); err != nil {
+					return report, err
+				}
+			}
+			if opt.Progress != nil {
+				opt.Progress(report)
+			}
+			if cursor = next; cursor == 0 {
+				break
+			}
+		}
+	}
+	return report, nil
+}
+
+// 比较一批key，db中没有的key表示数据库中没有未过期的记录
+func (p *DataProxy) verifyBatch(ctx context.Context, opt VerifyOptions, keys []string, db map[string]*row, report *VerifyReport) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	cc, cancel := context.WithTimeout(ctx, time.Second*5)
+	cached, err := redisPeekPipeline(cc, p.redisC, keys)
+	if err = p.checkError(cc, cancel, err); err != nil {
+		return err
+	}
+	var dead map[string]int
+	if dead, err = p.deadLetterVersions(ctx, keys); err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	var candidates []string
+	for _, key := range keys {
+		c, ok := cached[key]
+		if !ok {
+			continue
+		}
+		if c.dirty || c.blind {
+			report.Dirty++
+			if v, ok := dead[key]; ok && v == c.version {
+				p.reportDivergence(opt, report, Divergence{Key: key, Kind: DivergeDeadLetter, CacheVersion: c.version, DBVersion: dbVersion(db[key])})
+			}
+			continue
+		}
+		if classify(c, db[key], now).Kind != "" {
+			candidates = append(candidates, key)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	//db可能是一批之前读取的，期间的写入和写回会被误认为不一致，重新读取数据库后再读取缓存，
+	//缓存版本号没有变化时数据库中已经包含了这个版本之前的写回
+	cc, cancel = context.WithTimeout(ctx, time.Second*5)
+	fresh, err := queryRawRows(cc, p.dbc, candidates)
+	if err = p.checkError(cc, cancel, err); err != nil {
+		return err
+	}
+	cc, cancel = context.WithTimeout(ctx, time.Second*5)
+	recheck, err := redisPeekPipeline(cc, p.redisC, candidates)
+	if err = p.checkError(cc, cancel, err); err != nil {
+		return err
+	}
+
+	now = time.Now().Unix()
+	for _, key := range candidates {
+		c, ok := recheck[key]
+		if !ok || c.dirty || c.blind || c.version != cached[key].version {
+			continue
+		}
+		d := classify(c, fresh[key], now)
+		if d.Kind == "" {
+			continue
+		}
+		if d.Kind == DivergeMissingInDB && opt.WritebackMissing {
+			d.Repair = "writeback"
+		}
+		if opt.Repair && d.Repair != "" {
+			p.repair(ctx, c, &d)
+			if d.Repaired {
+				report.Repaired++
+			}
+		}
+		p.reportDivergence(opt, report, d)
+	}
+	return nil
+}
+
+func (p *DataProxy) reportDivergence(opt VerifyOptions, report *VerifyReport, d Divergence) {
+	report.Counts[d.Kind]++
+	if d.Error != "" {
+		report.Counts[DivergeRepairFailed]++
+	}
+	if len(report.Divergences) < opt.MaxDivergences {
+		report.Divergences = append(report.Divergences, d)
+	} else {
+		report.Truncated = true
+	}
+}
+
+func dbVersion(r *row) int {
+	if r == nil {
+		return 0
+	}
+	return r.version
+}
+
+// 比较干净的缓存和数据库记录，一致时返回的Kind为空
+func classify(c cachedRow, db *row, now int64) (d Divergence) {
+	d.Key = c.key
+	d.CacheVersion = c.version
+	d.DBVersion = dbVersion(db)
+	if consistent(c, db, now) {
+		return d
+	}
+	switch {
+	case db == nil:
+		//缓存是唯一的副本，不能删除；也可能是数据库中被直接删除的记录，不能确定时不写回
+		d.Kind = DivergeMissingInDB
+	case c.version < db.version:
+		d.Kind, d.Repair = DivergeCacheBehind, "evict"
+	case c.version > db.version:
+		d.Kind, d.Repair = DivergeCacheAhead, "writeback"
+	default:
+		d.Kind, d.Repair = DivergeValue, "evict"
+	}
+	return d
+}
+
+func (p *DataProxy) repair(ctx context.Context, c cachedRow, d *Divergence) {
+	var err error
+	cc, cancel := context.WithTimeout(ctx, time.Second)
+	switch d.Repair {
+	case "evict":
+		//缓存被修改过时放弃
+		_, err = redisEvict(cc, p.redisC, c.key, c.version)
+		if err == nil && p.hotkey != nil {
+			p.hotkey.invalidate(c.key)
+		}
+	case "writeback":
+		//数据库中只有更低的版本才会被覆盖
+		if c.deleted {
+			err = writebackDeletePgsql(cc, p.dbc, c.key, c.version)
+		} else {
+			err = writebackPgsql(cc, p.dbc, c.key, c.value, c.version, c.expireAt)
+		}
+	}
+	if err = p.checkError(cc, cancel, err); err != nil {
+		d.Error = err.Error()
+	} else {
+		d.Repaired = true
+	}
+}
@@ -0,0 +1,223 @@
+package rcache
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	redis "github.com/redis/go-redis/v9"
+)
+
+// 每次写入发布到changeChannel+key，见luaNotify
+const changeChannel = "__change__:"
+
+type Event struct {
+	Key     string
+	Version int //核对时发现已删除的key为0
+	Deleted bool
+}
+
+func changePayload(version int, deleted bool) string {
+	if deleted {
+		return strconv.Itoa(version) + " del"
+	}
+	return strconv.Itoa(version)
+}
+
+func parseChange(channel string, payload string) (e Event, ok bool) {
+	if e.Key, ok = strings.CutPrefix(channel, changeChannel); !ok {
+		return e, false
+	}
+	version, flag, _ := strings.Cut(payload, " ")
+	var err error
+	if e.Version, err = strconv.Atoi(version); err != nil {
+		return e, false
+	}
+	e.Deleted = flag == "del"
+	return e, true
+}
+
+// 不经过lua脚本直接写入数据库后发布变化，开启了WithCDC时同时写入变更流。
+// 失败时Watch由重连后的核对补上，变更流的消费者只能通过全量核对发现
+func (p *DataProxy) publish(ctx context.Context, key string, version int, op string) {
+	p.publishVersions(ctx, map[string]int{key: version}, op)
+}
+
+func (p *DataProxy) publishVersions(ctx context.Context, versions map[string]int, op string) {
+	if len(versions) == 0 {
+		return
+	}
+	cc, cancel := context.WithTimeout(ctx, time.Second*5)
+	pipe := p.redisC.Pipeline()
+	for key, version := range versions {
+		pipe.Publish(cc, changeChannel+key, changePayload(version, op == "del"))
+		if p.capturing() {
+			pipe.XAdd(cc, p.cdc.xadd(key, version, op))
+		}
+	}
+	pipe.Exec(cc)
+	cancel()
+}
+
+type watcher struct {
+	p        *DataProxy
+	keys     []string
+	prefixes []string
+	ch       chan Event
+	//已通知的版本号，不存在的key不记录
+	seen map[string]int
+}
+
+// 监听key的变化，keysOrPrefixes中以*结尾的按前缀匹配，其它按key匹配。ctx结束时关闭返回的channel。
+// 连接断开后自动重连，重连后重新读取所有监听的key，断开期间的变化也会通知，
+// 所以同一个版本可能通知多次，但不会遗漏最新的版本。前缀监听需要在内存中记录匹配的所有key的版本号
+func (p *DataProxy) Watch(ctx context.Context, keysOrPrefixes ...string) <-chan Event {
+	w := &watcher{p: p, ch: make(chan Event, 64), seen: map[string]int{}}
+	for _, k := range keysOrPrefixes {
+		if prefix, ok := strings.CutSuffix(k, "*"); ok {
+			w.prefixes = append(w.prefixes, prefix)
+		} else {
+			w.keys = append(w.keys, k)
+		}
+	}
+	go w.run(ctx)
+	return w.ch
+}
+
+func (w *watcher) run(ctx context.Context) {
+	defer close(w.ch)
+
+	pubsub := w.p.redisC.Subscribe(ctx)
+	defer pubsub.Close()
+	//订阅失败时在重连后重新订阅
+	if len(w.keys) > 0 {
+		channels := make([]string, len(w.keys))
+		for i, key := range w.keys {
+			channels[i] = changeChannel + key
+		}
+		pubsub.Subscribe(ctx, channels...)
+	}
+	if len(w.prefixes) > 0 {
+		patterns := make([]string, len(w.prefixes))
+		for i, prefix := range w.prefixes {
+			patterns[i] = globPrefix(changeChannel + prefix)
+		}
+		pubsub.PSubscribe(ctx, patterns...)
+	}
+
+	//订阅之后读取当前的版本号，之后的变化都会收到
+	broken := w.recheck(ctx, false) != nil
+	backoff := time.Duration(0)
+	for {
+		msg, err := pubsub.ReceiveTimeout(ctx, time.Second*30)
+		if ctx.Err() != nil {
+			return
+		}
+		var ne net.Error
+		if err != nil && errors.As(err, &ne) && ne.Timeout() {
+			//长时间没有消息时探测连接
+			err = pubsub.Ping(ctx)
+		}
+		if err != nil {
+			broken = true
+			backoff = min(max(backoff*2, time.Millisecond*100), time.Second*5)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			continue
+		}
+		backoff = 0
+
+		if broken {
+			//重连时go-redis会重新订阅，核对断开期间的变化
+			if w.recheck(ctx, true) == nil {
+				broken = false
+			} else if ctx.Err() != nil {
+				return
+			}
+		}
+
+		switch m := msg.(type) {
+		case *redis.Message:
+			if e, ok := parseChange(m.Channel, m.Payload); ok && w.accept(e) {
+				if !w.send(ctx, e) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// 过滤订阅之前发布、已经通过核对通知过的旧版本
+func (w *watcher) accept(e Event) bool {
+	seen, ok := w.seen[e.Key]
+	switch {
+	case e.Deleted:
+		delete(w.seen, e.Key)
+		return true
+	case !ok || e.Version > seen:
+		w.seen[e.Key] = e.Version
+		return true
+	}
+	return false
+}
+
+func (w *watcher) send(ctx context.Context, e Event) bool {
+	select {
+	case w.ch <- e:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// 读取所有监听的key的当前版本号，notify为true时通知与记录不一致的key
+func (w *watcher) recheck(ctx context.Context, notify bool) error {
+	current := map[string]int{}
+	for _, key := range w.keys {
+		_, ver, _, err := w.p.get(ctx, key)
+		if err == nil || err.Error() == "err_stale" {
+			current[key] = ver
+		} else if err.Error() != "err_not_exist" {
+			return err
+		}
+	}
+	for _, prefix := range w.prefixes {
+		err := w.p.ScanAll(ctx, prefix, 500, func(items []ScanItem) error {
+			for _, item := range items {
+				current[item.Key] = item.Version
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	var events []Event
+	for key, ver := range current {
+		if seen, ok := w.seen[key]; !ok || seen != ver {
+			events = append(events, Event{Key: key, Version: ver})
+		}
+	}
+	for key := range w.seen {
+		if _, ok := current[key]; !ok {
+			events = append(events, Event{Key: key, Deleted: true})
+		}
+	}
+	w.seen = current
+
+	if notify {
+		for _, e := range events {
+			if !w.send(ctx, e) {
+				return ctx.Err()
+			}
+		}
+	}
+	return nil
+}